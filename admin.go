@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/http/pprof"
+	"slices"
+	"strings"
+)
+
+// versionedConfig is the body used by the config api
+type versionedConfig struct {
+	Version uint64 `json:"version"`
+	Config  Config `json:"config"`
+}
+
+// queueState is the body returned by the queue api
+type queueState struct {
+	Paused       bool            `json:"paused"`
+	Depths       map[string]int  `json:"depths"`
+	RecentErrors []deliveryError `json:"recent_errors"`
+}
+
+// startAdminServer starts the admin http server in the background and returns a function that
+// shuts it down
+func startAdminServer(addr string, token string, enablePprof bool, store *ConfigStore) func(context.Context) error {
+	mux := http.NewServeMux()
+
+	// profiles show the environment and memory of the process, so they need the token too
+	if enablePprof && token != "" {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+
+	// the config api allows changes, so is only available when authentication is set up
+	if token != "" {
+		mux.HandleFunc("GET /api/config", handleGetConfig(store))
+		mux.HandleFunc("PUT /api/config", handlePutConfig(store))
+		mux.HandleFunc("GET /api/queue", handleGetQueue)
+		mux.HandleFunc("DELETE /api/queue", handleClearQueue)
+		mux.HandleFunc("POST /api/pause", handlePause(true))
+		mux.HandleFunc("POST /api/resume", handlePause(false))
+	}
+
+	// health checks and avatars don't need the token
+	public := http.NewServeMux()
+	public.HandleFunc("GET /healthz", handleHealthz)
+	if avatars.proxying() {
+		public.HandleFunc("GET /avatars/{key}", handleGetAvatar)
+	}
+	public.Handle("/", requireToken(token, mux))
+
+	server := &http.Server{
+		Addr:    addr,
+		Handler: public,
+	}
+
+	go func() {
+		slog.Info("admin server listening", "addr", addr, "pprof", enablePprof)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("admin server failed", "error", err)
+		}
+	}()
+
+	return server.Shutdown
+}
+
+// requireToken rejects requests without the bearer token, if one is set
+func requireToken(token string, next http.Handler) http.Handler {
+	if token == "" {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJson(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn("failed to write admin response", "error", err)
+	}
+}
+
+func handleGetConfig(store *ConfigStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg, version := store.Get()
+		w.Header().Set("ETag", fmt.Sprintf("\"%d\"", version))
+		// credentials in urls are left out, as they are from describe and diagnostic bundles
+		writeJson(w, http.StatusOK, versionedConfig{Version: version, Config: redactConfig(cfg)})
+	}
+}
+
+func handlePutConfig(store *ConfigStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body := versionedConfig{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, fmt.Sprintf("invalid body: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		version, err := store.Update(body.Config, body.Version)
+		if errors.Is(err, errVersionConflict) {
+			http.Error(w, fmt.Sprintf("config has changed, current version is %d", version), http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+
+		slog.Info("config updated through admin api", "version", version)
+		cfg, _ := store.Get()
+		w.Header().Set("ETag", fmt.Sprintf("\"%d\"", version))
+		writeJson(w, http.StatusOK, versionedConfig{Version: version, Config: cfg})
+	}
+}
+
+// the queue apis cover every scheduler, as each pipeline has its own
+func handleGetQueue(w http.ResponseWriter, r *http.Request) {
+	state := queueState{Depths: map[string]int{}, RecentErrors: []deliveryError{}}
+	for _, sched := range allSchedulers() {
+		state.Paused = state.Paused || sched.paused()
+		maps.Copy(state.Depths, sched.queueDepths())
+		state.RecentErrors = append(state.RecentErrors, sched.errLog.list()...)
+	}
+	// oldest first, as for a single scheduler
+	slices.SortStableFunc(state.RecentErrors, func(a, b deliveryError) int {
+		return a.Time.Compare(b.Time)
+	})
+	if n := len(state.RecentErrors); n > recentErrorCount {
+		state.RecentErrors = state.RecentErrors[n-recentErrorCount:]
+	}
+	writeJson(w, http.StatusOK, state)
+}
+
+func handleClearQueue(w http.ResponseWriter, r *http.Request) {
+	cleared := map[string]int{}
+	for _, sched := range allSchedulers() {
+		maps.Copy(cleared, sched.clear())
+	}
+	slog.Info("queues cleared through admin api", "cleared", cleared)
+	writeJson(w, http.StatusOK, map[string]any{"cleared": cleared})
+}
+
+func handlePause(pause bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		paused := false
+		for _, sched := range allSchedulers() {
+			if pause {
+				sched.pause()
+			} else {
+				sched.resume()
+			}
+			paused = paused || sched.paused()
+		}
+		if pause {
+			slog.Info("delivery paused through admin api")
+		} else {
+			slog.Info("delivery resumed through admin api")
+		}
+		writeJson(w, http.StatusOK, map[string]any{"paused": paused})
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// which messages are written to the archive
+const (
+	archiveAll       = "all"
+	archiveForwarded = "forwarded"
+)
+
+// defaults for rotating archive files
+const (
+	defaultArchiveMaxBytes = 100 << 20
+	defaultArchiveMaxAge   = 24 * time.Hour
+)
+
+var archive = &archiveWriter{}
+
+// archiveEntry is a single line in an archive file. the route is only set for forwarded messages.
+type archiveEntry struct {
+	Time    time.Time `json:"time"`
+	Route   string    `json:"route,omitempty"`
+	Message Message   `json:"message"`
+}
+
+// archiveKey identifies an archived message, to tell when it has been archived more than once
+func archiveKey(msg Message) string {
+	return fmt.Sprintf("%s\x00%s\x00%s\x00%s\x00%s\x00%s", msg.Source, msg.Gateway, msg.Channel, msg.Id, msg.Timestamp, msg.Text)
+}
+
+// archiveWriter appends messages to json lines files in a directory, starting a new file once the
+// current one is too big or too old
+type archiveWriter struct {
+	mu       sync.Mutex
+	dir      string
+	mode     string
+	maxBytes int
+	maxAge   time.Duration
+	file     *os.File
+	size     int
+	opened   time.Time
+}
+
+// enable starts archiving messages to the directory
+func (a *archiveWriter) enable(dir string, mode string, maxBytes int, maxAge time.Duration) error {
+	if mode != archiveAll && mode != archiveForwarded {
+		return fmt.Errorf("unknown archive mode %s, must be %s or %s", mode, archiveAll, archiveForwarded)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create archive directory: %v", err)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.dir, a.mode, a.maxBytes, a.maxAge = dir, mode, maxBytes, maxAge
+	return nil
+}
+
+// received archives a message as it is received, if every message is being archived
+func (a *archiveWriter) received(ctx context.Context, msg Message) {
+	a.write(ctx, archiveAll, archiveEntry{Time: time.Now(), Message: msg})
+}
+
+// forwarded archives a message once it has been delivered to a route, if only forwarded messages
+// are being archived
+func (a *archiveWriter) forwarded(ctx context.Context, route Route, msg Message) {
+	a.write(ctx, archiveForwarded, archiveEntry{Time: time.Now(), Route: route.Name, Message: msg})
+}
+
+func (a *archiveWriter) write(ctx context.Context, mode string, entry archiveEntry) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.dir == "" || a.mode != mode {
+		return
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		slog.Warn("failed to marshal archive entry", "error", err)
+		return
+	}
+	line = append(line, '\n')
+
+	if err := a.rotate(len(line)); err != nil {
+		slog.Warn("failed to open archive file", "error", err)
+		return
+	}
+
+	n, err := a.file.Write(line)
+	a.size += n
+	metrics.archiveBytes.Add(ctx, int64(n))
+	if err != nil {
+		slog.Warn("failed to write to archive", "file", a.file.Name(), "error", err)
+	}
+}
+
+// rotate opens a new file if there isn't one, or if the current one is too old or would become
+// too big
+func (a *archiveWriter) rotate(next int) error {
+	if a.file != nil && a.size+next <= a.maxBytes && time.Since(a.opened) < a.maxAge {
+		return nil
+	}
+	// a single entry bigger than the limit still has to go somewhere
+	if a.file != nil && a.size == 0 && time.Since(a.opened) < a.maxAge {
+		return nil
+	}
+
+	if a.file != nil {
+		if err := a.file.Close(); err != nil {
+			slog.Warn("failed to close archive file", "file", a.file.Name(), "error", err)
+		}
+		a.file = nil
+	}
+
+	now := time.Now()
+	path := filepath.Join(a.dir, fmt.Sprintf("messages-%s.jsonl", now.UTC().Format("20060102T150405.000")))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	slog.Debug("opened archive file", "file", path)
+	a.file, a.size, a.opened = file, int(info.Size()), now
+	return nil
+}
+
+// close closes the current archive file
+func (a *archiveWriter) close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.file == nil {
+		return nil
+	}
+	err := a.file.Close()
+	a.file = nil
+	return err
+}
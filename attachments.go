@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"time"
+)
+
+// how the files attached to messages are forwarded
+const (
+	// only the name, url and size of each file
+	attachmentsMetadata = "metadata"
+	// the contents of each file too, as base64 in the payload
+	attachmentsBase64 = "base64"
+	// the contents of each file as parts of a multipart request to webhooks, or as base64 to
+	// other destinations
+	attachmentsMultipart = "multipart"
+)
+
+// attachmentDownloadTimeout is how long downloading a file from matterbridge can take
+const attachmentDownloadTimeout = 30 * time.Second
+
+// defaultAttachmentMaxBytes is the largest file downloaded by default
+const defaultAttachmentMaxBytes = 10 * 1024 * 1024
+
+// attachmentOptions are the settings for forwarding attachments
+type attachmentOptions struct {
+	mode     string
+	maxBytes int64
+}
+
+// attachments are the settings for forwarding attachments, which only keeps metadata by default
+var attachments = attachmentOptions{mode: attachmentsMetadata, maxBytes: defaultAttachmentMaxBytes}
+
+// loadAttachmentOptions reads the attachment settings from the environment
+func loadAttachmentOptions() (attachmentOptions, error) {
+	opts := attachmentOptions{mode: os.Getenv("ATTACHMENTS")}
+	switch opts.mode {
+	case "":
+		opts.mode = attachmentsMetadata
+	case attachmentsMetadata, attachmentsBase64, attachmentsMultipart:
+	default:
+		return opts, fmt.Errorf("unknown attachments mode: %s", opts.mode)
+	}
+
+	maxBytes, err := intEnv("ATTACHMENT_MAX_BYTES", defaultAttachmentMaxBytes)
+	if err != nil {
+		return opts, err
+	}
+	if maxBytes <= 0 {
+		return opts, fmt.Errorf("ATTACHMENT_MAX_BYTES must be positive")
+	}
+	opts.maxBytes = int64(maxBytes)
+	return opts, nil
+}
+
+// matterbridgeFile is a file in the extra data of a matterbridge message
+type matterbridgeFile struct {
+	Name    string
+	Data    []byte
+	Comment string
+	URL     string
+	Size    int64
+	// avatars are uploaded by matterbridge for bridges that need them, rather than sent by users
+	Avatar bool
+}
+
+// loadAttachments moves the files from the extra data of a message to its attachments, downloading
+// them from matterbridge if their contents are forwarded and weren't included in the message
+func (s *source) loadAttachments(ctx context.Context, msg *Message) {
+	files := msg.Extra["file"]
+	if files == nil {
+		return
+	}
+	delete(msg.Extra, "file")
+	if len(msg.Extra) == 0 {
+		msg.Extra = nil
+	}
+
+	for _, raw := range files {
+		var file matterbridgeFile
+		if err := json.Unmarshal(raw, &file); err != nil {
+			slog.Warn("failed to parse file from matterbridge", "source", s.name, "error", err)
+			continue
+		}
+		if file.Avatar {
+			continue
+		}
+
+		attachment := Attachment{Name: file.Name, Url: file.URL, Size: file.Size, Comment: file.Comment}
+		if attachment.Size == 0 {
+			attachment.Size = int64(len(file.Data))
+		}
+		if attachments.mode != attachmentsMetadata {
+			// the size is whatever the sender claimed, so the contents are checked too. downloads
+			// are cut off at the limit.
+			if attachment.Size > attachments.maxBytes || int64(len(file.Data)) > attachments.maxBytes {
+				slog.Warn("attachment is too large to forward", "source", s.name, "name", file.Name, "size", max(attachment.Size, int64(len(file.Data))))
+			} else if len(file.Data) > 0 {
+				attachment.Data = file.Data
+				attachment.Size = int64(len(file.Data))
+			} else if file.URL != "" {
+				data, err := s.download(ctx, file.URL)
+				if err != nil {
+					slog.Warn("failed to download attachment", "source", s.name, "name", file.Name, "error", err)
+				} else {
+					attachment.Data = data
+					attachment.Size = int64(len(data))
+				}
+			}
+		}
+		msg.Attachments = append(msg.Attachments, attachment)
+	}
+}
+
+// download fetches a file, with the source's credentials if it is served by matterbridge
+func (s *source) download(ctx context.Context, fileUrl string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, attachmentDownloadTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", fileUrl, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build request: %v", err)
+	}
+	// files on the media server don't need credentials, so they are only sent to matterbridge
+	if api, err := url.Parse(s.apiUrl); err == nil && api.Host == req.URL.Host {
+		s.authorize(req)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server returned %s", res.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(res.Body, attachments.maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > attachments.maxBytes {
+		return nil, fmt.Errorf("attachment is larger than %d bytes", attachments.maxBytes)
+	}
+	return data, nil
+}
+
+// detachFiles takes the contents of the attachments out of the messages, so they can be sent as
+// parts of a multipart request rather than in the payload
+func detachFiles(msgs []Message) ([]Message, []Attachment) {
+	files := []Attachment{}
+	detached := make([]Message, len(msgs))
+	for i, msg := range msgs {
+		detached[i] = msg
+		if len(msg.Attachments) == 0 {
+			continue
+		}
+		detached[i].Attachments = make([]Attachment, len(msg.Attachments))
+		for j, attachment := range msg.Attachments {
+			if len(attachment.Data) > 0 {
+				files = append(files, attachment)
+			}
+			attachment.Data = nil
+			detached[i].Attachments[j] = attachment
+		}
+	}
+	return detached, files
+}
+
+// multipartPayload builds a multipart request with the payload in a part named payload, followed
+// by a part named attachment for each file
+func multipartPayload(body []byte, contentType string, files []Attachment) ([]byte, string, error) {
+	buf := &bytes.Buffer{}
+	w := multipart.NewWriter(buf)
+
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", `form-data; name="payload"`)
+	header.Set("Content-Type", contentType)
+	part, err := w.CreatePart(header)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := part.Write(body); err != nil {
+		return nil, "", err
+	}
+
+	for _, file := range files {
+		part, err := w.CreateFormFile("attachment", file.Name)
+		if err != nil {
+			return nil, "", err
+		}
+		if _, err := part.Write(file.Data); err != nil {
+			return nil, "", err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), w.FormDataContentType(), nil
+}
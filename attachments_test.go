@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAttachmentLimitIgnoresClaimedSize(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("a", 100)))
+	}))
+	defer server.Close()
+
+	saved := attachments
+	t.Cleanup(func() { attachments = saved })
+	attachments = attachmentOptions{mode: attachmentsBase64, maxBytes: 10}
+
+	// both files claim to be small, but are larger than the limit
+	inline, _ := json.Marshal(matterbridgeFile{Name: "inline.txt", Data: []byte(strings.Repeat("a", 100)), Size: 1})
+	download, _ := json.Marshal(matterbridgeFile{Name: "download.txt", URL: server.URL + "/download.txt", Size: 1})
+	small, _ := json.Marshal(matterbridgeFile{Name: "small.txt", Data: []byte("hello")})
+	msg := Message{Extra: map[string][]json.RawMessage{"file": {inline, download, small}}}
+
+	src := newSource("attachments", server.URL, "", "", "")
+	src.loadAttachments(context.Background(), &msg)
+	if len(msg.Attachments) != 3 {
+		t.Fatalf("expected every file to be forwarded, got %+v", msg.Attachments)
+	}
+	for _, attachment := range msg.Attachments[:2] {
+		if len(attachment.Data) != 0 {
+			t.Errorf("expected %s to be forwarded without its contents, got %d bytes", attachment.Name, len(attachment.Data))
+		}
+	}
+	if small := msg.Attachments[2]; string(small.Data) != "hello" || small.Size != 5 {
+		t.Errorf("expected the small file with its contents, got %+v", small)
+	}
+}
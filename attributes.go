@@ -0,0 +1,83 @@
+package main
+
+import (
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// otherAttributeValue replaces attribute values that aren't allowed or are over the limit
+const otherAttributeValue = "other"
+
+var (
+	gatewayGuard = newAttributeGuard(nil, 50)
+	channelGuard = newAttributeGuard(nil, 50)
+)
+
+// attributeGuard limits the values a metric attribute can take, so values like channel names can't
+// create an unbounded number of series. if an allowlist is given only those values are kept,
+// otherwise the first values seen are kept up to the limit.
+type attributeGuard struct {
+	mu        sync.Mutex
+	allowlist map[string]bool
+	seen      map[string]bool
+	limit     int
+}
+
+func newAttributeGuard(allowlist []string, limit int) *attributeGuard {
+	g := &attributeGuard{
+		seen:  map[string]bool{},
+		limit: limit,
+	}
+
+	if len(allowlist) > 0 {
+		g.allowlist = map[string]bool{}
+		for _, v := range allowlist {
+			g.allowlist[v] = true
+		}
+	}
+
+	return g
+}
+
+// value returns the value to record for the attribute
+func (g *attributeGuard) value(v string) string {
+	if g.allowlist != nil {
+		if g.allowlist[v] {
+			return v
+		}
+		return otherAttributeValue
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.seen[v] {
+		return v
+	}
+	if len(g.seen) >= g.limit {
+		return otherAttributeValue
+	}
+	g.seen[v] = true
+	return v
+}
+
+// messageAttributes describes a message on a metric, along with any extra attributes
+func messageAttributes(msg Message, extra ...attribute.KeyValue) metric.MeasurementOption {
+	attrs := []attribute.KeyValue{
+		attribute.String("source", msg.Source),
+		attribute.String("gateway", gatewayGuard.value(msg.Gateway)),
+		attribute.String("channel", channelGuard.value(msg.Channel)),
+		attribute.String("protocol", msg.Protocol),
+	}
+	if msg.Pipeline != "" {
+		attrs = append(attrs, attribute.String("pipeline", msg.Pipeline))
+	}
+	return metric.WithAttributes(append(attrs, extra...)...)
+}
+
+// routeAttributes describes a message being handled by a route on a metric
+func routeAttributes(msg Message, route Route, extra ...attribute.KeyValue) metric.MeasurementOption {
+	return messageAttributes(msg, append([]attribute.KeyValue{attribute.String("destination", route.Name)}, extra...)...)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how avatars are forwarded
+const (
+	// served from the admin server, with the avatar url replaced by a link to the copy there
+	avatarsProxy = "proxy"
+	// included in the payload, with the avatar url replaced by a data url
+	avatarsInline = "inline"
+)
+
+// defaults for the avatar cache
+const (
+	defaultAvatarCacheSize = 500
+	defaultAvatarCacheTtl  = 24 * time.Hour
+)
+
+// avatarMaxBytes is the largest avatar that is fetched, as they are kept in memory
+const avatarMaxBytes = 1 << 20
+
+// avatarFetchTimeout is how long fetching an avatar can take before the original url is forwarded
+const avatarFetchTimeout = 5 * time.Second
+
+// avatarTypes are the image types avatars can be. vector images like svg can have scripts, which
+// would run in the admin server's origin, so only raster images are kept.
+var avatarTypes = map[string]bool{
+	"image/png":                true,
+	"image/jpeg":               true,
+	"image/gif":                true,
+	"image/webp":               true,
+	"image/bmp":                true,
+	"image/avif":               true,
+	"image/x-icon":             true,
+	"image/vnd.microsoft.icon": true,
+}
+
+var avatars = &avatarCache{}
+
+// avatarCache keeps copies of the avatars of recent messages, so they can be forwarded even if the
+// original urls expire or can't be reached by receivers
+type avatarCache struct {
+	mu      sync.Mutex
+	mode    string
+	baseUrl string
+	size    int
+	ttl     time.Duration
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type cachedAvatar struct {
+	key         string
+	contentType string
+	data        []byte
+	fetched     time.Time
+}
+
+// enable starts fetching the avatars of messages. with the proxy mode, baseUrl is the address the
+// admin server can be reached at by receivers.
+func (c *avatarCache) enable(mode string, baseUrl string, size int, ttl time.Duration) error {
+	switch mode {
+	case avatarsProxy:
+		if _, err := url.ParseRequestURI(baseUrl); err != nil {
+			return fmt.Errorf("invalid avatar base url: %v", err)
+		}
+	case avatarsInline:
+	default:
+		return fmt.Errorf("unknown avatars mode %s, must be %s or %s", mode, avatarsProxy, avatarsInline)
+	}
+	if size <= 0 {
+		return fmt.Errorf("AVATAR_CACHE_SIZE must be positive")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.mode, c.baseUrl, c.size, c.ttl = mode, strings.TrimSuffix(baseUrl, "/"), size, ttl
+	c.order = list.New()
+	c.entries = map[string]*list.Element{}
+	return nil
+}
+
+// proxying reports whether avatars are served from the admin server
+func (c *avatarCache) proxying() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.mode == avatarsProxy
+}
+
+// rewrite replaces the avatar url of a message with the cached copy, fetching it if it isn't
+// cached. the original url is kept if the avatar can't be fetched.
+func (c *avatarCache) rewrite(ctx context.Context, msg *Message) {
+	c.mu.Lock()
+	mode := c.mode
+	c.mu.Unlock()
+	if mode == "" || msg.Avatar == "" || strings.HasPrefix(msg.Avatar, "data:") {
+		return
+	}
+
+	avatar, err := c.get(ctx, msg.Avatar)
+	if err != nil {
+		slog.Warn("failed to fetch avatar, forwarding the original url", "avatar", msg.Avatar, "error", err)
+		return
+	}
+	if mode == avatarsProxy {
+		msg.Avatar = c.baseUrl + "/avatars/" + avatar.key
+	} else {
+		msg.Avatar = "data:" + avatar.contentType + ";base64," + base64.StdEncoding.EncodeToString(avatar.data)
+	}
+}
+
+// get returns the cached copy of an avatar, fetching it if it isn't cached or has expired
+func (c *avatarCache) get(ctx context.Context, avatarUrl string) (*cachedAvatar, error) {
+	sum := sha256.Sum256([]byte(avatarUrl))
+	key := hex.EncodeToString(sum[:])
+	cached, ok := c.lookup(key)
+	if ok && c.fresh(cached) {
+		return cached, nil
+	}
+
+	contentType, data, err := fetchAvatar(ctx, avatarUrl)
+	if err != nil && ok {
+		// an expired copy is better than the url that may not work any more
+		return cached, nil
+	} else if err != nil {
+		return nil, err
+	}
+	avatar := &cachedAvatar{key: key, contentType: contentType, data: data, fetched: time.Now()}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.order.Remove(el)
+	}
+	c.entries[key] = c.order.PushFront(avatar)
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedAvatar).key)
+	}
+	return avatar, nil
+}
+
+// lookup returns a cached avatar by key
+func (c *avatarCache) lookup(key string) (*cachedAvatar, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*cachedAvatar), true
+}
+
+// fresh reports whether a cached avatar was fetched recently enough to be used without fetching
+// it again
+func (c *avatarCache) fresh(avatar *cachedAvatar) bool {
+	return c.ttl <= 0 || time.Since(avatar.fetched) <= c.ttl
+}
+
+// fetchAvatar downloads an avatar, returning its content type and contents
+func fetchAvatar(ctx context.Context, avatarUrl string) (string, []byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, avatarFetchTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", avatarUrl, nil)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to build request: %v", err)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", nil, fmt.Errorf("server returned %s", res.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(res.Body, avatarMaxBytes+1))
+	if err != nil {
+		return "", nil, err
+	}
+	if len(data) > avatarMaxBytes {
+		return "", nil, fmt.Errorf("avatar is larger than %d bytes", avatarMaxBytes)
+	}
+
+	// the type is taken from the contents, as the server could claim anything. the server's type is
+	// only used for images that aren't recognised, like avif.
+	contentType := http.DetectContentType(data)
+	if claimed, _, err := mime.ParseMediaType(res.Header.Get("Content-Type")); contentType == "application/octet-stream" && err == nil {
+		contentType = claimed
+	}
+	if !avatarTypes[contentType] {
+		return "", nil, fmt.Errorf("avatar is %s, not a raster image", contentType)
+	}
+	return contentType, data, nil
+}
+
+// handleGetAvatar serves a cached avatar. avatars are public, like the original urls, so the admin
+// token isn't needed. expired avatars are still served, as messages may already link to them.
+func handleGetAvatar(w http.ResponseWriter, r *http.Request) {
+	avatar, ok := avatars.lookup(r.PathValue("key"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", avatar.contentType)
+	// browsers opening the avatar shouldn't treat it as anything else, or run anything in it
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	w.Write(avatar.data)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAvatarsOnlyKeepRasterImages(t *testing.T) {
+	var pngData bytes.Buffer
+	png.Encode(&pngData, image.NewRGBA(image.Rect(0, 0, 1, 1)))
+	svg := `<svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script></svg>`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/avatar.png":
+			// a wrong type from the server doesn't matter, as the contents are checked
+			w.Header().Set("Content-Type", "text/html")
+			w.Write(pngData.Bytes())
+		case "/avatar.svg":
+			w.Header().Set("Content-Type", "image/svg+xml")
+			w.Write([]byte(svg))
+		}
+	}))
+	defer server.Close()
+
+	saved := avatars
+	t.Cleanup(func() { avatars = saved })
+	avatars = &avatarCache{}
+	if err := avatars.enable(avatarsProxy, "https://bridge.example.com", 10, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := Message{Avatar: server.URL + "/avatar.svg"}
+	avatars.rewrite(context.Background(), &msg)
+	if msg.Avatar != server.URL+"/avatar.svg" {
+		t.Errorf("expected the svg avatar not to be copied, got %s", msg.Avatar)
+	}
+
+	msg = Message{Avatar: server.URL + "/avatar.png"}
+	avatars.rewrite(context.Background(), &msg)
+	key, ok := strings.CutPrefix(msg.Avatar, "https://bridge.example.com/avatars/")
+	if !ok {
+		t.Fatalf("expected the png avatar to be copied, got %s", msg.Avatar)
+	}
+
+	req := httptest.NewRequest("GET", "/avatars/"+key, nil)
+	req.SetPathValue("key", key)
+	w := httptest.NewRecorder()
+	handleGetAvatar(w, req)
+	if got := w.Header().Get("Content-Type"); got != "image/png" {
+		t.Errorf("expected the avatar to be served as a png, got %s", got)
+	}
+	if w.Header().Get("X-Content-Type-Options") != "nosniff" || w.Header().Get("Content-Security-Policy") != "default-src 'none'" {
+		t.Errorf("expected the avatar to be served so nothing in it runs, got %v", w.Header())
+	}
+}
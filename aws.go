@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	snstypes "github.com/aws/aws-sdk-go-v2/service/sns/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/aws/smithy-go"
+	"github.com/cenkalti/backoff/v4"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// awsPublishTimeout is how long sending a message to aws can take before it is retried
+const awsPublishTimeout = 10 * time.Second
+
+// defaultMessageGroup keeps the messages in each channel in order on fifo queues and topics,
+// while letting different channels be processed in parallel
+const defaultMessageGroup = "{{.Gateway}}/{{.Channel}}"
+
+// SqsDestination sends messages to an sqs queue instead of posting them to a webhook
+type SqsDestination struct {
+	// the queue, such as https://sqs.eu-west-1.amazonaws.com/123456789012/chat.fifo
+	QueueUrl string `json:"queue_url"`
+	// the region, defaulting to the one in the queue url
+	Region string `json:"region,omitempty"`
+	// a template for the message group of fifo queues, defaulting to {{.Gateway}}/{{.Channel}}
+	MessageGroup string `json:"message_group,omitempty"`
+	// a different endpoint to use, such as for localstack
+	Endpoint string `json:"endpoint,omitempty"`
+}
+
+// SnsDestination publishes messages to an sns topic instead of posting them to a webhook
+type SnsDestination struct {
+	// the topic, such as arn:aws:sns:eu-west-1:123456789012:chat
+	TopicArn string `json:"topic_arn"`
+	// the region, defaulting to the one in the topic arn
+	Region string `json:"region,omitempty"`
+	// a template for the message group of fifo topics, defaulting to {{.Gateway}}/{{.Channel}}
+	MessageGroup string `json:"message_group,omitempty"`
+	// a different endpoint to use, such as for localstack
+	Endpoint string `json:"endpoint,omitempty"`
+}
+
+// sqsDestination sends each message to the queue, in the message group rendered for it
+type sqsDestination struct {
+	client   *sqs.Client
+	queueUrl string
+	group    *topicTemplate
+}
+
+// snsDestination publishes each message to the topic, in the message group rendered for it
+type snsDestination struct {
+	client   *sns.Client
+	topicArn string
+	group    *topicTemplate
+}
+
+func (s SqsDestination) validate() error {
+	if _, err := url.ParseRequestURI(s.QueueUrl); err != nil {
+		return fmt.Errorf("invalid sqs queue url: %v", err)
+	}
+	if s.Endpoint != "" {
+		if _, err := url.ParseRequestURI(s.Endpoint); err != nil {
+			return fmt.Errorf("invalid sqs endpoint: %v", err)
+		}
+	}
+	_, err := parseMessageGroupTemplate(s.MessageGroup)
+	return err
+}
+
+func (s SnsDestination) validate() error {
+	if !arn.IsARN(s.TopicArn) {
+		return fmt.Errorf("invalid sns topic arn %s", s.TopicArn)
+	}
+	if s.Endpoint != "" {
+		if _, err := url.ParseRequestURI(s.Endpoint); err != nil {
+			return fmt.Errorf("invalid sns endpoint: %v", err)
+		}
+	}
+	_, err := parseMessageGroupTemplate(s.MessageGroup)
+	return err
+}
+
+// parseMessageGroupTemplate parses a message group template. message groups can't have spaces,
+// so they are replaced in the values.
+func parseMessageGroupTemplate(group string) (*topicTemplate, error) {
+	if group == "" {
+		group = defaultMessageGroup
+	}
+	return parseTopicTemplate(group, "/")
+}
+
+// loadAwsConfig loads credentials and settings with the usual aws sdk chain, from the
+// environment, shared config files, or the role of the container or instance
+func loadAwsConfig(region string) (aws.Config, error) {
+	options := []func(*awsconfig.LoadOptions) error{}
+	if region != "" {
+		options = append(options, awsconfig.WithRegion(region))
+	}
+	if outboundDialer != nil {
+		options = append(options, awsconfig.WithHTTPClient(awshttp.NewBuildableClient().WithTransportOptions(func(t *http.Transport) {
+			t.Proxy = nil
+			t.DialContext = outboundDialer.DialContext
+		})))
+	}
+
+	cfg, err := awsconfig.LoadDefaultConfig(context.Background(), options...)
+	if err != nil {
+		return cfg, fmt.Errorf("failed to load aws config: %v", err)
+	}
+	return cfg, nil
+}
+
+func newSqsDestination(cfg SqsDestination) (*sqsDestination, error) {
+	group, err := parseMessageGroupTemplate(cfg.MessageGroup)
+	if err != nil {
+		return nil, err
+	}
+
+	region := cfg.Region
+	if region == "" {
+		region = sqsQueueRegion(cfg.QueueUrl)
+	}
+	awsCfg, err := loadAwsConfig(region)
+	if err != nil {
+		return nil, err
+	}
+	client := sqs.NewFromConfig(awsCfg, func(o *sqs.Options) {
+		if cfg.Endpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.Endpoint)
+		}
+	})
+
+	d := &sqsDestination{client: client, queueUrl: cfg.QueueUrl}
+	if strings.HasSuffix(cfg.QueueUrl, ".fifo") {
+		d.group = group
+	}
+	return d, nil
+}
+
+// sqsQueueRegion finds the region in a queue url like https://sqs.eu-west-1.amazonaws.com/...
+func sqsQueueRegion(queueUrl string) string {
+	u, err := url.Parse(queueUrl)
+	if err != nil {
+		return ""
+	}
+	parts := strings.Split(u.Hostname(), ".")
+	if len(parts) >= 3 && parts[0] == "sqs" {
+		return parts[1]
+	}
+	return ""
+}
+
+func newSnsDestination(cfg SnsDestination) (*snsDestination, error) {
+	group, err := parseMessageGroupTemplate(cfg.MessageGroup)
+	if err != nil {
+		return nil, err
+	}
+	topic, err := arn.Parse(cfg.TopicArn)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sns topic arn: %v", err)
+	}
+
+	region := cfg.Region
+	if region == "" {
+		region = topic.Region
+	}
+	awsCfg, err := loadAwsConfig(region)
+	if err != nil {
+		return nil, err
+	}
+	client := sns.NewFromConfig(awsCfg, func(o *sns.Options) {
+		if cfg.Endpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.Endpoint)
+		}
+	})
+
+	d := &snsDestination{client: client, topicArn: cfg.TopicArn}
+	if strings.HasSuffix(topic.Resource, ".fifo") {
+		d.group = group
+	}
+	return d, nil
+}
+
+// awsAttributes are the message attributes sent with each message, including the trace so
+// consumers can continue it
+func awsAttributes(ctx context.Context, cfg Config, route Route, msg Message, contentType string) map[string]string {
+	attributes := map[string]string{"content_type": contentType}
+	if msg.Id != "" {
+		attributes["message_id"] = msg.Id
+	}
+	if featureEnabled(cfg, flagPropagateTraceContext, route, msg, true) {
+		carrier := propagation.MapCarrier{}
+		otel.GetTextMapPropagator().Inject(ctx, carrier)
+		for k, v := range carrier {
+			attributes[k] = v
+		}
+	}
+	return attributes
+}
+
+// deduplicationId identifies a message on a fifo queue or topic. the payload is hashed rather
+// than using the message id, so edits aren't dropped as duplicates.
+func deduplicationId(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// awsError marks errors from aws that won't be fixed by retrying as permanent
+func awsError(action string, err error) error {
+	var apiErr smithy.APIError
+	permanent := errors.As(err, &apiErr) && apiErr.ErrorFault() == smithy.FaultClient && !strings.Contains(apiErr.ErrorCode(), "Throttl")
+	err = fmt.Errorf("failed to %s: %v", action, err)
+	if permanent {
+		return backoff.Permanent(err)
+	}
+	return err
+}
+
+func (d *sqsDestination) deliver(ctx context.Context, cfg Config, route Route, opts deliveryOptions, msgs []Message, body []byte, contentType string) error {
+	msg := msgs[0]
+	input := &sqs.SendMessageInput{
+		QueueUrl:          aws.String(d.queueUrl),
+		MessageBody:       aws.String(string(body)),
+		MessageAttributes: map[string]sqstypes.MessageAttributeValue{},
+	}
+	for k, v := range awsAttributes(ctx, cfg, route, msg, contentType) {
+		input.MessageAttributes[k] = sqstypes.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(v)}
+	}
+	if d.group != nil {
+		group, err := d.group.render(msg)
+		if err != nil {
+			return backoff.Permanent(err)
+		}
+		input.MessageGroupId = aws.String(group)
+		input.MessageDeduplicationId = aws.String(deduplicationId(body))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, awsPublishTimeout)
+	defer cancel()
+
+	start := time.Now()
+	_, err := d.client.SendMessage(ctx, input)
+	recordStage(ctx, stageDeliver, start)
+	if err != nil {
+		return awsError("send to sqs", err)
+	}
+	return nil
+}
+
+func (d *sqsDestination) close() {}
+
+func (d *snsDestination) deliver(ctx context.Context, cfg Config, route Route, opts deliveryOptions, msgs []Message, body []byte, contentType string) error {
+	msg := msgs[0]
+	input := &sns.PublishInput{
+		TopicArn:          aws.String(d.topicArn),
+		Message:           aws.String(string(body)),
+		MessageAttributes: map[string]snstypes.MessageAttributeValue{},
+	}
+	for k, v := range awsAttributes(ctx, cfg, route, msg, contentType) {
+		input.MessageAttributes[k] = snstypes.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(v)}
+	}
+	if d.group != nil {
+		group, err := d.group.render(msg)
+		if err != nil {
+			return backoff.Permanent(err)
+		}
+		input.MessageGroupId = aws.String(group)
+		input.MessageDeduplicationId = aws.String(deduplicationId(body))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, awsPublishTimeout)
+	defer cancel()
+
+	start := time.Now()
+	_, err := d.client.Publish(ctx, input)
+	recordStage(ctx, stageDeliver, start)
+	if err != nil {
+		return awsError("publish to sns", err)
+	}
+	return nil
+}
+
+func (d *snsDestination) close() {}
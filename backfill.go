@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// backfillFilter chooses which archived messages are backfilled
+type backfillFilter struct {
+	since    time.Time
+	until    time.Time
+	gateways []string
+	channels []string
+	accounts []string
+}
+
+func (f backfillFilter) matches(entry archiveEntry) bool {
+	// the message's own timestamp is when it was sent, the archive time is when it was written
+	sent, ok := messageTime(entry.Message, entry.Time)
+	if !ok {
+		sent = entry.Time
+	}
+	if !f.since.IsZero() && sent.Before(f.since) {
+		return false
+	}
+	if !f.until.IsZero() && !sent.Before(f.until) {
+		return false
+	}
+	if len(f.gateways) > 0 && !slices.Contains(f.gateways, entry.Message.Gateway) {
+		return false
+	}
+	if len(f.channels) > 0 && !slices.Contains(f.channels, entry.Message.Channel) {
+		return false
+	}
+	if len(f.accounts) > 0 && !slices.Contains(f.accounts, entry.Message.Account) {
+		return false
+	}
+	return true
+}
+
+// runBackfill sends the history from the archive to a single route, for giving a new consumer the
+// messages from before it was added
+func runBackfill(args []string) error {
+	flags := flag.NewFlagSet("backfill", flag.ContinueOnError)
+	route := flags.String("route", "", "the route to send the messages to")
+	since := flags.String("since", "", "only send messages sent at or after this time, as RFC3339, a date or a duration ago such as 72h")
+	until := flags.String("until", "", "only send messages sent before this time, in the same formats as -since")
+	gateways := flags.String("gateway", "", "only send messages from these comma separated gateways")
+	channels := flags.String("channel", "", "only send messages from these comma separated channels")
+	accounts := flags.String("account", "", "only send messages from these comma separated accounts")
+	perSecond := flags.Float64("rate", 5, "the maximum number of messages sent per second")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: matterbridge-to-webhook backfill -route name [-since time] [-until time] [-gateway names] [-channel names] [-account names] [-rate 5] [archive files or directories]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *route == "" {
+		flags.Usage()
+		return fmt.Errorf("a route must be given")
+	}
+	if *perSecond <= 0 {
+		return fmt.Errorf("the rate must be positive")
+	}
+
+	now := time.Now()
+	filter := backfillFilter{
+		gateways: splitList(*gateways),
+		channels: splitList(*channels),
+		accounts: splitList(*accounts),
+	}
+	var err error
+	if filter.since, err = parseBackfillTime(*since, now); err != nil {
+		return fmt.Errorf("invalid since: %v", err)
+	}
+	if filter.until, err = parseBackfillTime(*until, now); err != nil {
+		return fmt.Errorf("invalid until: %v", err)
+	}
+	if !filter.since.IsZero() && !filter.until.IsZero() && !filter.since.Before(filter.until) {
+		return fmt.Errorf("since must be before until")
+	}
+
+	paths := flags.Args()
+	if len(paths) == 0 {
+		dir := os.Getenv("ARCHIVE_DIR")
+		if dir == "" {
+			return fmt.Errorf("archive files must be given when archive_dir isn't set")
+		}
+		paths = []string{dir}
+	}
+	files, err := archiveFiles(paths)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store, err := setupOfflineConfig(ctx)
+	if err != nil {
+		return err
+	}
+	cfg, _ := store.Get()
+	if !slices.ContainsFunc(cfg.allRoutes(), func(r Route) bool { return r.Name == *route }) {
+		return fmt.Errorf("unknown route %s", *route)
+	}
+
+	sink, closeSink, err := newOfflinePipeline(ctx, store)
+	if err != nil {
+		return err
+	}
+	defer closeSink()
+	sink.routes = []string{*route}
+
+	limiter := rate.NewLimiter(rate.Limit(*perSecond), 1)
+	// archives of forwarded messages have a line for every route a message was delivered to
+	seen := map[string]struct{}{}
+	sent := 0
+	for _, path := range files {
+		file, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("failed to open archive: %v", err)
+		}
+		err = readArchive(file, func(entry archiveEntry) error {
+			if !filter.matches(entry) {
+				return nil
+			}
+			if entry.Route != "" {
+				key := archiveKey(entry.Message)
+				if _, ok := seen[key]; ok {
+					return nil
+				}
+				seen[key] = struct{}{}
+			}
+
+			if err := limiter.Wait(ctx); err != nil {
+				return err
+			}
+			sink.Send(ctx, entry.Message)
+			sent++
+			return nil
+		})
+		file.Close()
+		if err != nil {
+			return err
+		}
+		slog.Debug("backfilled archive file", "file", path, "total", sent)
+	}
+
+	slog.Info("backfilled messages, waiting for them to be delivered", "route", *route, "count", sent, "files", len(files))
+	return nil
+}
+
+// parseBackfillTime parses a time given as RFC3339, a date in UTC, or a duration before now
+func parseBackfillTime(v string, now time.Time) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.DateOnly, v); err == nil {
+		return t, nil
+	}
+	if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("%s is not a time, date or duration", v)
+}
+
+// archiveFiles lists the archive files to read, oldest first. directories are searched for the
+// files written by the archive.
+func archiveFiles(paths []string) ([]string, error) {
+	files := map[string]struct{}{}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read archive: %v", err)
+		}
+		if !info.IsDir() {
+			files[path] = struct{}{}
+			continue
+		}
+
+		matches, err := filepath.Glob(filepath.Join(path, "messages-*.jsonl"))
+		if err != nil {
+			return nil, err
+		}
+		for _, match := range matches {
+			files[match] = struct{}{}
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no archive files found")
+	}
+
+	// files are named after the time they were started, so sorting the names sorts them by time
+	sorted := make([]string, 0, len(files))
+	for file := range files {
+		sorted = append(sorted, file)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return filepath.Base(sorted[i]) < filepath.Base(sorted[j])
+	})
+	return sorted, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// the default high and low-water marks for backpressure, as percentages of the route queue sizes
+const (
+	defaultBackpressureHigh = 80
+	defaultBackpressureLow  = 50
+)
+
+// backpressureInterval is how often the route queues are checked while reading is paused
+const backpressureInterval = 50 * time.Millisecond
+
+var backpressure = &backpressureGate{}
+
+// backpressureGate stops messages being read from matterbridge while the route queues are too
+// full, rather than dropping them once a queue fills up. reading pauses when any queue reaches the
+// high-water mark, and resumes once every queue is down to the low-water mark. while paused the
+// stream isn't read, so messages wait in matterbridge instead of in memory. each pipeline is paused
+// on its own, only for its own queues.
+type backpressureGate struct {
+	enabled bool
+	high    int
+	low     int
+	done    <-chan struct{}
+
+	mu sync.Mutex
+	// when each paused pipeline was paused
+	pausedSince map[string]time.Time
+}
+
+// enable starts applying backpressure, until done is closed
+func (g *backpressureGate) enable(high, low int, done <-chan struct{}) error {
+	if high <= 0 || high > 100 {
+		return fmt.Errorf("BACKPRESSURE_HIGH_WATER must be between 1 and 100")
+	}
+	if low < 0 || low >= high {
+		return fmt.Errorf("BACKPRESSURE_LOW_WATER must be at least 0 and below the high-water mark")
+	}
+	g.high = high
+	g.low = low
+	g.done = done
+	g.enabled = true
+	return nil
+}
+
+// wait blocks while the route queues of a pipeline are too full. fullest reports how full its
+// fullest queue is, as a percentage.
+func (g *backpressureGate) wait(ctx context.Context, pipeline string, fullest func() int) {
+	if !g.enabled {
+		return
+	}
+	percent := fullest()
+	if percent < g.high {
+		return
+	}
+
+	start := time.Now()
+	g.setPausedSince(pipeline, start)
+	logger := slog.Default()
+	if pipeline != "" {
+		logger = logger.With("pipeline", pipeline)
+	}
+	logger.Warn("route queues are filling up, pausing reading from matterbridge", "fullest_percent", percent, "resume_percent", g.low)
+
+	ticker := time.NewTicker(backpressureInterval)
+	defer ticker.Stop()
+wait:
+	for fullest() > g.low {
+		select {
+		case <-g.done:
+			break wait
+		case <-ticker.C:
+		}
+	}
+
+	g.setPausedSince(pipeline, time.Time{})
+	paused := time.Since(start)
+	metrics.backpressurePause.Record(ctx, paused.Seconds())
+	logger.Info("route queues have drained, resuming reading from matterbridge", "paused_for", paused.Round(time.Millisecond))
+}
+
+func (g *backpressureGate) setPausedSince(pipeline string, t time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if t.IsZero() {
+		delete(g.pausedSince, pipeline)
+		return
+	}
+	if g.pausedSince == nil {
+		g.pausedSince = map[string]time.Time{}
+	}
+	g.pausedSince[pipeline] = t
+}
+
+// pausedFor is how long reading has been paused for, by the pipeline paused the longest, or zero if
+// none are
+func (g *backpressureGate) pausedFor() time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var paused time.Duration
+	for _, since := range g.pausedSince {
+		paused = max(paused, time.Since(since))
+	}
+	return paused
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// commit is set when building releases, with -ldflags "-X main.commit=abc123"
+var commit = ""
+
+// modified is whether the build has changes that aren't in the commit
+var modified = false
+
+func init() {
+	// builds without ldflags, like go install, still know their module version and commit
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return
+	}
+	if version == "dev" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		version = info.Main.Version
+	}
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			if commit == "" {
+				commit = setting.Value
+			}
+		case "vcs.modified":
+			modified = setting.Value == "true"
+		}
+	}
+}
+
+// versionString describes the build, for --version
+func versionString() string {
+	described := "matterbridge-to-webhook " + version
+	if commit != "" {
+		short := commit
+		if len(short) > 12 {
+			short = short[:12]
+		}
+		if modified {
+			short += "-dirty"
+		}
+		described += fmt.Sprintf(" (commit %s)", short)
+	}
+	return described + " " + runtime.Version()
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// clockSkewTolerance is how far the clocks of matterbridge and the chat protocols can be from the
+// local clock, set by CLOCK_SKEW_TOLERANCE. features that use message timestamps allow for it.
+var clockSkewTolerance time.Duration
+
+// messageTime returns when a message was sent according to its timestamp. timestamps in the future
+// by no more than the tolerance are treated as now.
+func messageTime(msg Message, now time.Time) (time.Time, bool) {
+	timestamp, err := time.Parse(time.RFC3339Nano, msg.Timestamp)
+	if err != nil {
+		return time.Time{}, false
+	}
+	if timestamp.After(now) && timestamp.Sub(now) <= clockSkewTolerance {
+		return now, true
+	}
+	return timestamp, true
+}
+
+// messageAge returns how long ago a message was sent according to its timestamp
+func messageAge(msg Message, now time.Time) (time.Duration, bool) {
+	timestamp, ok := messageTime(msg, now)
+	if !ok {
+		return 0, false
+	}
+	return now.Sub(timestamp), true
+}
+
+// olderThan checks whether a timestamp is older than the max age, giving it the benefit of the
+// doubt if its clock might be behind
+func olderThan(timestamp time.Time, now time.Time, maxAge time.Duration) bool {
+	return now.Sub(timestamp) > maxAge+clockSkewTolerance
+}
+
+// recordClockSkew records how far a live message's timestamp is from the local clock. this
+// includes the time taken for the message to get through matterbridge.
+func recordClockSkew(src *source, msg Message) {
+	timestamp, err := time.Parse(time.RFC3339Nano, msg.Timestamp)
+	if err != nil {
+		return
+	}
+
+	skew := time.Since(timestamp)
+	direction := "behind"
+	if skew < 0 {
+		skew, direction = -skew, "ahead"
+	}
+	metrics.clockSkew.Record(context.Background(), skew.Seconds(), metric.WithAttributes(
+		attribute.String("source", src.name),
+		attribute.String("direction", direction),
+	))
+}
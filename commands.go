@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// matchCommand returns the command a message invokes if it is one the route handles. commands are
+// the first word of the text, matched without case, and the rest of the text is their arguments.
+func (r Route) matchCommand(msg Message) (*Command, bool) {
+	if len(r.Commands) == 0 {
+		return nil, true
+	}
+	text := strings.TrimLeftFunc(msg.Text, unicode.IsSpace)
+	// the arguments can be on the next line, from clients that send multi-line messages
+	name, args := text, ""
+	if i := strings.IndexFunc(text, unicode.IsSpace); i >= 0 {
+		name, args = text[:i], text[i:]
+	}
+	for _, command := range r.Commands {
+		if strings.EqualFold(name, command) {
+			return &Command{Name: command, Args: strings.TrimSpace(args)}, true
+		}
+	}
+	return nil, false
+}
+
+// parseCommandRoutes builds a route for each command in a comma separated list of command and
+// webhook pairs, like !deploy=https://example.com/deploy, for dispatching commands without a config
+// file. routes are named after their command.
+func parseCommandRoutes(v string) ([]Route, error) {
+	routes := []Route{}
+	for _, item := range splitList(v) {
+		command, webhookUrl, ok := strings.Cut(item, "=")
+		command, webhookUrl = strings.TrimSpace(command), strings.TrimSpace(webhookUrl)
+		if !ok || command == "" || webhookUrl == "" {
+			return nil, fmt.Errorf("invalid command %s, must be like !deploy=https://example.com/hook", item)
+		}
+		name := strings.TrimLeftFunc(command, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+		if name == "" {
+			name = command
+		}
+		routes = append(routes, Route{Name: name, WebhookUrl: webhookUrl, Commands: []string{command}})
+	}
+	return routes, nil
+}
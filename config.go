@@ -0,0 +1,400 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+var errVersionConflict = errors.New("configuration version conflict")
+
+// Config is the routing and filter configuration, which can be changed while running
+type Config struct {
+	Routes   []Route                `json:"routes"`
+	Features map[string]FeatureFlag `json:"features,omitempty"`
+	Priority Priority               `json:"priority,omitempty"`
+	Accounts map[string]AccountInfo `json:"accounts,omitempty"`
+	// inject a message marking the start of each day in every channel
+	DaySeparators DaySeparators `json:"day_separators,omitempty"`
+	// limit how fast each channel, or user, can send messages
+	FloodProtection FloodProtection `json:"flood_protection,omitempty"`
+	// independent bridges with their own sources and routes, instead of the routes above
+	Pipelines []Pipeline `json:"pipelines,omitempty"`
+}
+
+// accountInfo returns the details configured for the message's account, if there are any
+func (c Config) accountInfo(msg Message) *AccountInfo {
+	info, ok := c.Accounts[msg.Account]
+	if !ok {
+		return nil
+	}
+	return &info
+}
+
+// Priority marks messages from some accounts or protocols as high priority, so on every route they
+// are delivered ahead of anything else waiting in the queue
+type Priority struct {
+	Accounts  []string `json:"accounts,omitempty"`
+	Protocols []string `json:"protocols,omitempty"`
+}
+
+// isHighPriority checks whether a message should skip ahead of other queued messages
+func (p Priority) isHighPriority(msg Message) bool {
+	return slices.Contains(p.Accounts, msg.Account) || slices.Contains(p.Protocols, msg.Protocol)
+}
+
+// Route forwards messages matching its filters to a webhook
+type Route struct {
+	Name       string `json:"name"`
+	WebhookUrl string `json:"webhook_url,omitempty"`
+	// equivalent webhook urls to spread messages across, instead of a single webhook url
+	Endpoints []Endpoint `json:"endpoints,omitempty"`
+	// webhook urls in order of preference, moving on to the next when delivery to one fails
+	Failover []string `json:"failover,omitempty"`
+	// where capabilities are probed, defaulting to the webhook url
+	ProbeUrl string `json:"probe_url,omitempty"`
+	// publishes to a message broker instead of a webhook
+	Nats  *NatsDestination  `json:"nats,omitempty"`
+	Mqtt  *MqttDestination  `json:"mqtt,omitempty"`
+	Amqp  *AmqpDestination  `json:"amqp,omitempty"`
+	Redis *RedisDestination `json:"redis,omitempty"`
+	Sqs   *SqsDestination   `json:"sqs,omitempty"`
+	Sns   *SnsDestination   `json:"sns,omitempty"`
+	Grpc  *GrpcDestination  `json:"grpc,omitempty"`
+
+	MessagePrefix string `json:"message_prefix,omitempty"`
+	// only messages starting with one of these commands, like !deploy, are delivered, with the
+	// command that matched
+	Commands []string `json:"commands,omitempty"`
+	// replies in the chat once a message matching the prefix or commands has been delivered
+	Receipt *ReceiptConfig `json:"receipt,omitempty"`
+	// only messages from these user ids or usernames are delivered, such as to stop anyone
+	// triggering commands
+	AllowedUsers []string `json:"allowed_users,omitempty"`
+	// the fraction of messages delivered, such as 0.1 for 1 in 10, for a sample of busy gateways
+	SampleRate float64 `json:"sample_rate,omitempty"`
+	// how edited messages are delivered, either in full, or as a before and after or unified diff
+	EditMode string `json:"edit_mode,omitempty"`
+	// steps that rewrite protocol specific formatting in the text, in order, like irc colour codes
+	Normalize []string `json:"normalize,omitempty"`
+	// the longest text delivered, in characters, and whether longer messages are split or truncated
+	MaxTextLength int    `json:"max_text_length,omitempty"`
+	LongText      string `json:"long_text,omitempty"`
+	// a jq expression that reshapes each message into the payload the receiver expects
+	PayloadJq string `json:"payload_jq,omitempty"`
+	// posts messages to a chat service's incoming webhook in its own format
+	Format *FormatConfig `json:"format,omitempty"`
+	// delivers a summary of the route's messages at an interval, instead of each message
+	Digest *DigestConfig `json:"digest,omitempty"`
+
+	// scheduling settings, which are isolated from other routes
+	Workers    int     `json:"workers,omitempty"`
+	QueueSize  int     `json:"queue_size,omitempty"`
+	RateLimit  float64 `json:"rate_limit,omitempty"`
+	MaxRetries int     `json:"max_retries,omitempty"`
+}
+
+// sampled reports whether a message is in the route's sample. messages with ids are chosen by
+// their id, so edits are delivered along with the messages they change.
+func (r Route) sampled(msg Message) bool {
+	if r.SampleRate <= 0 || r.SampleRate >= 1 {
+		return true
+	}
+	// bucket messages consistently, like feature flag percentages
+	h := fnv.New32a()
+	h.Write([]byte(r.Name))
+	if msg.Id != "" {
+		h.Write([]byte(msg.Source + msg.Id))
+	} else {
+		h.Write([]byte(msg.Timestamp + msg.Text))
+	}
+	return float64(h.Sum32()%10_000) < r.SampleRate*10_000
+}
+
+// allowsUser reports whether a message is from a user the route delivers messages from
+func (r Route) allowsUser(msg Message) bool {
+	if len(r.AllowedUsers) == 0 {
+		return true
+	}
+	return (msg.Userid != "" && slices.Contains(r.AllowedUsers, msg.Userid)) ||
+		(msg.Username != "" && slices.Contains(r.AllowedUsers, msg.Username))
+}
+
+// Validate checks the configuration can be used for forwarding messages
+func (c Config) Validate() error {
+	if len(c.Routes) == 0 && len(c.Pipelines) == 0 {
+		return fmt.Errorf("at least one route must be configured")
+	}
+	if len(c.Routes) > 0 && len(c.Pipelines) > 0 {
+		return fmt.Errorf("routes must be in a pipeline when pipelines are configured")
+	}
+	pipelines := map[string]bool{}
+	for _, p := range c.Pipelines {
+		if err := p.validate(); err != nil {
+			return err
+		}
+		if pipelines[p.Name] {
+			return fmt.Errorf("pipeline %s is defined more than once", p.Name)
+		}
+		pipelines[p.Name] = true
+	}
+
+	names := map[string]bool{}
+	for i, route := range c.allRoutes() {
+		if route.Name == "" {
+			return fmt.Errorf("route %d must have a name", i)
+		}
+		if names[route.Name] {
+			return fmt.Errorf("route %s is defined more than once", route.Name)
+		}
+		names[route.Name] = true
+
+		destinations := 0
+		for _, set := range []bool{route.WebhookUrl != "", len(route.Endpoints) > 0, len(route.Failover) > 0, route.Nats != nil, route.Mqtt != nil, route.Amqp != nil, route.Redis != nil, route.Sqs != nil, route.Sns != nil, route.Grpc != nil} {
+			if set {
+				destinations++
+			}
+		}
+		if destinations == 0 {
+			return fmt.Errorf("route %s must have a webhook url", route.Name)
+		}
+		if destinations > 1 {
+			return fmt.Errorf("route %s must have only one of a webhook url, endpoints, failover, nats, mqtt, amqp, redis, sqs, sns or grpc", route.Name)
+		}
+		if route.Nats != nil {
+			if err := route.Nats.validate(); err != nil {
+				return fmt.Errorf("route %s has an invalid nats destination: %v", route.Name, err)
+			}
+		}
+		if route.Mqtt != nil {
+			if err := route.Mqtt.validate(); err != nil {
+				return fmt.Errorf("route %s has an invalid mqtt destination: %v", route.Name, err)
+			}
+		}
+		if route.Amqp != nil {
+			if err := route.Amqp.validate(); err != nil {
+				return fmt.Errorf("route %s has an invalid amqp destination: %v", route.Name, err)
+			}
+		}
+		if route.Redis != nil {
+			if err := route.Redis.validate(); err != nil {
+				return fmt.Errorf("route %s has an invalid redis destination: %v", route.Name, err)
+			}
+		}
+		if route.Sqs != nil {
+			if err := route.Sqs.validate(); err != nil {
+				return fmt.Errorf("route %s has an invalid sqs destination: %v", route.Name, err)
+			}
+		}
+		if route.Sns != nil {
+			if err := route.Sns.validate(); err != nil {
+				return fmt.Errorf("route %s has an invalid sns destination: %v", route.Name, err)
+			}
+		}
+		if route.Grpc != nil {
+			if err := route.Grpc.validate(); err != nil {
+				return fmt.Errorf("route %s has an invalid grpc destination: %v", route.Name, err)
+			}
+		}
+		if route.WebhookUrl != "" {
+			if _, err := url.ParseRequestURI(route.WebhookUrl); err != nil {
+				return fmt.Errorf("route %s has an invalid webhook url: %v", route.Name, err)
+			}
+		}
+		for _, endpoint := range route.Endpoints {
+			if _, err := url.ParseRequestURI(endpoint.Url); err != nil {
+				return fmt.Errorf("route %s has an invalid endpoint url: %v", route.Name, err)
+			}
+			if endpoint.Weight < 0 {
+				return fmt.Errorf("route %s must not have negative endpoint weights", route.Name)
+			}
+		}
+		for _, failover := range route.Failover {
+			if _, err := url.ParseRequestURI(failover); err != nil {
+				return fmt.Errorf("route %s has an invalid failover url: %v", route.Name, err)
+			}
+		}
+		if route.ProbeUrl != "" {
+			if _, err := url.ParseRequestURI(route.ProbeUrl); err != nil {
+				return fmt.Errorf("route %s has an invalid probe url: %v", route.Name, err)
+			}
+		}
+		if route.PayloadJq != "" {
+			if _, err := compilePayloadJq(route.PayloadJq); err != nil {
+				return fmt.Errorf("route %s has an invalid payload_jq: %v", route.Name, err)
+			}
+		}
+		if route.Format != nil {
+			if len(webhookTargets(route)) == 0 {
+				return fmt.Errorf("route %s can only have a format with a webhook", route.Name)
+			}
+			if route.PayloadJq != "" {
+				return fmt.Errorf("route %s can't have both a format and a payload_jq", route.Name)
+			}
+			if err := route.Format.validate(); err != nil {
+				return fmt.Errorf("route %s has an invalid format: %v", route.Name, err)
+			}
+		}
+		if route.Receipt != nil {
+			if route.MessagePrefix == "" && len(route.Commands) == 0 {
+				return fmt.Errorf("route %s can only have a receipt with a message prefix or commands", route.Name)
+			}
+			if err := route.Receipt.validate(); err != nil {
+				return fmt.Errorf("route %s has an invalid receipt: %v", route.Name, err)
+			}
+		}
+		for _, command := range route.Commands {
+			if command == "" || strings.ContainsFunc(command, unicode.IsSpace) {
+				return fmt.Errorf("route %s has an invalid command %q, commands must be a single word", route.Name, command)
+			}
+		}
+		if err := validateNormalize(route.Normalize); err != nil {
+			return fmt.Errorf("route %s has an invalid normalize list: %v", route.Name, err)
+		}
+		switch route.EditMode {
+		case "", editModeFull, editModeBeforeAfter, editModeUnified:
+		default:
+			return fmt.Errorf("route %s has an unknown edit mode: %s", route.Name, route.EditMode)
+		}
+		switch route.LongText {
+		case "", longTextSplit:
+			if route.MaxTextLength > 0 && route.MaxTextLength < minSplitTextLength {
+				return fmt.Errorf("route %s must have a max text length of at least %d to split messages", route.Name, minSplitTextLength)
+			}
+		case longTextTruncate:
+		default:
+			return fmt.Errorf("route %s has an unknown long text mode: %s", route.Name, route.LongText)
+		}
+		if route.MaxTextLength < 0 {
+			return fmt.Errorf("route %s must not have a negative max text length", route.Name)
+		}
+		if route.Digest != nil {
+			if err := route.Digest.validate(); err != nil {
+				return fmt.Errorf("route %s has an invalid digest: %v", route.Name, err)
+			}
+		}
+		if route.SampleRate < 0 || route.SampleRate > 1 {
+			return fmt.Errorf("route %s must have a sample rate between 0 and 1", route.Name)
+		}
+		if route.Workers < 0 || route.QueueSize < 0 || route.RateLimit < 0 || route.MaxRetries < 0 {
+			return fmt.Errorf("route %s must not have negative scheduling settings", route.Name)
+		}
+	}
+
+	if _, err := c.DaySeparators.location(); err != nil {
+		return err
+	}
+	if err := c.FloodProtection.validate(); err != nil {
+		return err
+	}
+
+	for name, flag := range c.Features {
+		if flag.Percentage != nil && (*flag.Percentage < 0 || *flag.Percentage > 100) {
+			return fmt.Errorf("feature flag %s must have a percentage between 0 and 100", name)
+		}
+	}
+
+	return nil
+}
+
+// parseConfig decodes and validates a json configuration
+func parseConfig(data []byte) (Config, error) {
+	cfg := Config{}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("failed to parse config: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return cfg, fmt.Errorf("invalid config: %v", err)
+	}
+	return cfg, nil
+}
+
+// loadConfig reads the initial configuration from the config file if one is given, otherwise a
+// single route is built from the webhook url and message prefix
+func loadConfig(configFile string, webhookUrl string, messagePrefix string, commands string) (Config, error) {
+	if configFile != "" {
+		data, err := os.ReadFile(configFile)
+		if err != nil {
+			return Config{}, fmt.Errorf("failed to read config file: %v", err)
+		}
+		return parseConfig(data)
+	}
+
+	cfg := Config{Routes: []Route{}}
+	if webhookUrl != "" {
+		cfg.Routes = append(cfg.Routes, Route{
+			Name:          "default",
+			WebhookUrl:    webhookUrl,
+			MessagePrefix: messagePrefix,
+		})
+	}
+	commandRoutes, err := parseCommandRoutes(commands)
+	if err != nil {
+		return Config{}, err
+	}
+	cfg.Routes = append(cfg.Routes, commandRoutes...)
+	return cfg, cfg.Validate()
+}
+
+// ConfigStore holds the current configuration along with a version number that is incremented
+// every time it changes
+type ConfigStore struct {
+	mu      sync.RWMutex
+	config  Config
+	version uint64
+}
+
+func newConfigStore(cfg Config) *ConfigStore {
+	return &ConfigStore{
+		config:  cfg,
+		version: 1,
+	}
+}
+
+// Get returns the current configuration and its version
+func (s *ConfigStore) Get() (Config, uint64) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.config, s.version
+}
+
+// Update replaces the configuration only if the given version is still the current one, returning
+// the new version
+func (s *ConfigStore) Update(cfg Config, version uint64) (uint64, error) {
+	if err := cfg.Validate(); err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if version != s.version {
+		return s.version, errVersionConflict
+	}
+
+	s.config = cfg
+	s.version++
+	return s.version, nil
+}
+
+// Replace unconditionally swaps in a new configuration, returning the new version. this is used by
+// external configuration sources which are the source of truth.
+func (s *ConfigStore) Replace(cfg Config) (uint64, error) {
+	if err := cfg.Validate(); err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.config = cfg
+	s.version++
+	return s.version, nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// what happens when a webhook can't be reached at startup
+const (
+	// the problem is logged, and the bridge starts anyway
+	startupCheckWarn = "warn"
+	// the bridge doesn't start
+	startupCheckFail = "fail"
+)
+
+// eventPing is the event of the test message posted to webhooks when checking them with POST
+const eventPing = "ping"
+
+// connectivityTimeout is how long each webhook has to respond to the check
+const connectivityTimeout = 10 * time.Second
+
+// webhookCheck is the result of checking a webhook of a route
+type webhookCheck struct {
+	route string
+	// the redacted url, for logs
+	url string
+	err error
+}
+
+// loadCheckMethod reads the method used to check webhooks from the environment
+func loadCheckMethod() (string, error) {
+	method := strings.ToUpper(os.Getenv("STARTUP_CHECK_METHOD"))
+	switch method {
+	case "":
+		return http.MethodHead, nil
+	case http.MethodHead, http.MethodOptions, http.MethodPost:
+		return method, nil
+	default:
+		return "", fmt.Errorf("unsupported startup check method: %s, must be HEAD, OPTIONS or POST", method)
+	}
+}
+
+// webhookTargets lists every webhook a route can post to
+func webhookTargets(route Route) []string {
+	targets := []string{}
+	if route.WebhookUrl != "" {
+		targets = append(targets, route.WebhookUrl)
+	}
+	for _, endpoint := range route.Endpoints {
+		targets = append(targets, endpoint.Url)
+	}
+	return append(targets, route.Failover...)
+}
+
+// checkConnectivity sends a test request to every webhook in the config
+func checkConnectivity(ctx context.Context, cfg Config, method string, opts deliveryOptions) []webhookCheck {
+	checks := []webhookCheck{}
+	for _, route := range cfg.allRoutes() {
+		for _, target := range webhookTargets(route) {
+			checks = append(checks, webhookCheck{
+				route: route.Name,
+				url:   redactUrl(target),
+				err:   checkWebhook(ctx, target, method, opts),
+			})
+		}
+	}
+	return checks
+}
+
+// checkWebhook sends a test request to a webhook. any response means it can be reached, except
+// ones saying the url or credentials are wrong, or that the server is broken. servers that don't
+// support the method still answered, so are fine. with POST, a message with the ping event is
+// sent, for webhooks that only handle posts.
+func checkWebhook(ctx context.Context, target string, method string, opts deliveryOptions) error {
+	ctx, cancel := context.WithTimeout(ctx, connectivityTimeout)
+	defer cancel()
+
+	var body io.Reader
+	if method == http.MethodPost {
+		payload, _, err := encodePayload([]Message{{Event: eventPing, Timestamp: time.Now().UTC().Format(time.RFC3339)}}, capabilities{})
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return fmt.Errorf("failed to build request: %v", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", contentTypeJson)
+	}
+	if opts.webhookToken != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", opts.webhookToken))
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusGone:
+		return fmt.Errorf("webhook returned %s, check the url", res.Status)
+	case res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden:
+		return fmt.Errorf("webhook returned %s, check the token", res.Status)
+	case res.StatusCode >= 500 && res.StatusCode != http.StatusNotImplemented:
+		return fmt.Errorf("webhook returned %s", res.Status)
+	}
+	return nil
+}
+
+// startupCheck checks the webhooks before the bridge starts. problems are logged, and with the
+// fail mode the bridge doesn't start.
+func startupCheck(ctx context.Context, cfg Config, mode string, opts deliveryOptions) error {
+	if mode != startupCheckWarn && mode != startupCheckFail {
+		return fmt.Errorf("unknown startup check mode: %s, must be %s or %s", mode, startupCheckWarn, startupCheckFail)
+	}
+	method, err := loadCheckMethod()
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, check := range checkConnectivity(ctx, cfg, method, opts) {
+		if check.err == nil {
+			slog.Debug("webhook is reachable", "route", check.route, "url", check.url)
+			continue
+		}
+		failed++
+		slog.Error("webhook is unreachable", "route", check.route, "url", check.url, slog.Any("error", check.err))
+	}
+	if failed > 0 && mode == startupCheckFail {
+		return fmt.Errorf("%d webhooks failed the startup check", failed)
+	}
+	return nil
+}
+
+// runValidate checks the config and sends a test request to every webhook, without running the
+// bridge. it fails if any of them can't be reached.
+func runValidate(args []string, out io.Writer) error {
+	defaultMethod, err := loadCheckMethod()
+	if err != nil {
+		return err
+	}
+	flags := flag.NewFlagSet("validate", flag.ContinueOnError)
+	method := flags.String("method", defaultMethod, "request method to check webhooks with, HEAD, OPTIONS or POST")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	*method = strings.ToUpper(*method)
+	if *method != http.MethodHead && *method != http.MethodOptions && *method != http.MethodPost {
+		return fmt.Errorf("unsupported method: %s, must be HEAD, OPTIONS or POST", *method)
+	}
+
+	webhookUrl, err := secretEnv("WEBHOOK_URL")
+	if err != nil {
+		return err
+	}
+	configFile := os.Getenv("CONFIG_FILE")
+	if webhookUrl == "" && configFile == "" && os.Getenv("KUBERNETES_CONFIGMAP") == "" && os.Getenv("CONSUL_KEY") == "" && os.Getenv("COMMANDS") == "" {
+		return fmt.Errorf("the webhook url or config must be set")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store, err := setupConfig(ctx, configFile, webhookUrl, os.Getenv("MESSAGE_PREFIX"))
+	if err != nil {
+		return err
+	}
+	opts, err := loadDeliveryOptions()
+	if err != nil {
+		return err
+	}
+	cfg, _ := store.Get()
+
+	failed := 0
+	for _, check := range checkConnectivity(ctx, cfg, *method, opts) {
+		if check.err != nil {
+			failed++
+			fmt.Fprintf(out, "FAIL %s %s: %v\n", check.route, check.url, check.err)
+		} else {
+			fmt.Fprintf(out, "ok   %s %s\n", check.route, check.url)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d webhooks failed the check", failed)
+	}
+	return nil
+}
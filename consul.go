@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+)
+
+// consulWaitTime is how long a blocking query waits for a change before returning
+const consulWaitTime = 5 * time.Minute
+
+// consulWatcher applies routing configuration from a consul kv key whenever it changes. the last
+// applied config is cached locally so the bridge can still start when consul is unreachable.
+type consulWatcher struct {
+	addr      string
+	key       string
+	token     string
+	cacheFile string
+	store     *ConfigStore
+}
+
+func newConsulWatcher(addr string, key string, token string, cacheFile string, store *ConfigStore) *consulWatcher {
+	return &consulWatcher{
+		addr:      strings.TrimSuffix(addr, "/"),
+		key:       strings.TrimPrefix(key, "/"),
+		token:     token,
+		cacheFile: cacheFile,
+		store:     store,
+	}
+}
+
+// fetch gets the value of the key. when index is set the request blocks until the value changes
+// past that index or the wait time passes.
+func (w *consulWatcher) fetch(ctx context.Context, index uint64) ([]byte, uint64, error) {
+	query := url.Values{"raw": {"true"}}
+	if index > 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", consulWaitTime.String())
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/v1/kv/%s?%s", w.addr, w.key, query.Encode()), nil)
+	if err != nil {
+		return nil, index, fmt.Errorf("failed to build request: %v", err)
+	}
+	if w.token != "" {
+		req.Header.Set("X-Consul-Token", w.token)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, index, fmt.Errorf("failed to request key: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return nil, index, fmt.Errorf("key %s does not exist", w.key)
+	} else if res.StatusCode != http.StatusOK {
+		return nil, index, fmt.Errorf("consul returned %s", res.Status)
+	}
+
+	newIndex, err := strconv.ParseUint(res.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil {
+		return nil, index, fmt.Errorf("invalid consul index: %v", err)
+	}
+
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, index, fmt.Errorf("failed to read key: %v", err)
+	}
+
+	return data, newIndex, nil
+}
+
+// apply parses the config and swaps it into the store, caching it if it was valid
+func (w *consulWatcher) apply(data []byte, index uint64) error {
+	cfg, err := parseConfig(data)
+	if err != nil {
+		return err
+	}
+
+	version, err := w.store.Replace(cfg)
+	if err != nil {
+		return err
+	}
+	slog.Info("applied config from consul", "key", w.key, "index", index, "version", version)
+
+	if w.cacheFile != "" {
+		if err := os.WriteFile(w.cacheFile, data, 0600); err != nil {
+			slog.Warn("failed to cache consul config", "file", w.cacheFile, "error", err)
+		}
+	}
+	return nil
+}
+
+// load fetches and applies the current config, returning the index to watch from. if consul can't
+// be reached the cached config is used instead, and a zero index is returned.
+func (w *consulWatcher) load(ctx context.Context) (uint64, error) {
+	data, index, err := w.fetch(ctx, 0)
+	if err == nil {
+		return index, w.apply(data, index)
+	}
+
+	if w.cacheFile == "" {
+		return 0, fmt.Errorf("failed to load config from consul: %v", err)
+	}
+
+	slog.Warn("failed to load config from consul, using cached config", "error", err, "file", w.cacheFile)
+	cached, cacheErr := os.ReadFile(w.cacheFile)
+	if cacheErr != nil {
+		return 0, fmt.Errorf("failed to load config from consul: %v, and failed to read cache: %v", err, cacheErr)
+	}
+
+	cfg, cacheErr := parseConfig(cached)
+	if cacheErr != nil {
+		return 0, fmt.Errorf("failed to load config from consul: %v, and cached config is invalid: %v", err, cacheErr)
+	}
+	_, err = w.store.Replace(cfg)
+	return 0, err
+}
+
+// run watches the key forever with blocking queries, retrying with a backoff when consul fails
+func (w *consulWatcher) run(ctx context.Context, index uint64) {
+	b := backoff.NewExponentialBackOff()
+	b.MaxElapsedTime = 0
+
+	for ctx.Err() == nil {
+		data, newIndex, err := w.fetch(ctx, index)
+		if err != nil {
+			d := b.NextBackOff()
+			slog.Warn("consul watch failed", "error", err, "retry", d.String())
+			time.Sleep(d)
+			continue
+		}
+		b.Reset()
+
+		switch {
+		case newIndex < index:
+			// the index going backwards means consul's state was reset, so start again
+			index = 0
+		case newIndex == index:
+			// the wait time passed without any changes
+		default:
+			index = newIndex
+			if err := w.apply(data, index); err != nil {
+				slog.Warn("ignoring invalid config from consul", "key", w.key, "error", err)
+			}
+		}
+	}
+}
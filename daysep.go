@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// eventDaySeparator is the event of the synthetic messages marking the start of a new day
+const eventDaySeparator = "day_separator"
+
+// DaySeparators configures injecting a message before the first message of each day in a channel
+type DaySeparators struct {
+	Enabled bool `json:"enabled"`
+	// the iana time zone days are counted in, defaulting to utc
+	Timezone string `json:"timezone,omitempty"`
+}
+
+// location returns the time zone days are counted in
+func (d DaySeparators) location() (*time.Location, error) {
+	if d.Timezone == "" {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(d.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid day separator time zone: %v", err)
+	}
+	return loc, nil
+}
+
+// dayTracker remembers the day the last message was seen in each channel
+type dayTracker struct {
+	days map[string]string
+	// the last time zone loaded, as loading it reads from disk
+	timezone string
+	loc      *time.Location
+}
+
+func newDayTracker() *dayTracker {
+	return &dayTracker{days: map[string]string{}}
+}
+
+// separator returns a day separator message if the message is the first in its channel today
+func (t *dayTracker) separator(cfg DaySeparators, msg Message, now time.Time) (Message, bool) {
+	if !cfg.Enabled || msg.Event != "" {
+		return Message{}, false
+	}
+	if t.loc == nil || t.timezone != cfg.Timezone {
+		// the time zone was checked when the config was loaded
+		loc, err := cfg.location()
+		if err != nil {
+			return Message{}, false
+		}
+		t.timezone, t.loc = cfg.Timezone, loc
+	}
+	loc := t.loc
+
+	now = now.In(loc)
+	key := msg.Source + "/" + msg.Gateway + "/" + msg.Channel
+	day := now.Format(time.DateOnly)
+	if t.days[key] == day {
+		return Message{}, false
+	}
+	t.days[key] = day
+
+	// the account and protocol are kept so the separator has the same priority as the message, and
+	// is delivered before it
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	return Message{
+		Text:      now.Format("Monday, 2 January 2006"),
+		Channel:   msg.Channel,
+		Gateway:   msg.Gateway,
+		Protocol:  msg.Protocol,
+		Account:   msg.Account,
+		Event:     eventDaySeparator,
+		Timestamp: midnight.Format(time.RFC3339),
+		Source:    msg.Source,
+	}, true
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// defaultDedupSize is the number of recent message ids remembered for spotting duplicates
+const defaultDedupSize = 1000
+
+var dedup = &dedupStore{}
+
+// dedupStore remembers the ids of recent messages, so a message matterbridge sends again, like
+// when its history is replayed, isn't delivered twice. a message with a known id but different
+// text is an edit rather than a duplicate. the ids can be kept in a file, so they are remembered
+// across restarts.
+type dedupStore struct {
+	mu      sync.Mutex
+	enabled bool
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+
+	path  string
+	file  *os.File
+	lines int
+}
+
+// dedupEntry is a remembered message, and a line of the dedup file
+type dedupEntry struct {
+	Key  string `json:"key"`
+	Hash string `json:"hash"`
+}
+
+// enable starts suppressing duplicates. with a path, the ids already in the file are loaded and
+// new ones are appended to it as messages are received.
+func (d *dedupStore) enable(size int, path string) error {
+	if size <= 0 {
+		return fmt.Errorf("DEDUP_SIZE must be positive")
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.size = size
+	d.order = list.New()
+	d.entries = map[string]*list.Element{}
+	d.enabled = true
+
+	if path == "" {
+		return nil
+	}
+	d.path = path
+	if err := d.load(); err != nil {
+		return err
+	}
+	// start from a compact file, so it doesn't keep growing across restarts
+	return d.compact()
+}
+
+// load reads the remembered ids from the file. a missing file is the first run, and lines that
+// can't be read, like one cut short by a crash, are skipped.
+func (d *dedupStore) load() error {
+	f, err := os.Open(d.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read dedup file: %v", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		entry := dedupEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil || entry.Key == "" {
+			continue
+		}
+		d.remember(entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read dedup file: %v", err)
+	}
+	return nil
+}
+
+// duplicate reports whether a message has already been received, remembering it if it hasn't.
+// messages without an id can't be told apart, so are never duplicates.
+func (d *dedupStore) duplicate(msg Message) bool {
+	if msg.Id == "" {
+		return false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.enabled {
+		return false
+	}
+
+	// ids are only unique within a matterbridge instance
+	sum := sha256.Sum256([]byte(msg.Text))
+	entry := dedupEntry{Key: msg.Source + "/" + msg.Id, Hash: hex.EncodeToString(sum[:16])}
+	if el, ok := d.entries[entry.Key]; ok && el.Value.(*dedupEntry).Hash == entry.Hash {
+		d.order.MoveToFront(el)
+		return true
+	}
+
+	d.remember(entry)
+	if d.file != nil {
+		if err := d.append(entry); err != nil {
+			slog.Warn("failed to save message id for deduplication", "file", d.path, slog.Any("error", err))
+		}
+	}
+	return false
+}
+
+// remember adds or updates an entry, forgetting the oldest once there are too many
+func (d *dedupStore) remember(entry dedupEntry) {
+	if el, ok := d.entries[entry.Key]; ok {
+		el.Value.(*dedupEntry).Hash = entry.Hash
+		d.order.MoveToFront(el)
+		return
+	}
+
+	d.entries[entry.Key] = d.order.PushFront(&entry)
+	if d.order.Len() > d.size {
+		oldest := d.order.Back()
+		d.order.Remove(oldest)
+		delete(d.entries, oldest.Value.(*dedupEntry).Key)
+	}
+}
+
+// append adds an entry to the file, which is compacted once it has twice as many lines as
+// there are entries to remember
+func (d *dedupStore) append(entry dedupEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := d.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write dedup file: %v", err)
+	}
+	d.lines++
+	if d.lines > 2*d.size {
+		return d.compact()
+	}
+	return nil
+}
+
+// compact replaces the file with just the remembered entries, oldest first, and reopens it for
+// appending
+func (d *dedupStore) compact() error {
+	if d.file != nil {
+		d.file.Close()
+		d.file = nil
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(d.path), filepath.Base(d.path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write dedup file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	for el := d.order.Back(); el != nil; el = el.Prev() {
+		line, err := json.Marshal(el.Value.(*dedupEntry))
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		w.Write(append(line, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write dedup file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write dedup file: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), d.path); err != nil {
+		return fmt.Errorf("failed to write dedup file: %v", err)
+	}
+
+	f, err := os.OpenFile(d.path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open dedup file: %v", err)
+	}
+	d.file = f
+	d.lines = d.order.Len()
+	return nil
+}
+
+// close closes the dedup file
+func (d *dedupStore) close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.file == nil {
+		return nil
+	}
+	err := d.file.Close()
+	d.file = nil
+	return err
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// routingTable is the effective routing of a bridge, in the order messages go through it
+type routingTable struct {
+	Sources    []describedSource `json:"sources"`
+	Filters    []string          `json:"filters"`
+	Transforms []string          `json:"transforms"`
+	Priority   Priority          `json:"priority,omitempty"`
+	Routes     []describedRoute  `json:"routes"`
+}
+
+type describedSource struct {
+	Name      string `json:"name"`
+	Url       string `json:"url"`
+	Transport string `json:"transport"`
+}
+
+type describedRoute struct {
+	Name         string      `json:"name"`
+	Filters      []string    `json:"filters"`
+	Transforms   []string    `json:"transforms"`
+	Destinations []string    `json:"destinations"`
+	Limits       routeLimits `json:"limits"`
+}
+
+// routeLimits are a route's scheduling settings, with the defaults filled in
+type routeLimits struct {
+	Workers    int     `json:"workers"`
+	QueueSize  int     `json:"queue_size"`
+	RateLimit  float64 `json:"rate_limit,omitempty"`
+	MaxRetries int     `json:"max_retries"`
+	// how often the webhook's capabilities are probed
+	ProbeInterval string `json:"probe_interval,omitempty"`
+}
+
+// treeNode is a line of the human readable routing table
+type treeNode struct {
+	label    string
+	children []treeNode
+}
+
+// runRoutes runs the routes subcommands, which show what the bridge does with messages without
+// running it
+func runRoutes(args []string, out io.Writer) error {
+	if len(args) == 0 || args[0] != "describe" {
+		return fmt.Errorf("usage: matterbridge-to-webhook routes describe [-json]")
+	}
+
+	flags := flag.NewFlagSet("routes describe", flag.ContinueOnError)
+	asJson := flags.Bool("json", false, "print the routing table as json")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	table, err := loadRoutingTable()
+	if err != nil {
+		return err
+	}
+
+	if *asJson {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(table)
+	}
+	printTree(out, table.tree())
+	return nil
+}
+
+// loadRoutingTable reads the sources and config the same way as running the bridge does
+func loadRoutingTable() (routingTable, error) {
+	table := routingTable{}
+
+	sources, err := loadSources()
+	if err != nil {
+		return table, err
+	}
+	webhookUrl, err := secretEnv("WEBHOOK_URL")
+	if err != nil {
+		return table, err
+	}
+	configFile := os.Getenv("CONFIG_FILE")
+	if webhookUrl == "" && configFile == "" && os.Getenv("KUBERNETES_CONFIGMAP") == "" && os.Getenv("CONSUL_KEY") == "" && os.Getenv("COMMANDS") == "" {
+		return table, fmt.Errorf("the webhook url or config must be set")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store, err := setupConfig(ctx, configFile, webhookUrl, os.Getenv("MESSAGE_PREFIX"))
+	if err != nil {
+		return table, err
+	}
+	opts, err := loadDeliveryOptions()
+	if err != nil {
+		return table, err
+	}
+	cfg, _ := store.Get()
+
+	transport := os.Getenv("SOURCE_TRANSPORT")
+	if transport == "" {
+		transport = "stream"
+	}
+	for _, src := range sources {
+		table.Sources = append(table.Sources, describedSource{Name: src.name, Url: redactUrl(src.apiUrl), Transport: transport})
+	}
+
+	table.Filters = loadListFilter().describe()
+	maxAge, err := durationEnv("MAX_MESSAGE_AGE", 0)
+	if err != nil {
+		return table, err
+	}
+	if maxAge > 0 {
+		table.Filters = append(table.Filters, fmt.Sprintf("not older than %s", maxAge))
+	}
+
+	table.Transforms = []string{}
+	if path := os.Getenv("WASM_TRANSFORM"); path != "" {
+		table.Transforms = append(table.Transforms, fmt.Sprintf("wasm module %s", path))
+	}
+	if path := os.Getenv("SCRIPT_FILE"); path != "" {
+		table.Transforms = append(table.Transforms, fmt.Sprintf("script %s", path))
+	}
+	if len(cfg.Accounts) > 0 {
+		table.Transforms = append(table.Transforms, fmt.Sprintf("account info for %d accounts", len(cfg.Accounts)))
+	}
+	if cfg.DaySeparators.Enabled {
+		timezone := cfg.DaySeparators.Timezone
+		if timezone == "" {
+			timezone = "UTC"
+		}
+		table.Transforms = append(table.Transforms, fmt.Sprintf("day separators in %s", timezone))
+	}
+	table.Priority = cfg.Priority
+
+	for _, route := range redactConfig(cfg).allRoutes() {
+		table.Routes = append(table.Routes, describeRoute(route, opts))
+	}
+	return table, nil
+}
+
+func describeRoute(route Route, opts deliveryOptions) describedRoute {
+	described := describedRoute{
+		Name:         route.Name,
+		Filters:      []string{},
+		Transforms:   []string{},
+		Destinations: []string{},
+		Limits: routeLimits{
+			Workers:    route.Workers,
+			QueueSize:  route.QueueSize,
+			RateLimit:  route.RateLimit,
+			MaxRetries: route.MaxRetries,
+		},
+	}
+	if described.Limits.Workers == 0 {
+		described.Limits.Workers = defaultRouteWorkers
+	}
+	if described.Limits.QueueSize == 0 {
+		described.Limits.QueueSize = defaultRouteQueueSize
+	}
+
+	if route.MessagePrefix != "" {
+		described.Filters = append(described.Filters, fmt.Sprintf("message prefix %q", route.MessagePrefix))
+	}
+	if len(route.Commands) > 0 {
+		described.Filters = append(described.Filters, fmt.Sprintf("commands %s", strings.Join(route.Commands, ", ")))
+	}
+	if len(route.AllowedUsers) > 0 {
+		described.Filters = append(described.Filters, fmt.Sprintf("only users %s", strings.Join(route.AllowedUsers, ", ")))
+	}
+	if route.SampleRate > 0 && route.SampleRate < 1 {
+		described.Filters = append(described.Filters, fmt.Sprintf("sample of %g%% of messages", route.SampleRate*100))
+	}
+
+	if route.EditMode != "" && route.EditMode != editModeFull {
+		described.Transforms = append(described.Transforms, fmt.Sprintf("edits as %s", route.EditMode))
+	}
+	if route.Digest != nil {
+		described.Transforms = append(described.Transforms, fmt.Sprintf("digest every %s", route.Digest.Interval))
+	}
+	if len(route.Normalize) > 0 {
+		described.Transforms = append(described.Transforms, fmt.Sprintf("normalize %s", strings.Join(route.Normalize, ", ")))
+	}
+	if route.MaxTextLength > 0 {
+		mode := route.LongText
+		if mode == "" {
+			mode = longTextSplit
+		}
+		described.Transforms = append(described.Transforms, fmt.Sprintf("%s text longer than %d characters", mode, route.MaxTextLength))
+	}
+	if route.PayloadJq != "" && opts.execHook == nil {
+		described.Transforms = append(described.Transforms, fmt.Sprintf("payload jq %s", route.PayloadJq))
+	}
+	if route.Format != nil && opts.execHook == nil {
+		described.Transforms = append(described.Transforms, fmt.Sprintf("format for %s", route.Format.Type))
+	}
+	if opts.execHook != nil {
+		described.Transforms = append(described.Transforms, fmt.Sprintf("exec hook %s", strings.Join(opts.execHook.command, " ")))
+	}
+
+	switch {
+	case route.Nats != nil:
+		nats := fmt.Sprintf("nats %s subject %s", route.Nats.Url, route.Nats.Subject)
+		if route.Nats.JetStream {
+			nats += " with jetstream"
+		}
+		described.Destinations = append(described.Destinations, nats)
+	case route.Mqtt != nil:
+		qos := 1
+		if route.Mqtt.QoS != nil {
+			qos = *route.Mqtt.QoS
+		}
+		mqtt := fmt.Sprintf("mqtt %s topic %s qos %d", route.Mqtt.Url, route.Mqtt.Topic, qos)
+		if route.Mqtt.Retained {
+			mqtt += " retained"
+		}
+		described.Destinations = append(described.Destinations, mqtt)
+	case route.Amqp != nil:
+		routingKey := route.Amqp.RoutingKey
+		if routingKey == "" {
+			routingKey = defaultRoutingKey
+		}
+		exchange := route.Amqp.Exchange
+		if exchange == "" {
+			exchange = "(default)"
+		}
+		described.Destinations = append(described.Destinations, fmt.Sprintf("amqp %s exchange %s routing key %s", route.Amqp.Url, exchange, routingKey))
+	case route.Redis != nil:
+		redis := fmt.Sprintf("redis %s stream %s", route.Redis.Url, route.Redis.Stream)
+		if route.Redis.MaxLen > 0 {
+			redis += fmt.Sprintf(" max length %d", route.Redis.MaxLen)
+		}
+		described.Destinations = append(described.Destinations, redis)
+	case route.Sqs != nil:
+		described.Destinations = append(described.Destinations, fmt.Sprintf("sqs %s", route.Sqs.QueueUrl))
+	case route.Sns != nil:
+		described.Destinations = append(described.Destinations, fmt.Sprintf("sns %s", route.Sns.TopicArn))
+	case route.Grpc != nil:
+		grpc := fmt.Sprintf("grpc %s", route.Grpc.Address)
+		if route.Grpc.Insecure {
+			grpc += " without tls"
+		}
+		described.Destinations = append(described.Destinations, grpc)
+	case len(route.Endpoints) > 0:
+		for _, endpoint := range route.Endpoints {
+			weight := endpoint.Weight
+			if weight == 0 {
+				weight = 1
+			}
+			described.Destinations = append(described.Destinations, fmt.Sprintf("webhook %s weight %d", endpoint.Url, weight))
+		}
+	case len(route.Failover) > 0:
+		described.Destinations = append(described.Destinations, fmt.Sprintf("webhook %s", route.Failover[0]))
+		for _, failover := range route.Failover[1:] {
+			described.Destinations = append(described.Destinations, fmt.Sprintf("then webhook %s", failover))
+		}
+	default:
+		described.Destinations = append(described.Destinations, fmt.Sprintf("webhook %s", route.WebhookUrl))
+	}
+	// only webhooks are probed
+	if (route.WebhookUrl != "" || len(route.Endpoints) > 0 || len(route.Failover) > 0) && opts.probeInterval > 0 {
+		described.Limits.ProbeInterval = opts.probeInterval.String()
+	}
+
+	return described
+}
+
+// tree lays out the routing table for printing
+func (t routingTable) tree() []treeNode {
+	sources := treeNode{label: "sources"}
+	for _, src := range t.Sources {
+		sources.children = append(sources.children, treeNode{label: fmt.Sprintf("%s %s (%s)", src.Name, src.Url, src.Transport)})
+	}
+
+	filters := treeNode{label: "filters"}
+	for _, filter := range t.Filters {
+		filters.children = append(filters.children, treeNode{label: filter})
+	}
+	if len(t.Filters) == 0 {
+		filters.children = append(filters.children, treeNode{label: "all messages"})
+	}
+
+	transforms := treeNode{label: "transforms"}
+	for _, transform := range t.Transforms {
+		transforms.children = append(transforms.children, treeNode{label: transform})
+	}
+	if len(t.Transforms) == 0 {
+		transforms.children = append(transforms.children, treeNode{label: "none"})
+	}
+
+	routes := treeNode{label: "routes"}
+	if len(t.Priority.Accounts) > 0 || len(t.Priority.Protocols) > 0 {
+		priority := []string{}
+		if len(t.Priority.Accounts) > 0 {
+			priority = append(priority, "accounts "+strings.Join(t.Priority.Accounts, ", "))
+		}
+		if len(t.Priority.Protocols) > 0 {
+			priority = append(priority, "protocols "+strings.Join(t.Priority.Protocols, ", "))
+		}
+		routes.label = fmt.Sprintf("routes (high priority: %s)", strings.Join(priority, "; "))
+	}
+	for _, route := range t.Routes {
+		routes.children = append(routes.children, route.tree())
+	}
+
+	return []treeNode{sources, filters, transforms, routes}
+}
+
+func (r describedRoute) tree() treeNode {
+	node := treeNode{label: r.Name}
+
+	filters := treeNode{label: "filters"}
+	for _, filter := range r.Filters {
+		filters.children = append(filters.children, treeNode{label: filter})
+	}
+	if len(r.Filters) == 0 {
+		filters.children = append(filters.children, treeNode{label: "all messages"})
+	}
+	node.children = append(node.children, filters)
+
+	if len(r.Transforms) > 0 {
+		transforms := treeNode{label: "transforms"}
+		for _, transform := range r.Transforms {
+			transforms.children = append(transforms.children, treeNode{label: transform})
+		}
+		node.children = append(node.children, transforms)
+	}
+
+	destinations := treeNode{label: "destinations"}
+	for _, destination := range r.Destinations {
+		destinations.children = append(destinations.children, treeNode{label: destination})
+	}
+	node.children = append(node.children, destinations)
+
+	limits := []string{
+		fmt.Sprintf("workers %d", r.Limits.Workers),
+		fmt.Sprintf("queue size %d", r.Limits.QueueSize),
+		fmt.Sprintf("max retries %d", r.Limits.MaxRetries),
+	}
+	if r.Limits.RateLimit > 0 {
+		limits = append(limits, fmt.Sprintf("rate limit %g/s", r.Limits.RateLimit))
+	}
+	if r.Limits.ProbeInterval != "" {
+		limits = append(limits, fmt.Sprintf("probed every %s", r.Limits.ProbeInterval))
+	}
+	node.children = append(node.children, treeNode{label: "limits: " + strings.Join(limits, ", ")})
+
+	return node
+}
+
+// printTree writes the nodes as headings, with their children under them drawn with box drawing
+// lines like the tree command
+func printTree(out io.Writer, nodes []treeNode) {
+	for _, node := range nodes {
+		fmt.Fprintln(out, node.label)
+		printBranches(out, "", node.children)
+	}
+}
+
+func printBranches(out io.Writer, indent string, nodes []treeNode) {
+	for i, node := range nodes {
+		branch, next := "├── ", "│   "
+		if i == len(nodes)-1 {
+			branch, next = "└── ", "    "
+		}
+		fmt.Fprintf(out, "%s%s%s\n", indent, branch, node.label)
+		printBranches(out, indent+next, node.children)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"github.com/cenkalti/backoff/v4"
+)
+
+// destination is where a route delivers its messages. deliver makes a single attempt, marking
+// errors that won't be fixed by retrying as permanent.
+type destination interface {
+	deliver(ctx context.Context, cfg Config, route Route, opts deliveryOptions, msgs []Message, body []byte, contentType string) error
+	close()
+}
+
+// newDestination connects to wherever the route delivers to
+func newDestination(route Route) (destination, error) {
+	if route.Nats != nil {
+		return newNatsDestination(*route.Nats)
+	}
+	if route.Mqtt != nil {
+		return newMqttDestination(route)
+	}
+	if route.Amqp != nil {
+		return newAmqpDestination(*route.Amqp)
+	}
+	if route.Redis != nil {
+		return newRedisDestination(*route.Redis)
+	}
+	if route.Sqs != nil {
+		return newSqsDestination(*route.Sqs)
+	}
+	if route.Sns != nil {
+		return newSnsDestination(*route.Sns)
+	}
+	if route.Grpc != nil {
+		return newGrpcDestination(*route.Grpc)
+	}
+	if len(route.Failover) > 0 {
+		return newFailoverDestination(route.Failover), nil
+	}
+	return &webhookDestination{targets: newBalancer(route)}, nil
+}
+
+// webhookDestination posts messages to the route's webhook url or endpoints
+type webhookDestination struct {
+	targets *balancer
+}
+
+func (d *webhookDestination) deliver(ctx context.Context, cfg Config, route Route, opts deliveryOptions, msgs []Message, body []byte, contentType string) error {
+	// every attempt can go to a different endpoint, so one failing replica doesn't lose messages
+	target := d.targets.next()
+	err := sendWebhook(ctx, cfg, route, target, opts, msgs[0], body, contentType)
+	d.targets.report(target, err)
+	return err
+}
+
+func (d *webhookDestination) close() {}
+
+// isWebhook reports whether a destination posts to webhooks rather than publishing to a broker
+func isWebhook(dest destination) bool {
+	switch dest.(type) {
+	case *webhookDestination, *failoverDestination:
+		return true
+	}
+	return false
+}
+
+// failoverDestination posts to webhooks in order of preference. each message is retried on the
+// first webhook, and only moves on to the next once it has run out of retries.
+type failoverDestination struct {
+	tiers []failoverTier
+}
+
+type failoverTier struct {
+	// the redacted url, for metrics and logs
+	name string
+	dest destination
+}
+
+func newFailoverDestination(urls []string) *failoverDestination {
+	d := &failoverDestination{}
+	for _, url := range urls {
+		d.tiers = append(d.tiers, failoverTier{name: redactUrl(url), dest: &webhookDestination{targets: newBalancer(Route{WebhookUrl: url})}})
+	}
+	return d
+}
+
+// deliver sends to the primary webhook. forwardMessages uses the tiers to fail over.
+func (d *failoverDestination) deliver(ctx context.Context, cfg Config, route Route, opts deliveryOptions, msgs []Message, body []byte, contentType string) error {
+	return d.tiers[0].dest.deliver(ctx, cfg, route, opts, msgs, body, contentType)
+}
+
+func (d *failoverDestination) close() {}
+
+// failedDestination is used when a route's destination couldn't be set up, failing every delivery
+// with the reason
+type failedDestination struct {
+	err error
+}
+
+func (d *failedDestination) deliver(ctx context.Context, cfg Config, route Route, opts deliveryOptions, msgs []Message, body []byte, contentType string) error {
+	return backoff.Permanent(d.err)
+}
+
+func (d *failedDestination) close() {}
+
+// TlsConfig is the tls setup for connecting to a message broker
+type TlsConfig struct {
+	// a pem file of certificate authorities to trust instead of the system ones
+	CaFile string `json:"ca_file,omitempty"`
+	// a client certificate and key, for brokers that authenticate clients with certificates
+	CertFile           string `json:"cert_file,omitempty"`
+	KeyFile            string `json:"key_file,omitempty"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify,omitempty"`
+}
+
+func (t TlsConfig) validate() error {
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return fmt.Errorf("a tls certificate and key must be set together")
+	}
+	return nil
+}
+
+// config builds the tls config, using the system defaults when nothing is set
+func (t TlsConfig) config() (*tls.Config, error) {
+	cfg := &tls.Config{InsecureSkipVerify: t.InsecureSkipVerify}
+	if t.CaFile != "" {
+		pem, err := os.ReadFile(t.CaFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ca file: %v", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in ca file %s", t.CaFile)
+		}
+	}
+	if t.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
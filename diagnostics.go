@@ -0,0 +1,265 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// recentMessageCount is the number of messages kept for diagnostic bundles
+const recentMessageCount = 50
+
+var diagnostics = &diagnosticRecorder{}
+
+// messageMetadata is what is kept about a recent message for diagnostics. the text is left out so
+// bundles don't contain chat contents.
+type messageMetadata struct {
+	Id         string    `json:"id"`
+	Source     string    `json:"source"`
+	Gateway    string    `json:"gateway"`
+	Channel    string    `json:"channel"`
+	Protocol   string    `json:"protocol"`
+	Account    string    `json:"account"`
+	Timestamp  string    `json:"timestamp"`
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+// diagnosticBundle is written to disk for postmortem analysis
+type diagnosticBundle struct {
+	Time             time.Time         `json:"time"`
+	Reason           string            `json:"reason"`
+	ConfigVersion    uint64            `json:"config_version"`
+	ConfigHash       string            `json:"config_hash"`
+	Config           Config            `json:"config"`
+	QueueDepths      map[string]int    `json:"queue_depths"`
+	StreamConnected  map[string]bool   `json:"stream_connected"`
+	LastMessageAge   map[string]string `json:"last_message_age"`
+	RecentMessages   []messageMetadata `json:"recent_messages"`
+	GoroutineStacks  string            `json:"goroutine_stacks"`
+	GoroutineCount   int               `json:"goroutine_count"`
+	GoVersion        string            `json:"go_version"`
+	MemoryAllocBytes uint64            `json:"memory_alloc_bytes"`
+}
+
+// diagnosticRecorder keeps track of what goes into a diagnostic bundle
+type diagnosticRecorder struct {
+	mu     sync.Mutex
+	dir    string
+	store  *ConfigStore
+	recent []messageMetadata
+	next   int
+}
+
+// enable starts writing bundles to the given directory when the process receives SIGQUIT or
+// panics
+func (d *diagnosticRecorder) enable(dir string, store *ConfigStore) {
+	d.mu.Lock()
+	d.dir, d.store = dir, store
+	d.mu.Unlock()
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGQUIT)
+	go func() {
+		<-c
+		d.dump("received SIGQUIT")
+		// match go's default behaviour for SIGQUIT
+		os.Exit(2)
+	}()
+}
+
+// record keeps the metadata of a received message
+func (d *diagnosticRecorder) record(msg Message) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.dir == "" {
+		return
+	}
+
+	meta := messageMetadata{
+		Id:         msg.Id,
+		Source:     msg.Source,
+		Gateway:    msg.Gateway,
+		Channel:    msg.Channel,
+		Protocol:   msg.Protocol,
+		Account:    msg.Account,
+		Timestamp:  msg.Timestamp,
+		ReceivedAt: time.Now(),
+	}
+
+	if len(d.recent) < recentMessageCount {
+		d.recent = append(d.recent, meta)
+	} else {
+		d.recent[d.next] = meta
+	}
+	d.next = (d.next + 1) % recentMessageCount
+}
+
+// recoverPanic writes a bundle if the calling goroutine is panicking, then carries on panicking. it
+// must be deferred directly.
+func (d *diagnosticRecorder) recoverPanic() {
+	if r := recover(); r != nil {
+		d.dump(fmt.Sprintf("panic: %v", r))
+		panic(r)
+	}
+}
+
+// recoverPanicWith writes a bundle if the calling goroutine is panicking, then passes the panic to
+// onPanic, which stops whatever the goroutine is part of rather than the whole process. without
+// onPanic it carries on panicking. it must be deferred directly.
+func (d *diagnosticRecorder) recoverPanicWith(onPanic func(any)) {
+	if r := recover(); r != nil {
+		d.dump(fmt.Sprintf("panic: %v", r))
+		if onPanic == nil {
+			panic(r)
+		}
+		onPanic(r)
+	}
+}
+
+// dump writes a diagnostic bundle, if enabled
+func (d *diagnosticRecorder) dump(reason string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.dir == "" {
+		return
+	}
+
+	bundle := diagnosticBundle{
+		Time:            time.Now(),
+		Reason:          reason,
+		StreamConnected: map[string]bool{},
+		LastMessageAge:  map[string]string{},
+		GoroutineCount:  runtime.NumGoroutine(),
+		GoVersion:       runtime.Version(),
+	}
+
+	eachHealth(func(name string, h *streamHealth) {
+		bundle.StreamConnected[name] = h.isConnected()
+		bundle.LastMessageAge[name] = h.lastMessageAge().String()
+	})
+
+	if d.store != nil {
+		cfg, version := d.store.Get()
+		cfgBytes, _ := json.Marshal(cfg)
+		hash := sha256.Sum256(cfgBytes)
+		bundle.ConfigVersion = version
+		bundle.ConfigHash = hex.EncodeToString(hash[:])
+		bundle.Config = redactConfig(cfg)
+	}
+	bundle.QueueDepths = map[string]int{}
+	eachQueueDepth(func(route string, depth int) {
+		bundle.QueueDepths[route] = depth
+	})
+
+	// oldest message first
+	bundle.RecentMessages = append(append([]messageMetadata{}, d.recent[d.next:]...), d.recent[:d.next]...)
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	bundle.MemoryAllocBytes = mem.Alloc
+
+	// grow the buffer until all the stacks fit
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			bundle.GoroutineStacks = string(buf[:n])
+			break
+		}
+		buf = make([]byte, len(buf)*2)
+	}
+
+	data, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		slog.Error("failed to encode diagnostic bundle", "error", err)
+		return
+	}
+
+	path := filepath.Join(d.dir, fmt.Sprintf("diagnostics-%s.json", bundle.Time.UTC().Format("20060102T150405Z")))
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		slog.Error("failed to write diagnostic bundle", "path", path, "error", err)
+		return
+	}
+	slog.Info("wrote diagnostic bundle", "path", path, "reason", reason)
+}
+
+// redactConfig removes credentials from webhook urls
+func redactConfig(cfg Config) Config {
+	redacted := cfg
+	redacted.Routes = redactRoutes(cfg.Routes)
+	redacted.Pipelines = slices.Clone(cfg.Pipelines)
+	for i := range redacted.Pipelines {
+		redacted.Pipelines[i].Routes = redactRoutes(redacted.Pipelines[i].Routes)
+	}
+	return redacted
+}
+
+func redactRoutes(routes []Route) []Route {
+	redacted := make([]Route, len(routes))
+	for i, route := range routes {
+		if route.WebhookUrl != "" {
+			route.WebhookUrl = redactUrl(route.WebhookUrl)
+		}
+		if route.ProbeUrl != "" {
+			route.ProbeUrl = redactUrl(route.ProbeUrl)
+		}
+		if route.Nats != nil {
+			nats := *route.Nats
+			nats.Url = redactUrl(nats.Url)
+			route.Nats = &nats
+		}
+		if route.Mqtt != nil {
+			mqtt := *route.Mqtt
+			mqtt.Url = redactUrl(mqtt.Url)
+			route.Mqtt = &mqtt
+		}
+		if route.Amqp != nil {
+			amqp := *route.Amqp
+			amqp.Url = redactUrl(amqp.Url)
+			route.Amqp = &amqp
+		}
+		if route.Redis != nil {
+			redis := *route.Redis
+			redis.Url = redactUrl(redis.Url)
+			route.Redis = &redis
+		}
+		route.Failover = slices.Clone(route.Failover)
+		for j := range route.Failover {
+			route.Failover[j] = redactUrl(route.Failover[j])
+		}
+		route.Endpoints = slices.Clone(route.Endpoints)
+		for j := range route.Endpoints {
+			route.Endpoints[j].Url = redactUrl(route.Endpoints[j].Url)
+		}
+		redacted[i] = route
+	}
+	return redacted
+}
+
+// redactUrl removes the user info and query, which often hold tokens
+func redactUrl(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return "redacted"
+	}
+	if u.User != nil {
+		u.User = url.User("redacted")
+	}
+	if u.RawQuery != "" {
+		u.RawQuery = "redacted"
+	}
+	return u.String()
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// eventDigest is the event of the synthetic messages summarising a route's messages
+const eventDigest = "digest"
+
+// defaultDigestMaxLines is the number of messages from each channel included in the digest text
+const defaultDigestMaxLines = 100
+
+// DigestConfig makes a route collect its messages and deliver a summary of them at an interval,
+// instead of delivering each message
+type DigestConfig struct {
+	// how often the summary is delivered, such as 1h
+	Interval string `json:"interval"`
+	// the number of messages from each channel included in the text, defaulting to 100. every
+	// message is counted.
+	MaxLines int `json:"max_lines,omitempty"`
+}
+
+func (d DigestConfig) interval() (time.Duration, error) {
+	interval, err := time.ParseDuration(d.Interval)
+	if err != nil {
+		return 0, fmt.Errorf("invalid digest interval: %v", err)
+	}
+	if interval <= 0 {
+		return 0, fmt.Errorf("the digest interval must be positive")
+	}
+	return interval, nil
+}
+
+func (d DigestConfig) validate() error {
+	if _, err := d.interval(); err != nil {
+		return err
+	}
+	if d.MaxLines < 0 {
+		return fmt.Errorf("the digest max lines must not be negative")
+	}
+	return nil
+}
+
+// digestCollector summarises the messages collected since the last digest
+type digestCollector struct {
+	maxLines int
+	start    time.Time
+	count    int
+	channels []*digestChannel
+	index    map[string]*digestChannel
+}
+
+type digestChannel struct {
+	summary DigestChannel
+	lines   []string
+}
+
+func newDigestCollector(cfg DigestConfig, start time.Time) *digestCollector {
+	maxLines := cfg.MaxLines
+	if maxLines == 0 {
+		maxLines = defaultDigestMaxLines
+	}
+	return &digestCollector{maxLines: maxLines, start: start, index: map[string]*digestChannel{}}
+}
+
+// add counts a message towards the digest
+func (c *digestCollector) add(msg Message) {
+	key := msg.Source + "/" + msg.Gateway + "/" + msg.Channel
+	channel, ok := c.index[key]
+	if !ok {
+		channel = &digestChannel{summary: DigestChannel{
+			Source:         msg.Source,
+			Gateway:        msg.Gateway,
+			Channel:        msg.Channel,
+			FirstTimestamp: msg.Timestamp,
+		}}
+		c.index[key] = channel
+		c.channels = append(c.channels, channel)
+	}
+
+	c.count++
+	channel.summary.Count++
+	channel.summary.LastTimestamp = msg.Timestamp
+	if len(channel.lines) < c.maxLines {
+		channel.lines = append(channel.lines, fmt.Sprintf("%s: %s", msg.Username, msg.Text))
+	}
+}
+
+// flush returns a message with the digest of everything collected, starting a new digest. there is
+// nothing to deliver if no messages were collected.
+func (c *digestCollector) flush(now time.Time) (Message, bool) {
+	if c.count == 0 {
+		c.start = now
+		return Message{}, false
+	}
+
+	digest := &Digest{
+		Start:    c.start.UTC().Format(time.RFC3339),
+		End:      now.UTC().Format(time.RFC3339),
+		Count:    c.count,
+		Channels: []DigestChannel{},
+	}
+	text := []string{}
+	for _, channel := range c.channels {
+		summary := channel.summary
+		summary.Text = strings.Join(channel.lines, "\n")
+		if extra := summary.Count - len(channel.lines); extra > 0 {
+			summary.Text += fmt.Sprintf("\n(%d more)", extra)
+		}
+		digest.Channels = append(digest.Channels, summary)
+		if summary.Count == 1 {
+			text = append(text, fmt.Sprintf("%s: 1 message", summary.Channel))
+		} else {
+			text = append(text, fmt.Sprintf("%s: %d messages", summary.Channel, summary.Count))
+		}
+	}
+
+	c.start, c.count, c.channels, c.index = now, 0, nil, map[string]*digestChannel{}
+	return Message{
+		Text:      strings.Join(text, "\n"),
+		Event:     eventDigest,
+		Timestamp: digest.End,
+		Digest:    digest,
+	}, true
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"container/list"
+	"strings"
+)
+
+// ways edited messages can be delivered to a route
+const (
+	editModeFull        = "full"
+	editModeBeforeAfter = "before_after"
+	editModeUnified     = "unified"
+)
+
+// editTrackerSize is the number of recent messages remembered for detecting edits
+const editTrackerSize = 1000
+
+// maxDiffCells limits the work done to diff an edit
+const maxDiffCells = 1_000_000
+
+// editTracker remembers the text of recent messages by id, so when matterbridge sends a message
+// with an id it has already seen, the edit can be compared to the original
+type editTracker struct {
+	size  int
+	order *list.List
+	texts map[string]*list.Element
+}
+
+type trackedText struct {
+	id   string
+	text string
+}
+
+func newEditTracker(size int) *editTracker {
+	return &editTracker{
+		size:  size,
+		order: list.New(),
+		texts: map[string]*list.Element{},
+	}
+}
+
+// observe records a message, returning the previous text if it is an edit of a recent message
+func (t *editTracker) observe(msg Message) (string, bool) {
+	if msg.Id == "" {
+		return "", false
+	}
+
+	// ids are only unique within a matterbridge instance
+	id := msg.Source + "/" + msg.Id
+	if el, ok := t.texts[id]; ok {
+		tracked := el.Value.(*trackedText)
+		previous := tracked.text
+		tracked.text = msg.Text
+		t.order.MoveToFront(el)
+		return previous, true
+	}
+
+	t.texts[id] = t.order.PushFront(&trackedText{id: id, text: msg.Text})
+	if t.order.Len() > t.size {
+		oldest := t.order.Back()
+		t.order.Remove(oldest)
+		delete(t.texts, oldest.Value.(*trackedText).id)
+	}
+	return "", false
+}
+
+// applyEditMode rewrites an edited message for the route's edit mode. in the diff modes the full
+// text is left out and only the change is sent.
+func applyEditMode(msg Message, previousText string, mode string) Message {
+	switch mode {
+	case editModeBeforeAfter:
+		msg.Edit = &MessageEdit{Before: previousText, After: msg.Text}
+		msg.Text = ""
+	case editModeUnified:
+		msg.Edit = &MessageEdit{Diff: unifiedDiff(previousText, msg.Text)}
+		msg.Text = ""
+	}
+	return msg
+}
+
+// unifiedDiff gives a line by line diff of two texts, with removed lines prefixed by "-", added
+// lines by "+" and unchanged lines by " "
+func unifiedDiff(before string, after string) string {
+	a, b := strings.Split(before, "\n"), strings.Split(after, "\n")
+
+	// the comparison table grows with the product of the line counts, so very long messages are
+	// shown as entirely replaced instead
+	if len(a)*len(b) > maxDiffCells {
+		lines := make([]string, 0, len(a)+len(b))
+		for _, line := range a {
+			lines = append(lines, "-"+line)
+		}
+		for _, line := range b {
+			lines = append(lines, "+"+line)
+		}
+		return strings.Join(lines, "\n")
+	}
+
+	// longest common subsequence lengths of every pair of suffixes
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	lines := []string{}
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			lines = append(lines, " "+a[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			lines = append(lines, "-"+a[i])
+			i++
+		default:
+			lines = append(lines, "+"+b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		lines = append(lines, "-"+a[i])
+	}
+	for ; j < len(b); j++ {
+		lines = append(lines, "+"+b[j])
+	}
+
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+)
+
+// an endpoint is taken out of rotation for a while after failing a few times in a row
+const (
+	endpointFailureThreshold = 3
+	endpointCooldown         = 30 * time.Second
+)
+
+// Endpoint is one of several equivalent webhook urls for a route, such as replicas behind a load
+// balancer
+type Endpoint struct {
+	Url string `json:"url"`
+	// the share of messages sent to this endpoint compared to the others, defaulting to 1
+	Weight int `json:"weight,omitempty"`
+}
+
+// balancer picks the endpoint for each request with smooth weighted round robin, skipping
+// endpoints that keep failing
+type balancer struct {
+	mu        sync.Mutex
+	endpoints []*endpointState
+}
+
+type endpointState struct {
+	url       string
+	weight    int
+	current   int
+	failures  int
+	downUntil time.Time
+}
+
+// newBalancer creates a balancer for the route's endpoints, or its webhook url if it has none
+func newBalancer(route Route) *balancer {
+	b := &balancer{}
+	if len(route.Endpoints) == 0 {
+		b.endpoints = []*endpointState{{url: route.WebhookUrl, weight: 1}}
+		return b
+	}
+
+	for _, endpoint := range route.Endpoints {
+		weight := endpoint.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		b.endpoints = append(b.endpoints, &endpointState{url: endpoint.Url, weight: weight})
+	}
+	return b
+}
+
+// next returns the url to send the next request to. if every endpoint is out of rotation, they
+// are all tried again rather than giving up.
+func (b *balancer) next() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.endpoints) == 1 {
+		return b.endpoints[0].url
+	}
+
+	now := time.Now()
+	healthy := []*endpointState{}
+	for _, e := range b.endpoints {
+		if !now.Before(e.downUntil) {
+			healthy = append(healthy, e)
+		}
+	}
+	if len(healthy) == 0 {
+		healthy = b.endpoints
+	}
+
+	// every endpoint gains its weight, and the one with the most is picked and pays back the total
+	total := 0
+	var picked *endpointState
+	for _, e := range healthy {
+		e.current += e.weight
+		total += e.weight
+		if picked == nil || e.current > picked.current {
+			picked = e
+		}
+	}
+	picked.current -= total
+	return picked.url
+}
+
+// report records the result of a request to an endpoint. permanent errors mean the endpoint
+// answered, so they don't count against it.
+func (b *balancer) report(url string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var permanent *backoff.PermanentError
+	if errors.As(err, &permanent) {
+		err = nil
+	}
+
+	for _, e := range b.endpoints {
+		if e.url != url {
+			continue
+		}
+		if err == nil {
+			e.failures = 0
+			return
+		}
+		e.failures++
+		if e.failures >= endpointFailureThreshold && len(b.endpoints) > 1 {
+			e.failures = 0
+			e.downUntil = time.Now().Add(endpointCooldown)
+			slog.Warn("taking failing endpoint out of rotation", "endpoint", redactUrl(url), "for", endpointCooldown.String())
+		}
+		return
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/jake-walker/matterbridge-to-webhook/pkg/bridge"
+)
+
+// errHookDropped is returned when the exec hook exits with a non-zero status to drop the message
+var errHookDropped = errors.New("dropped by exec hook")
+
+// execHook builds webhook payloads by piping messages through an external command. the message
+// is written to its stdin as json, and its stdout is sent as the payload.
+type execHook struct {
+	command []string
+	timeout time.Duration
+	slots   chan struct{}
+}
+
+// loadExecHook reads the exec hook from the environment, if one is configured
+func loadExecHook() (*execHook, error) {
+	command := strings.Fields(os.Getenv("EXEC_HOOK_COMMAND"))
+	if len(command) == 0 {
+		return nil, nil
+	}
+	timeout, err := durationEnv("EXEC_HOOK_TIMEOUT", 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	concurrency, err := intEnv("EXEC_HOOK_CONCURRENCY", 4)
+	if err != nil {
+		return nil, err
+	}
+	if concurrency <= 0 {
+		return nil, fmt.Errorf("EXEC_HOOK_CONCURRENCY must be positive")
+	}
+
+	return &execHook{
+		command: command,
+		timeout: timeout,
+		slots:   make(chan struct{}, concurrency),
+	}, nil
+}
+
+// run pipes the message through the command for a route, returning the payload to send
+func (h *execHook) run(ctx context.Context, route Route, input []byte) ([]byte, error) {
+	// only a limited number of commands run at once, however many routes and workers there are
+	select {
+	case h.slots <- struct{}{}:
+		defer func() { <-h.slots }()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, h.command[0], h.command[1:]...)
+	cmd.Env = append(os.Environ(), "ROUTE="+route.Name)
+	cmd.Stdin = bytes.NewReader(input)
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("exec hook took longer than %s", h.timeout)
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return nil, fmt.Errorf("%w (exit status %d): %s", errHookDropped, exitErr.ExitCode(), bridge.Truncate(bytes.TrimSpace(stderr.Bytes())))
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to run exec hook: %v", err)
+	}
+	return stdout.Bytes(), nil
+}
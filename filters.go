@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// listFilter drops messages from channels and gateways that aren't allowed, before they are
+// transformed or offered to any route. denied names win over allowed ones.
+type listFilter struct {
+	allowChannels []string
+	denyChannels  []string
+	allowGateways []string
+	denyGateways  []string
+}
+
+// loadListFilter reads the channel and gateway lists from the environment
+func loadListFilter() listFilter {
+	return listFilter{
+		allowChannels: splitList(os.Getenv("CHANNELS_ALLOW")),
+		denyChannels:  splitList(os.Getenv("CHANNELS_DENY")),
+		allowGateways: splitList(os.Getenv("GATEWAYS_ALLOW")),
+		denyGateways:  splitList(os.Getenv("GATEWAYS_DENY")),
+	}
+}
+
+// enabled reports whether any of the lists are set
+func (f listFilter) enabled() bool {
+	return len(f.allowChannels) > 0 || len(f.denyChannels) > 0 || len(f.allowGateways) > 0 || len(f.denyGateways) > 0
+}
+
+func (f listFilter) Allow(ctx context.Context, msg Message) bool {
+	stageStart := time.Now()
+	reason := f.reject(msg)
+	recordStage(ctx, stageFilter, stageStart)
+	if reason == "" {
+		return true
+	}
+
+	metrics.messageDropped.Add(ctx, 1, messageAttributes(msg, dropReasonAttribute(dropReasonFilter)))
+	slog.Debug("skipping message from "+reason, "message", msg)
+	return false
+}
+
+// reject returns why a message isn't allowed, or nothing if it is
+func (f listFilter) reject(msg Message) string {
+	if slices.Contains(f.denyGateways, msg.Gateway) {
+		return "denied gateway"
+	}
+	if len(f.allowGateways) > 0 && !slices.Contains(f.allowGateways, msg.Gateway) {
+		return "gateway that isn't allowed"
+	}
+	if slices.Contains(f.denyChannels, msg.Channel) {
+		return "denied channel"
+	}
+	if len(f.allowChannels) > 0 && !slices.Contains(f.allowChannels, msg.Channel) {
+		return "channel that isn't allowed"
+	}
+	return ""
+}
+
+// staleFilter drops messages sent longer ago than the max age, like the backlog matterbridge sends
+// after an outage, so old commands aren't acted on. messages without a timestamp can't be shown
+// to be recent, so are dropped too.
+type staleFilter struct {
+	maxAge time.Duration
+}
+
+func (f staleFilter) Allow(ctx context.Context, msg Message) bool {
+	now := time.Now()
+	timestamp, ok := messageTime(msg, now)
+	if ok && !olderThan(timestamp, now, f.maxAge) {
+		return true
+	}
+
+	metrics.messageDropped.Add(ctx, 1, messageAttributes(msg, dropReasonAttribute(dropReasonStale)))
+	slog.Debug("skipping message older than the max age", "message", msg, "max_age", f.maxAge)
+	return false
+}
+
+// describe lists the filters for the routing table
+func (f listFilter) describe() []string {
+	described := []string{}
+	if len(f.allowGateways) > 0 {
+		described = append(described, fmt.Sprintf("only gateways %s", strings.Join(f.allowGateways, ", ")))
+	}
+	if len(f.denyGateways) > 0 {
+		described = append(described, fmt.Sprintf("not gateways %s", strings.Join(f.denyGateways, ", ")))
+	}
+	if len(f.allowChannels) > 0 {
+		described = append(described, fmt.Sprintf("only channels %s", strings.Join(f.allowChannels, ", ")))
+	}
+	if len(f.denyChannels) > 0 {
+		described = append(described, fmt.Sprintf("not channels %s", strings.Join(f.denyChannels, ", ")))
+	}
+	return described
+}
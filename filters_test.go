@@ -0,0 +1,64 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func FuzzMessageMatching(f *testing.F) {
+	f.Add("!deploy api v1.2", "general", "gw1", "!deploy")
+	f.Add("  !DEPLOY  ", "random", "gw2", "!deploy")
+	f.Add("!deployment", "general", "gw1", "!deploy")
+	f.Add("", "", "", "")
+	f.Add(" !deploy\targs", "général", "gw1", "!Deploy")
+
+	f.Fuzz(func(t *testing.T, text string, channel string, gateway string, command string) {
+		msg := Message{Text: text, Channel: channel, Gateway: gateway}
+
+		filter := listFilter{allowChannels: []string{channel}, denyGateways: []string{"denied"}}
+		if reason := filter.reject(msg); (gateway == "denied") != (reason != "") {
+			t.Fatalf("unexpected reason %q for gateway %q", reason, gateway)
+		}
+		if reason := (listFilter{denyChannels: []string{channel}}).reject(msg); reason == "" {
+			t.Fatalf("denied channel %q was allowed", channel)
+		}
+		if reason := (listFilter{}).reject(msg); reason != "" {
+			t.Fatalf("message was rejected without any lists: %s", reason)
+		}
+
+		route := Route{Name: "test", Commands: []string{command}}
+		matched, ok := route.matchCommand(msg)
+		if !ok {
+			return
+		}
+		if matched == nil || !slices.Contains(route.Commands, matched.Name) {
+			t.Fatalf("matched a command the route doesn't have: %+v", matched)
+		}
+		if matched.Args != strings.TrimSpace(matched.Args) {
+			t.Fatalf("arguments %q weren't trimmed", matched.Args)
+		}
+		if utf8.ValidString(text) && !strings.Contains(text, matched.Args) {
+			t.Fatalf("arguments %q aren't from the text %q", matched.Args, text)
+		}
+	})
+}
+
+func TestMatchCommand(t *testing.T) {
+	route := Route{Commands: []string{"!deploy"}}
+	for text, args := range map[string]string{
+		"!deploy api v1.2":    "api v1.2",
+		"  !DEPLOY":           "",
+		"!deploy\nprod":       "prod",
+		"!deploy\tapi\nv1.2 ": "api\nv1.2",
+	} {
+		matched, ok := route.matchCommand(Message{Text: text})
+		if !ok || matched.Name != "!deploy" || matched.Args != args {
+			t.Errorf("expected %q to invoke !deploy with %q, got %+v", text, args, matched)
+		}
+	}
+	if _, ok := route.matchCommand(Message{Text: "!deployment prod"}); ok {
+		t.Error("expected a longer word not to match")
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// the pipeline stages that can be gated. they are all on unless a flag says otherwise.
+const (
+	// passing the trace context on to webhooks in request headers
+	flagPropagateTraceContext = "propagate_trace_context"
+	// adding the details of accounts from the config to messages
+	flagEnrichment = "enrichment"
+	// running messages through the wasm module and starlark script
+	flagWasmTransform   = "wasm_transform"
+	flagScriptTransform = "script_transform"
+	// the route's normalize steps
+	flagNormalize = "normalize"
+	// reshaping payloads with the route's payload_jq
+	flagPayloadJq = "payload_jq"
+	// formatting messages for chat services with the route's format
+	flagFormatter = "formatter"
+)
+
+// FeatureFlag gates a pipeline stage, so it can be rolled out gradually. a flag can be limited to
+// some routes, and to a percentage of the messages on those routes.
+type FeatureFlag struct {
+	Enabled    bool     `json:"enabled"`
+	Percentage *int     `json:"percentage,omitempty"`
+	Routes     []string `json:"routes,omitempty"`
+}
+
+// parseFeatureFlags parses flags given as a comma separated list of names, each optionally
+// followed by the percentage of messages it applies to (e.g. "new_formatter,enrichment=10")
+func parseFeatureFlags(v string) (map[string]FeatureFlag, error) {
+	flags := map[string]FeatureFlag{}
+
+	for _, item := range splitList(v) {
+		name, value, hasValue := strings.Cut(item, "=")
+		flag := FeatureFlag{Enabled: true}
+
+		if hasValue {
+			switch value {
+			case "true", "on":
+			case "false", "off":
+				flag.Enabled = false
+			default:
+				percentage, err := strconv.Atoi(strings.TrimSuffix(value, "%"))
+				if err != nil || percentage < 0 || percentage > 100 {
+					return nil, fmt.Errorf("invalid value for feature flag %s: %s", name, value)
+				}
+				flag.Percentage = &percentage
+			}
+		}
+
+		flags[name] = flag
+	}
+
+	return flags, nil
+}
+
+// featureEnabled checks whether a flag applies to a message on a route. flags that aren't defined
+// in the config or the defaults take the fallback value. stages that run before messages are
+// routed are checked without a route, so flags limited to some routes don't change them.
+func featureEnabled(cfg Config, name string, route Route, msg Message, fallback bool) bool {
+	flag, ok := cfg.Features[name]
+	if !ok {
+		if flag, ok = defaultFeatureFlags[name]; !ok {
+			return fallback
+		}
+	}
+
+	if !flag.Enabled {
+		return false
+	}
+	if len(flag.Routes) > 0 && route.Name != "" && !slices.Contains(flag.Routes, route.Name) {
+		return false
+	}
+	if flag.Percentage == nil {
+		return true
+	}
+
+	// bucket messages consistently, so the same message always gets the same decision
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	h.Write([]byte(msg.Id + msg.Timestamp + msg.Text))
+	return int(h.Sum32()%100) < *flag.Percentage
+}
+
+// gatedRoute returns the route without the stages whose flags are off for the message. a batch is
+// delivered with the stages of its first message.
+func gatedRoute(cfg Config, route Route, msg Message) Route {
+	if len(route.Normalize) > 0 && !featureEnabled(cfg, flagNormalize, route, msg, true) {
+		route.Normalize = nil
+	}
+	if route.PayloadJq != "" && !featureEnabled(cfg, flagPayloadJq, route, msg, true) {
+		route.PayloadJq = ""
+	}
+	if route.Format != nil && !featureEnabled(cfg, flagFormatter, route, msg, true) {
+		route.Format = nil
+	}
+	return route
+}
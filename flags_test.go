@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestGatedRoute(t *testing.T) {
+	route := Route{Name: "chat", Normalize: []string{"mentions"}, PayloadJq: ".text", Format: &FormatConfig{Type: "slack"}}
+	msg := Message{Id: "1", Text: "hello"}
+
+	gated := gatedRoute(Config{}, route, msg)
+	if len(gated.Normalize) != 1 || gated.PayloadJq == "" || gated.Format == nil {
+		t.Errorf("expected every stage to be on without flags, got %+v", gated)
+	}
+
+	cfg := Config{Features: map[string]FeatureFlag{
+		flagNormalize: {Enabled: false},
+		flagFormatter: {Enabled: true, Routes: []string{"other"}},
+	}}
+	gated = gatedRoute(cfg, route, msg)
+	if gated.Normalize != nil || gated.Format != nil || gated.PayloadJq != ".text" {
+		t.Errorf("expected only the stages flagged off for the route to be removed, got %+v", gated)
+	}
+	if route.Format == nil {
+		t.Error("expected the route itself to be left alone")
+	}
+}
+
+func TestFeatureEnabledWithoutRoute(t *testing.T) {
+	cfg := Config{Features: map[string]FeatureFlag{flagEnrichment: {Enabled: true, Routes: []string{"deploy"}}}}
+	if !featureEnabled(cfg, flagEnrichment, Route{}, Message{}, false) {
+		t.Error("expected the routes of a flag to be ignored before messages are routed")
+	}
+	if featureEnabled(cfg, flagEnrichment, Route{Name: "chat"}, Message{}, false) {
+		t.Error("expected a flag limited to other routes to be off")
+	}
+}
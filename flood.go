@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// eventFloodSuppressed is the event of the notices standing in for messages dropped by flood
+// protection
+const eventFloodSuppressed = "flood_suppressed"
+
+// what messages are limited together by flood protection
+const (
+	floodPerChannel = "channel"
+	floodPerUser    = "user"
+)
+
+// what happens to messages over the flood protection limit
+const (
+	// the messages are dropped
+	floodModeDrop = "drop"
+	// the messages are dropped, and the next message allowed through is preceded by a notice saying
+	// how many were
+	floodModeCollapse = "collapse"
+)
+
+// floodTrackerSize is how many channels or users are tracked before idle ones are forgotten
+const floodTrackerSize = 10000
+
+// FloodProtection limits how fast each channel, or user, can send messages, so one flooding a
+// channel can't use up the delivery budget of every route
+type FloodProtection struct {
+	Enabled bool `json:"enabled"`
+	// the messages per second allowed from each channel or user
+	Rate float64 `json:"rate"`
+	// how many messages can arrive at once before the rate applies, defaulting to the rate rounded up
+	Burst int `json:"burst,omitempty"`
+	// whether the limit is for each channel or each user, defaulting to channel
+	Per string `json:"per,omitempty"`
+	// whether messages over the limit are dropped or collapsed into a notice, defaulting to drop
+	Mode string `json:"mode,omitempty"`
+}
+
+func (f FloodProtection) validate() error {
+	if !f.Enabled {
+		return nil
+	}
+	if f.Rate <= 0 {
+		return fmt.Errorf("flood protection must have a positive rate")
+	}
+	if f.Burst < 0 {
+		return fmt.Errorf("flood protection must not have a negative burst")
+	}
+	switch f.Per {
+	case "", floodPerChannel, floodPerUser:
+	default:
+		return fmt.Errorf("unknown flood protection limit: %s, must be %s or %s", f.Per, floodPerChannel, floodPerUser)
+	}
+	switch f.Mode {
+	case "", floodModeDrop, floodModeCollapse:
+	default:
+		return fmt.Errorf("unknown flood protection mode: %s, must be %s or %s", f.Mode, floodModeDrop, floodModeCollapse)
+	}
+	return nil
+}
+
+func (f FloodProtection) burst() int {
+	if f.Burst > 0 {
+		return f.Burst
+	}
+	return int(math.Max(1, math.Ceil(f.Rate)))
+}
+
+// key is what a message is limited by
+func (f FloodProtection) key(msg Message) string {
+	key := msg.Source + "/" + msg.Gateway + "/" + msg.Channel
+	if f.Per == floodPerUser {
+		user := msg.Userid
+		if user == "" {
+			user = msg.Username
+		}
+		key += "/" + msg.Account + "/" + user
+	}
+	return key
+}
+
+// floodTracker keeps a rate limit for each channel or user, along with how many of their messages
+// have been dropped since the last notice
+type floodTracker struct {
+	limits map[string]*floodLimit
+	// the config the limits were made for, so they are started again when it changes
+	cfg FloodProtection
+}
+
+type floodLimit struct {
+	limiter    *rate.Limiter
+	suppressed int
+}
+
+func newFloodTracker() *floodTracker {
+	return &floodTracker{limits: map[string]*floodLimit{}}
+}
+
+// check reports whether a message is within the flood protection limit. when it is, and messages
+// before it were collapsed, a notice saying how many is returned to be delivered before it.
+// messages are limited by when they were sent, so history that is replayed in a burst is counted
+// the same as it was live.
+func (t *floodTracker) check(cfg FloodProtection, msg Message, now time.Time) (bool, Message, bool) {
+	if !cfg.Enabled || msg.Event != "" {
+		return true, Message{}, false
+	}
+	if t.cfg != cfg {
+		t.cfg = cfg
+		clear(t.limits)
+	}
+	if sent, ok := messageTime(msg, now); ok {
+		now = sent
+	}
+
+	key := cfg.key(msg)
+	limit, ok := t.limits[key]
+	if !ok {
+		if len(t.limits) >= floodTrackerSize {
+			t.forgetIdle(now)
+		}
+		limit = &floodLimit{limiter: rate.NewLimiter(rate.Limit(cfg.Rate), cfg.burst())}
+		t.limits[key] = limit
+	}
+
+	if !limit.limiter.AllowN(now, 1) {
+		limit.suppressed++
+		return false, Message{}, false
+	}
+	if limit.suppressed == 0 || cfg.Mode != floodModeCollapse {
+		limit.suppressed = 0
+		return true, Message{}, false
+	}
+
+	notice := Message{
+		Text:      fmt.Sprintf("%d messages suppressed", limit.suppressed),
+		Channel:   msg.Channel,
+		Gateway:   msg.Gateway,
+		Protocol:  msg.Protocol,
+		Account:   msg.Account,
+		Event:     eventFloodSuppressed,
+		Timestamp: now.UTC().Format(time.RFC3339),
+		Source:    msg.Source,
+	}
+	if cfg.Per == floodPerUser {
+		notice.Text = fmt.Sprintf("%d messages from %s suppressed", limit.suppressed, msg.Username)
+		notice.Username = msg.Username
+		notice.Userid = msg.Userid
+	}
+	limit.suppressed = 0
+	return true, notice, true
+}
+
+// forgetIdle forgets the channels and users that are back within their limit, with nothing
+// waiting to be collapsed
+func (t *floodTracker) forgetIdle(now time.Time) {
+	for key, limit := range t.limits {
+		if limit.suppressed == 0 && limit.limiter.TokensAt(now) >= float64(limit.limiter.Burst()) {
+			delete(t.limits, key)
+		}
+	}
+}
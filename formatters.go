@@ -0,0 +1,338 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"text/template/parse"
+)
+
+// the chat services messages can be formatted for
+const (
+	formatZulip      = "zulip"
+	formatRocketChat = "rocketchat"
+	formatMattermost = "mattermost"
+)
+
+// FormatConfig posts messages to a chat service's incoming webhook in its own format, instead of
+// the usual payload
+type FormatConfig struct {
+	// the chat service, one of zulip, rocketchat or mattermost
+	Type string `json:"type"`
+	// the channel, or zulip stream, messages are posted to. for rocket.chat and mattermost, this
+	// defaults to the channel the webhook was set up with.
+	Channel string `json:"channel,omitempty"`
+	// a go template for the zulip topic, defaulting to the channel of the message
+	Topic string `json:"topic,omitempty"`
+	// a go template for the name messages are posted as, defaulting to the username
+	DisplayName string `json:"display_name,omitempty"`
+}
+
+// formatter builds the request body for a chat service's incoming webhook
+type formatter interface {
+	format(msg Message, cfg FormatConfig) ([]byte, string, error)
+	validate(cfg FormatConfig) error
+}
+
+// formatters are the chat services messages can be formatted for, by type
+var formatters = map[string]formatter{
+	formatZulip:      zulipFormatter{},
+	formatRocketChat: rocketChatFormatter{},
+	formatMattermost: mattermostFormatter{},
+}
+
+func (f FormatConfig) validate() error {
+	formatter, ok := formatters[f.Type]
+	if !ok {
+		types := []string{}
+		for name := range formatters {
+			types = append(types, name)
+		}
+		slices.Sort(types)
+		return fmt.Errorf("unknown format type %s, must be one of %s", f.Type, strings.Join(types, ", "))
+	}
+	for _, text := range []string{f.Topic, f.DisplayName} {
+		if _, err := formatTemplate(text); err != nil {
+			return err
+		}
+	}
+	return formatter.validate(f)
+}
+
+// formatMessage builds the body of the request posting a message to the chat service
+func formatMessage(msg Message, cfg FormatConfig) ([]byte, string, error) {
+	formatter, ok := formatters[cfg.Type]
+	if !ok {
+		return nil, "", fmt.Errorf("unknown format type %s", cfg.Type)
+	}
+	return formatter.format(msg, cfg)
+}
+
+// formatTemplates are the parsed templates of formats, so each is only parsed once
+var (
+	formatTemplatesMu sync.Mutex
+	formatTemplates   = map[string]*template.Template{}
+)
+
+func formatTemplate(text string) (*template.Template, error) {
+	formatTemplatesMu.Lock()
+	defer formatTemplatesMu.Unlock()
+
+	if tmpl, ok := formatTemplates[text]; ok {
+		return tmpl, nil
+	}
+	tmpl, err := template.New("format").Option("missingkey=error").Parse(text)
+	if err == nil {
+		err = checkTemplateLoops(tmpl)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid format template: %v", err)
+	}
+	formatTemplates[text] = tmpl
+	return tmpl, nil
+}
+
+// maxTemplateOutput is the most a template can render, so one like {{range 1000000000}} can't use
+// up all the memory
+const maxTemplateOutput = 4 << 20
+
+// maxTemplateIterations is the most times the body of a template's ranges over numbers can run, as
+// a loop that doesn't write anything isn't stopped by the output limit
+const maxTemplateIterations = 10000
+
+// checkTemplateLoops refuses templates that range over numbers, like {{range 1000000000}}, more
+// times than the limit, counting ranges inside each other, and in the templates they call,
+// together. numbers given directly or through a variable are counted.
+func checkTemplateLoops(tmpl *template.Template) error {
+	for _, t := range tmpl.Templates() {
+		if t.Tree == nil {
+			continue
+		}
+		c := &loopChecker{tmpl: tmpl, numbers: map[string]uint64{}, calling: map[string]bool{t.Name(): true}}
+		if err := c.check(t.Tree.Root, 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loopChecker counts how many times each part of a template can run
+type loopChecker struct {
+	tmpl *template.Template
+	// the variables set to numbers
+	numbers map[string]uint64
+	// the templates being checked, as a template that calls itself fails at the maximum depth
+	calling map[string]bool
+}
+
+func (c *loopChecker) check(node parse.Node, iterations uint64) error {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return nil
+		}
+		for _, child := range n.Nodes {
+			if err := c.check(child, iterations); err != nil {
+				return err
+			}
+		}
+	case *parse.ActionNode:
+		c.remember(n.Pipe)
+	case *parse.IfNode:
+		return c.checkBranches(n.List, n.ElseList, iterations)
+	case *parse.WithNode:
+		return c.checkBranches(n.List, n.ElseList, iterations)
+	case *parse.RangeNode:
+		if count, ok := c.number(n.Pipe); ok && count > 1 {
+			if count > maxTemplateIterations/iterations {
+				return fmt.Errorf("ranges over numbers can run at most %d times", maxTemplateIterations)
+			}
+			iterations *= count
+		}
+		return c.checkBranches(n.List, n.ElseList, iterations)
+	case *parse.TemplateNode:
+		called := c.tmpl.Lookup(n.Name)
+		if called == nil || called.Tree == nil || c.calling[n.Name] {
+			return nil
+		}
+		c.calling[n.Name] = true
+		defer delete(c.calling, n.Name)
+		return c.check(called.Tree.Root, iterations)
+	}
+	return nil
+}
+
+func (c *loopChecker) checkBranches(list *parse.ListNode, elseList *parse.ListNode, iterations uint64) error {
+	if err := c.check(list, iterations); err != nil {
+		return err
+	}
+	return c.check(elseList, iterations)
+}
+
+// remember keeps track of the variables set to numbers, like {{$n := 100}}
+func (c *loopChecker) remember(pipe *parse.PipeNode) {
+	if pipe == nil || len(pipe.Decl) != 1 {
+		return
+	}
+	name := pipe.Decl[0].Ident[0]
+	if count, ok := c.number(pipe); ok {
+		c.numbers[name] = count
+	} else {
+		delete(c.numbers, name)
+	}
+}
+
+// number returns the number a pipeline evaluates to, if it is a number from the template.
+// negative numbers don't run a range at all, so they count as none.
+func (c *loopChecker) number(pipe *parse.PipeNode) (uint64, bool) {
+	if pipe == nil || len(pipe.Cmds) != 1 || len(pipe.Cmds[0].Args) != 1 {
+		return 0, false
+	}
+	switch arg := pipe.Cmds[0].Args[0].(type) {
+	case *parse.NumberNode:
+		if arg.IsUint {
+			return arg.Uint64, true
+		} else if arg.IsInt {
+			return 0, true
+		}
+	case *parse.VariableNode:
+		if len(arg.Ident) == 1 {
+			count, ok := c.numbers[arg.Ident[0]]
+			return count, ok
+		}
+	case *parse.PipeNode:
+		return c.number(arg)
+	}
+	return 0, false
+}
+
+// executeTemplate renders a template, failing once its output is too long
+func executeTemplate(tmpl *template.Template, data any) (string, error) {
+	w := &limitedBuilder{max: maxTemplateOutput}
+	err := tmpl.Execute(w, data)
+	return w.String(), err
+}
+
+// limitedBuilder is a strings.Builder that refuses to grow past a maximum length
+type limitedBuilder struct {
+	strings.Builder
+	max int
+}
+
+func (b *limitedBuilder) Write(p []byte) (int, error) {
+	if b.Len()+len(p) > b.max {
+		return 0, fmt.Errorf("output is longer than %d bytes", b.max)
+	}
+	return b.Builder.Write(p)
+}
+
+// renderFormat fills in a format template for a message, or returns the fallback if there isn't one
+func renderFormat(text string, msg Message, fallback string) (string, error) {
+	if text == "" {
+		return fallback, nil
+	}
+	tmpl, err := formatTemplate(text)
+	if err != nil {
+		return "", err
+	}
+	text, err = executeTemplate(tmpl, msg)
+	if err != nil {
+		return "", fmt.Errorf("failed to render format template: %v", err)
+	}
+	return text, nil
+}
+
+// formattedText is the text of a message with links to its attachments, which chat services show
+// as previews
+func formattedText(msg Message) string {
+	lines := []string{}
+	if msg.Text != "" {
+		lines = append(lines, msg.Text)
+	}
+	for _, attachment := range msg.Attachments {
+		if attachment.Url != "" {
+			lines = append(lines, attachment.Url)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// zulipFormatter posts to a stream with the zulip messages api, authenticated with the bot's email
+// and api key in the webhook url. bots can't post as someone else, so the name is in the text.
+type zulipFormatter struct{}
+
+func (zulipFormatter) validate(cfg FormatConfig) error {
+	if cfg.Channel == "" {
+		return fmt.Errorf("zulip needs the channel to be set to a stream")
+	}
+	return nil
+}
+
+func (zulipFormatter) format(msg Message, cfg FormatConfig) ([]byte, string, error) {
+	topic, err := renderFormat(cfg.Topic, msg, msg.Channel)
+	if err != nil {
+		return nil, "", err
+	}
+	name, err := renderFormat(cfg.DisplayName, msg, msg.Username)
+	if err != nil {
+		return nil, "", err
+	}
+
+	content := formattedText(msg)
+	if name != "" {
+		content = fmt.Sprintf("**%s**: %s", name, content)
+	}
+	form := url.Values{}
+	form.Set("type", "stream")
+	form.Set("to", cfg.Channel)
+	form.Set("topic", topic)
+	form.Set("content", content)
+	return []byte(form.Encode()), "application/x-www-form-urlencoded", nil
+}
+
+// rocketChatFormatter posts to a rocket.chat incoming webhook, as the user with their avatar
+type rocketChatFormatter struct{}
+
+func (rocketChatFormatter) validate(cfg FormatConfig) error {
+	return nil
+}
+
+func (rocketChatFormatter) format(msg Message, cfg FormatConfig) ([]byte, string, error) {
+	name, err := renderFormat(cfg.DisplayName, msg, msg.Username)
+	if err != nil {
+		return nil, "", err
+	}
+	body, err := json.Marshal(struct {
+		Text    string `json:"text"`
+		Alias   string `json:"alias,omitempty"`
+		Avatar  string `json:"avatar,omitempty"`
+		Channel string `json:"channel,omitempty"`
+	}{Text: formattedText(msg), Alias: name, Avatar: msg.Avatar, Channel: cfg.Channel})
+	return body, contentTypeJson, err
+}
+
+// mattermostFormatter posts to a mattermost incoming webhook, as the user with their avatar. the
+// webhook has to allow overriding the username and icon for them to be used.
+type mattermostFormatter struct{}
+
+func (mattermostFormatter) validate(cfg FormatConfig) error {
+	return nil
+}
+
+func (mattermostFormatter) format(msg Message, cfg FormatConfig) ([]byte, string, error) {
+	name, err := renderFormat(cfg.DisplayName, msg, msg.Username)
+	if err != nil {
+		return nil, "", err
+	}
+	body, err := json.Marshal(struct {
+		Text     string `json:"text"`
+		Username string `json:"username,omitempty"`
+		IconUrl  string `json:"icon_url,omitempty"`
+		Channel  string `json:"channel,omitempty"`
+	}{Text: formattedText(msg), Username: name, IconUrl: msg.Avatar, Channel: cfg.Channel})
+	return body, contentTypeJson, err
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func FuzzTemplates(f *testing.F) {
+	f.Add("chat.{{.Gateway}}.{{.Channel}}", "hello", "general", "bob", "gw1")
+	f.Add("{{.Username}} in {{.Channel}}", "hello", "gen.eral", "bo b", "gw/1")
+	f.Add("{{.Missing}}", "", "", "", "")
+	f.Add("{{if .Text}}{{.Text}}{{else}}empty{{end}}", "**hi**", "#chan", "<@1>", "")
+	f.Add("{{", "text", "chan", "user", "gw")
+	f.Add("{{range 1000000000}}{{$.Text}}{{end}}", "hello", "general", "bob", "gw1")
+	f.Add("{{range 1000000000}}{{end}}", "hello", "general", "bob", "gw1")
+	f.Add("{{$n := 1000}}{{range $n}}{{range $n}}{{end}}{{end}}", "hello", "general", "bob", "gw1")
+
+	f.Fuzz(func(t *testing.T, text string, msgText string, channel string, username string, gateway string) {
+		msg := Message{Text: msgText, Channel: channel, Username: username, Gateway: gateway}
+
+		// topics always end up as levels without the separator or whitespace in the values
+		topic, err := parseTopicTemplate("chat.{{.Gateway}}.{{.Channel}}.{{.Username}}", ".", "*", ">")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rendered, err := topic.render(msg); err == nil {
+			if levels := strings.Split(rendered, "."); len(levels) != 4 {
+				t.Fatalf("topic %q doesn't have 4 levels", rendered)
+			}
+			if strings.ContainsAny(rendered, " \t\r\n*>") {
+				t.Fatalf("topic %q has special characters", rendered)
+			}
+		}
+
+		// chat services are always sent a valid payload
+		for name, formatter := range formatters {
+			cfg := FormatConfig{Type: name, Channel: "stream"}
+			if formatter.validate(cfg) != nil {
+				continue
+			}
+			body, contentType, err := formatter.format(msg, cfg)
+			if err != nil {
+				t.Fatalf("failed to format for %s: %v", name, err)
+			}
+			switch contentType {
+			case contentTypeJson:
+				if !json.Valid(body) {
+					t.Fatalf("%s payload isn't valid json: %s", name, body)
+				}
+			default:
+				if _, err := url.ParseQuery(string(body)); err != nil {
+					t.Fatalf("%s payload isn't a valid form: %s", name, body)
+				}
+			}
+		}
+
+		// templates from the config only fail to parse or render, they never panic
+		if _, err := renderFormat(text, msg, "fallback"); err != nil {
+			return
+		}
+		if tmpl, err := parseTopicTemplate(text, "/"); err == nil {
+			tmpl.render(msg)
+		}
+	})
+}
+
+func TestRenderFormatOutputLimit(t *testing.T) {
+	_, err := renderFormat("{{range 1000}}{{$.Text}}{{end}}", Message{Text: strings.Repeat("a", 5000)}, "")
+	if err == nil || !strings.Contains(err.Error(), "longer than") {
+		t.Errorf("expected a template with too much output to fail, got %v", err)
+	}
+
+	text, err := renderFormat("{{.Username}}: {{.Text}}", Message{Text: "hello", Username: "bob"}, "")
+	if err != nil || text != "bob: hello" {
+		t.Errorf("unexpected rendered text %q, %v", text, err)
+	}
+}
+
+func TestTemplateLoopLimit(t *testing.T) {
+	for _, text := range []string{
+		"{{range 1000000000}}{{end}}",
+		"{{$n := 1000000000}}{{range $n}}{{end}}",
+		"{{range 1000}}{{if .Text}}{{range 1000}}{{end}}{{end}}{{end}}",
+		"{{range (18446744073709551615)}}{{end}}",
+		`{{define "inner"}}{{range 1000}}{{end}}{{end}}{{range 1000}}{{template "inner"}}{{end}}`,
+	} {
+		if _, err := formatTemplate(text); err == nil || !strings.Contains(err.Error(), "at most") {
+			t.Errorf("expected %s to be refused, got %v", text, err)
+		}
+		if _, err := parseTopicTemplate(text, "."); err == nil {
+			t.Errorf("expected the topic %s to be refused", text)
+		}
+	}
+
+	for _, text := range []string{"{{range 100}}{{range 100}}.{{end}}{{end}}", "{{range -5}}{{end}}", "{{range .Attachments}}{{.Name}}{{end}}"} {
+		if _, err := formatTemplate(text); err != nil {
+			t.Errorf("expected %s to be allowed, got %v", text, err)
+		}
+	}
+}
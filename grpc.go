@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/jake-walker/matterbridge-to-webhook/pkg/forwarder"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// grpcAckTimeout is how long a message can wait for the server to acknowledge it before it is
+// retried
+const grpcAckTimeout = 10 * time.Second
+
+// GrpcDestination streams messages to a server implementing the forwarder service instead of
+// posting them to a webhook
+type GrpcDestination struct {
+	// the server, such as forwarder.example.com:443
+	Address string `json:"address"`
+	// connect without tls, for servers on a trusted network
+	Insecure bool      `json:"insecure,omitempty"`
+	Tls      TlsConfig `json:"tls,omitempty"`
+}
+
+// grpcStream is the stream messages are sent on, which is opened again if it fails
+type grpcStream = grpc.BidiStreamingClient[forwarder.ForwardRequest, forwarder.Ack]
+
+// grpcDestination sends every message on a single stream, and matches the acks from the server to
+// the deliveries waiting for them
+type grpcDestination struct {
+	conn   *grpc.ClientConn
+	client forwarder.ForwarderClient
+
+	mu      sync.Mutex
+	stream  grpcStream
+	cancel  context.CancelFunc
+	pending map[string]chan error
+	next    uint64
+	// a stream can only be sent on by one goroutine at a time. sends are kept apart from mu, so a
+	// send held up by flow control doesn't stop acks being passed on.
+	sendMu sync.Mutex
+}
+
+func (g GrpcDestination) validate() error {
+	if _, _, err := net.SplitHostPort(g.Address); err != nil {
+		return fmt.Errorf("invalid grpc address: %v", err)
+	}
+	return g.Tls.validate()
+}
+
+// newGrpcDestination sets up the client. the connection is made when messages are sent, so the
+// server doesn't need to be up yet.
+func newGrpcDestination(cfg GrpcDestination) (*grpcDestination, error) {
+	options := []grpc.DialOption{grpc.WithUserAgent("matterbridge-to-webhook")}
+	if cfg.Insecure {
+		options = append(options, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	} else {
+		tlsConfig, err := cfg.Tls.config()
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	}
+
+	target := "dns:///" + cfg.Address
+	if outboundDialer != nil {
+		// the proxy resolves the address, so it is passed through as it is
+		target = "passthrough:///" + cfg.Address
+		options = append(options, grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return outboundDialer.DialContext(ctx, "tcp", addr)
+		}))
+	}
+
+	conn, err := grpc.NewClient(target, options...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up grpc client: %v", err)
+	}
+	return &grpcDestination{conn: conn, client: forwarder.NewForwarderClient(conn), pending: map[string]chan error{}}, nil
+}
+
+// open returns the stream, opening it if there isn't one. it must be called with the lock held.
+func (d *grpcDestination) open(route Route, opts deliveryOptions) (grpcStream, error) {
+	if d.stream != nil {
+		return d.stream, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ctx = metadata.AppendToOutgoingContext(ctx, "route", route.Name)
+	if opts.webhookToken != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+opts.webhookToken)
+	}
+	stream, err := d.client.Forward(ctx)
+	if err != nil {
+		cancel()
+		return nil, grpcError(err)
+	}
+
+	d.stream, d.cancel = stream, cancel
+	go d.receive(stream)
+	return stream, nil
+}
+
+// receive passes the acks from the server to the deliveries waiting for them, until the stream
+// fails. anything still waiting then fails too, so it is retried on a new stream.
+func (d *grpcDestination) receive(stream grpcStream) {
+	defer diagnostics.recoverPanic()
+	for {
+		ack, err := stream.Recv()
+		if err != nil {
+			d.reset(stream, grpcError(err))
+			return
+		}
+
+		var result error
+		if ack.Error != "" {
+			result = withCause(causeNon2xx, fmt.Errorf("grpc server failed to process message: %s", ack.Error))
+			if ack.Permanent {
+				result = backoff.Permanent(result)
+			}
+		}
+		d.mu.Lock()
+		if waiting, ok := d.pending[ack.DeliveryId]; ok {
+			waiting <- result
+			delete(d.pending, ack.DeliveryId)
+		}
+		d.mu.Unlock()
+	}
+}
+
+// reset closes the stream if it is still the current one, failing everything waiting on it
+func (d *grpcDestination) reset(stream grpcStream, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.stream != stream {
+		return
+	}
+
+	d.cancel()
+	d.stream, d.cancel = nil, nil
+	for id, waiting := range d.pending {
+		waiting <- err
+		delete(d.pending, id)
+	}
+}
+
+// grpcError marks errors that won't be fixed by retrying as permanent, like the client errors
+// from webhooks
+func grpcError(err error) error {
+	switch status.Code(err) {
+	case codes.Unimplemented, codes.Unauthenticated, codes.PermissionDenied, codes.InvalidArgument:
+		return backoff.Permanent(fmt.Errorf("grpc stream failed: %v", err))
+	}
+	return fmt.Errorf("grpc stream failed: %v", err)
+}
+
+func (d *grpcDestination) deliver(ctx context.Context, cfg Config, route Route, opts deliveryOptions, msgs []Message, body []byte, contentType string) error {
+	msg := msgs[0]
+	req := &forwarder.ForwardRequest{
+		Route:       route.Name,
+		Message:     messageToProto(msg),
+		ContentType: contentType,
+	}
+	if opts.execHook != nil || route.PayloadJq != "" {
+		req.Payload = body
+	}
+	// pass the trace on to the server so it can continue it
+	if featureEnabled(cfg, flagPropagateTraceContext, route, msg, true) {
+		carrier := propagation.MapCarrier{}
+		otel.GetTextMapPropagator().Inject(ctx, carrier)
+		req.TraceContext = carrier
+	}
+
+	start := time.Now()
+	defer recordStage(ctx, stageDeliver, start)
+
+	// the timeout covers sending as well as waiting for the ack
+	timeout := time.NewTimer(grpcAckTimeout)
+	defer timeout.Stop()
+
+	waiting := make(chan error, 1)
+	d.mu.Lock()
+	stream, err := d.open(route, opts)
+	if err != nil {
+		d.mu.Unlock()
+		return err
+	}
+	d.next++
+	req.DeliveryId = strconv.FormatUint(d.next, 10)
+	d.pending[req.DeliveryId] = waiting
+	d.mu.Unlock()
+
+	sent := make(chan struct{})
+	go func() {
+		defer diagnostics.recoverPanic()
+		defer close(sent)
+		d.sendMu.Lock()
+		defer d.sendMu.Unlock()
+		// if sending fails, the stream is broken, and the delivery fails with the reason once it is
+		// received
+		_ = stream.Send(req)
+	}()
+
+	select {
+	case err = <-waiting:
+		return err
+	case <-timeout.C:
+		err = withCause(causeTimeout, fmt.Errorf("timed out waiting for the grpc server"))
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	// a send that is still held up means the server has stopped taking messages, so the stream is
+	// closed, which fails the send and everything else waiting on it
+	select {
+	case <-sent:
+	default:
+		d.reset(stream, err)
+	}
+
+	d.mu.Lock()
+	delete(d.pending, req.DeliveryId)
+	d.mu.Unlock()
+	return err
+}
+
+func (d *grpcDestination) close() {
+	d.mu.Lock()
+	if d.cancel != nil {
+		d.cancel()
+	}
+	d.mu.Unlock()
+	d.conn.Close()
+}
+
+// messageToProto converts a message to the type sent to grpc servers
+func messageToProto(msg Message) *forwarder.Message {
+	m := &forwarder.Message{
+		Text:      msg.Text,
+		Channel:   msg.Channel,
+		Username:  msg.Username,
+		Userid:    msg.Userid,
+		Avatar:    msg.Avatar,
+		Account:   msg.Account,
+		Event:     msg.Event,
+		Protocol:  msg.Protocol,
+		Gateway:   msg.Gateway,
+		ParentId:  msg.ParentId,
+		Timestamp: msg.Timestamp,
+		Id:        msg.Id,
+		Source:    msg.Source,
+	}
+	if msg.Edit != nil {
+		m.Edit = &forwarder.MessageEdit{Before: msg.Edit.Before, After: msg.Edit.After, Diff: msg.Edit.Diff}
+	}
+	if msg.AccountInfo != nil {
+		m.AccountInfo = &forwarder.AccountInfo{DisplayName: msg.AccountInfo.DisplayName, IconUrl: msg.AccountInfo.IconUrl}
+	}
+	if msg.Command != nil {
+		m.Command = &forwarder.Command{Name: msg.Command.Name, Args: msg.Command.Args}
+	}
+	for _, attachment := range msg.Attachments {
+		m.Attachments = append(m.Attachments, &forwarder.Attachment{
+			Name:    attachment.Name,
+			Url:     attachment.Url,
+			Size:    attachment.Size,
+			Comment: attachment.Comment,
+			Data:    attachment.Data,
+		})
+	}
+	return m
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	healthMu       sync.Mutex
+	healthBySource = map[string]*streamHealth{}
+)
+
+// streamHealth tracks the state of the connection to a matterbridge instance
+type streamHealth struct {
+	connected   atomic.Bool
+	lastMessage atomic.Int64
+}
+
+// registerHealth creates the health tracker for a source
+func registerHealth(name string) *streamHealth {
+	h := &streamHealth{}
+	// count from startup, so a stream that never sends anything still looks stale
+	h.lastMessage.Store(time.Now().UnixNano())
+
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	healthBySource[name] = h
+	return h
+}
+
+// eachHealth calls fn with the health of every source
+func eachHealth(fn func(name string, h *streamHealth)) {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	for name, h := range healthBySource {
+		fn(name, h)
+	}
+}
+
+func (h *streamHealth) setConnected(connected bool) {
+	h.connected.Store(connected)
+}
+
+func (h *streamHealth) isConnected() bool {
+	return h.connected.Load()
+}
+
+// received records that something came through the stream
+func (h *streamHealth) received() {
+	h.lastMessage.Store(time.Now().UnixNano())
+}
+
+// lastMessageAge is the time since anything was last received from the stream
+func (h *streamHealth) lastMessageAge() time.Duration {
+	return time.Since(time.Unix(0, h.lastMessage.Load()))
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// healthFileInterval is how often the health file is written
+const healthFileInterval = 10 * time.Second
+
+// defaultHealthFileMaxAge is how old the health file can be before the healthcheck fails, long
+// enough to miss a couple of writes
+const defaultHealthFileMaxAge = 30 * time.Second
+
+// healthcheckTimeout is how long the healthcheck waits for the health endpoint
+const healthcheckTimeout = 5 * time.Second
+
+// healthReport is the body of the health endpoint, and the contents of the health file
+type healthReport struct {
+	Healthy   bool                    `json:"healthy"`
+	CheckedAt time.Time               `json:"checked_at"`
+	Sources   map[string]sourceHealth `json:"sources"`
+}
+
+type sourceHealth struct {
+	Connected             bool    `json:"connected"`
+	LastMessageAgeSeconds float64 `json:"last_message_age_seconds"`
+}
+
+// currentHealth reports on the stream from each matterbridge instance. the bridge is healthy when
+// all of them are connected.
+func currentHealth() healthReport {
+	report := healthReport{Healthy: streamsConnected(), CheckedAt: time.Now().UTC(), Sources: map[string]sourceHealth{}}
+	eachHealth(func(name string, h *streamHealth) {
+		report.Sources[name] = sourceHealth{Connected: h.isConnected(), LastMessageAgeSeconds: h.lastMessageAge().Seconds()}
+	})
+	return report
+}
+
+// handleHealthz serves the health report, with a 503 status when the bridge isn't healthy so load
+// balancers and orchestrators don't need to read the body
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	report := currentHealth()
+	status := http.StatusOK
+	if !report.Healthy {
+		status = http.StatusServiceUnavailable
+	}
+	writeJson(w, status, report)
+}
+
+var healthFile = &healthFileWriter{}
+
+// healthFileWriter keeps the health report in a file, for health checks in deployments without
+// the admin server
+type healthFileWriter struct {
+	path string
+	stop chan struct{}
+	done chan struct{}
+}
+
+// enable writes the health report to the file at an interval until closed
+func (f *healthFileWriter) enable(path string) error {
+	if err := f.write(path); err != nil {
+		return err
+	}
+	f.path = path
+	f.stop = make(chan struct{})
+	f.done = make(chan struct{})
+	go f.run()
+	return nil
+}
+
+func (f *healthFileWriter) run() {
+	defer diagnostics.recoverPanic()
+	defer close(f.done)
+
+	ticker := time.NewTicker(healthFileInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-ticker.C:
+			if err := f.write(f.path); err != nil {
+				slog.Warn("failed to write health file", "file", f.path, slog.Any("error", err))
+			}
+		}
+	}
+}
+
+// write replaces the health file, so the healthcheck never reads a partly written one
+func (f *healthFileWriter) write(path string) error {
+	data, err := json.Marshal(currentHealth())
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write health file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write health file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write health file: %v", err)
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// close stops writing the health file and removes it, as a stopped bridge isn't healthy
+func (f *healthFileWriter) close() error {
+	if f.path == "" {
+		return nil
+	}
+	close(f.stop)
+	<-f.done
+	if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// runHealthcheck checks the health of a running bridge, from its health endpoint or health file,
+// and fails if it isn't healthy. it is meant for container health checks, which can't rely on
+// curl being in the image.
+func runHealthcheck(args []string) error {
+	flags := flag.NewFlagSet("healthcheck", flag.ContinueOnError)
+	url := flags.String("url", "", "url of the health endpoint, defaulting to /healthz on ADMIN_ADDR")
+	file := flags.String("file", os.Getenv("HEALTH_FILE"), "health file to check instead of the endpoint")
+	maxAge := flags.Duration("max-age", defaultHealthFileMaxAge, "how old the health file can be")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var report healthReport
+	var err error
+	if *file != "" && *url == "" {
+		report, err = readHealthFile(*file, *maxAge)
+	} else {
+		if *url == "" {
+			*url, err = localHealthUrl(os.Getenv("ADMIN_ADDR"))
+			if err != nil {
+				return err
+			}
+		}
+		report, err = fetchHealth(*url)
+	}
+	if err != nil {
+		return err
+	}
+
+	if !report.Healthy {
+		for name, source := range report.Sources {
+			if !source.Connected {
+				return fmt.Errorf("unhealthy: the stream from %s is not connected", name)
+			}
+		}
+		return fmt.Errorf("unhealthy: no streams are connected")
+	}
+	fmt.Println("healthy")
+	return nil
+}
+
+// localHealthUrl is the health endpoint of the admin server listening on addr
+func localHealthUrl(addr string) (string, error) {
+	if addr == "" {
+		return "", fmt.Errorf("the admin address or health file must be set for the healthcheck")
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid admin address: %v", err)
+	}
+	// servers listening on every interface can be reached on loopback
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	return "http://" + net.JoinHostPort(host, port) + "/healthz", nil
+}
+
+func fetchHealth(url string) (healthReport, error) {
+	report := healthReport{}
+	client := &http.Client{Timeout: healthcheckTimeout}
+	res, err := client.Get(url)
+	if err != nil {
+		return report, fmt.Errorf("failed to reach the health endpoint: %v", err)
+	}
+	defer res.Body.Close()
+	if err := json.NewDecoder(res.Body).Decode(&report); err != nil {
+		return report, fmt.Errorf("health endpoint returned %s", res.Status)
+	}
+	return report, nil
+}
+
+func readHealthFile(path string, maxAge time.Duration) (healthReport, error) {
+	report := healthReport{}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return report, fmt.Errorf("failed to read health file: %v", err)
+	}
+	if err := json.Unmarshal(data, &report); err != nil {
+		return report, fmt.Errorf("failed to parse health file: %v", err)
+	}
+	if age := time.Since(report.CheckedAt); age > maxAge {
+		return report, fmt.Errorf("unhealthy: the health file was last written %s ago", age.Round(time.Second))
+	}
+	return report, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// fetchHistory gets the messages matterbridge has buffered
+func fetchHistory(ctx context.Context, src *source) ([]Message, error) {
+	req, err := src.newRequest(ctx, "GET", "/api/messages")
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request history: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to request history: matterbridge returned %s", res.Status)
+	}
+
+	msgs := []Message{}
+	if err := json.NewDecoder(res.Body).Decode(&msgs); err != nil {
+		return nil, fmt.Errorf("failed to decode history: %v", err)
+	}
+	return msgs, nil
+}
+
+// replayHistory forwards the most recent buffered messages from before the stream connected, up to
+// the max count and age
+func replayHistory(ctx context.Context, src *source, maxMessages int, maxAge time.Duration, connectedAt time.Time, c chan queuedMessage) {
+	msgs, err := fetchHistory(ctx, src)
+	if err != nil {
+		slog.Warn("failed to replay history", "source", src.name, "error", err)
+		return
+	}
+
+	replay := []Message{}
+	for _, msg := range msgs {
+		if msg.Event != "" {
+			continue
+		}
+
+		// anything sent after the stream connected will come through the stream as well. messages
+		// close to connecting might have come from a clock that is ahead, so are replayed to be safe.
+		timestamp, ok := messageTime(msg, connectedAt)
+		if ok && timestamp.After(connectedAt) {
+			continue
+		}
+		if maxAge > 0 && (!ok || olderThan(timestamp, connectedAt, maxAge)) {
+			continue
+		}
+
+		replay = append(replay, msg)
+	}
+
+	// keep the newest messages
+	if maxMessages >= 0 && len(replay) > maxMessages {
+		replay = replay[len(replay)-maxMessages:]
+	}
+
+	slog.Info("replaying history", "source", src.name, "messages", len(replay), "buffered", len(msgs))
+	for _, msg := range replay {
+		enqueueMessage(src, msg, c)
+	}
+}
@@ -0,0 +1,267 @@
+//go:build integration
+
+// Package integration runs the bridge against a real matterbridge in docker, with a gateway joining
+// two api accounts. messages are posted to one account, and the bridge reads them from the other
+// and delivers them to a webhook run by the test. run it with go test -tags integration ./integration
+package integration
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/jake-walker/matterbridge-to-webhook/pkg/bridge"
+	"github.com/ory/dockertest/v3"
+	"github.com/ory/dockertest/v3/docker"
+)
+
+// the token set for the account the bridge reads from, in matterbridge.toml
+const token = "integration-token"
+
+// how long to wait for a message to be delivered
+const deliveryTimeout = 30 * time.Second
+
+// receiver is the webhook the bridge delivers to
+type receiver struct {
+	mu    sync.Mutex
+	texts []string
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	// capability probes are refused, so messages are delivered as usual
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var msgs []bridge.Message
+	if err := json.NewDecoder(req.Body).Decode(&msgs); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, msg := range msgs {
+		r.texts = append(r.texts, msg.Text)
+	}
+}
+
+// snapshot returns the text of every message delivered so far
+func (r *receiver) snapshot() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.texts)
+}
+
+func (r *receiver) received(text string) bool {
+	return slices.Contains(r.snapshot(), text)
+}
+
+// freePort finds a port on the loopback interface that nothing is listening on
+func freePort(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	return port
+}
+
+// startMatterbridge runs matterbridge with the ports published on fixed host ports, so they stay
+// the same when it is restarted. it returns the urls of the api accounts to post to and read from.
+func startMatterbridge(t *testing.T, pool *dockertest.Pool) (*dockertest.Resource, string, string) {
+	t.Helper()
+	config, err := filepath.Abs("matterbridge.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inPort, outPort := freePort(t), freePort(t)
+	resource, err := pool.RunWithOptions(&dockertest.RunOptions{
+		Repository:   "42wim/matterbridge",
+		Tag:          "stable",
+		Mounts:       []string{config + ":/etc/matterbridge/matterbridge.toml:ro"},
+		ExposedPorts: []string{"4242/tcp", "4243/tcp"},
+		PortBindings: map[docker.Port][]docker.PortBinding{
+			"4242/tcp": {{HostIP: "127.0.0.1", HostPort: inPort}},
+			"4243/tcp": {{HostIP: "127.0.0.1", HostPort: outPort}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to start matterbridge: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := pool.Purge(resource); err != nil {
+			t.Errorf("failed to remove matterbridge: %v", err)
+		}
+	})
+	return resource, "http://127.0.0.1:" + inPort, "http://127.0.0.1:" + outPort
+}
+
+// waitForApi waits until matterbridge's api accepts requests
+func waitForApi(t *testing.T, pool *dockertest.Pool, apiUrl string) {
+	t.Helper()
+	err := pool.Retry(func() error {
+		res, err := http.Get(apiUrl + "/api/health")
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return fmt.Errorf("matterbridge returned %s", res.Status)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("matterbridge didn't start: %v", err)
+	}
+}
+
+// send posts a message into the gateway through the other api account
+func send(t *testing.T, apiUrl string, text string) {
+	t.Helper()
+	body, _ := json.Marshal(map[string]string{"text": text, "username": "tester", "gateway": "test"})
+	res, err := http.Post(apiUrl+"/api/message", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("failed to send message: matterbridge returned %s", res.Status)
+	}
+}
+
+// expect waits for the receiver to be sent a message
+func expect(t *testing.T, rcv *receiver, text string) {
+	t.Helper()
+	deadline := time.Now().Add(deliveryTimeout)
+	for !rcv.received(text) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%q wasn't delivered", text)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// startBridge builds the bridge and runs it until the test finishes
+func startBridge(t *testing.T, env ...string) {
+	t.Helper()
+	bin := filepath.Join(t.TempDir(), "matterbridge-to-webhook")
+	build := exec.Command("go", "build", "-o", bin, "..")
+	build.Stdout, build.Stderr = os.Stderr, os.Stderr
+	if err := build.Run(); err != nil {
+		t.Fatalf("failed to build the bridge: %v", err)
+	}
+
+	cmd := exec.Command(bin)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("failed to start the bridge: %v", err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Signal(os.Interrupt)
+		cmd.Wait()
+	})
+}
+
+func TestBridge(t *testing.T) {
+	pool, err := dockertest.NewPool("")
+	if err != nil {
+		t.Skipf("docker isn't available: %v", err)
+	}
+	if err := pool.Client.Ping(); err != nil {
+		t.Skipf("docker isn't available: %v", err)
+	}
+
+	resource, inUrl, outUrl := startMatterbridge(t, pool)
+	waitForApi(t, pool, inUrl)
+	waitForApi(t, pool, outUrl)
+
+	t.Run("wrong credentials are rejected", func(t *testing.T) {
+		// matterbridge refuses a wrong token as unauthorized, and a missing one as a bad request
+		for name, tc := range map[string]struct {
+			token  string
+			status string
+		}{
+			"wrong token": {token: "wrong", status: "401"},
+			"no token":    {status: "40"},
+		} {
+			src := &bridge.StreamSource{Url: outUrl, Token: tc.token, BackOff: backoff.WithMaxRetries(&backoff.ZeroBackOff{}, 0)}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			err := src.Read(ctx, func(ctx context.Context, msg bridge.Message) {
+				t.Errorf("%s: expected nothing to be read, got %+v", name, msg)
+			})
+			cancel()
+			if err == nil || !strings.Contains(err.Error(), "matterbridge returned "+tc.status) {
+				t.Errorf("%s: expected matterbridge to refuse the stream, got %v", name, err)
+			}
+		}
+	})
+
+	rcv := &receiver{}
+	webhook := httptest.NewServer(rcv)
+	defer webhook.Close()
+	startBridge(t,
+		"MATTERBRIDGE_API_URL="+outUrl,
+		"MATTERBRIDGE_API_TOKEN="+token,
+		"WEBHOOK_URL="+webhook.URL+"/hook",
+		"MESSAGE_PREFIX=!",
+	)
+
+	t.Run("prefixed message is delivered", func(t *testing.T) {
+		// the first message can be sent before the bridge has connected, so keep sending it
+		deadline := time.Now().Add(deliveryTimeout)
+		for !rcv.received("!ping first") {
+			if time.Now().After(deadline) {
+				t.Fatal("\"!ping first\" wasn't delivered")
+			}
+			send(t, inUrl, "!ping first")
+			time.Sleep(time.Second)
+		}
+	})
+
+	t.Run("message without prefix is filtered", func(t *testing.T) {
+		send(t, inUrl, "not a command")
+		send(t, inUrl, "!ping second")
+		expect(t, rcv, "!ping second")
+		if rcv.received("not a command") {
+			t.Error("expected the message without the prefix to be filtered")
+		}
+	})
+
+	t.Run("bridge reconnects after matterbridge restarts", func(t *testing.T) {
+		if err := pool.Client.RestartContainer(resource.Container.ID, 10); err != nil {
+			t.Fatalf("failed to restart matterbridge: %v", err)
+		}
+		waitForApi(t, pool, inUrl)
+
+		// messages sent before the bridge reconnects aren't in the stream, so keep sending until
+		// one gets through
+		deadline := time.Now().Add(2 * deliveryTimeout)
+		for i := 1; ; i++ {
+			text := fmt.Sprintf("!ping after restart %d", i)
+			send(t, inUrl, text)
+			time.Sleep(time.Second)
+			if slices.ContainsFunc(rcv.snapshot(), func(v string) bool { return strings.HasPrefix(v, "!ping after restart") }) {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("nothing was delivered after matterbridge restarted")
+			}
+		}
+	})
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/itchyny/gojq"
+)
+
+// payloadPrograms are the compiled jq expressions of routes, by expression, so each is only
+// compiled once
+var (
+	payloadProgramsMu sync.Mutex
+	payloadPrograms   = map[string]*gojq.Code{}
+)
+
+// compilePayloadJq compiles a jq expression for reshaping messages
+func compilePayloadJq(expr string) (*gojq.Code, error) {
+	query, err := gojq.Parse(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid jq expression: %v", err)
+	}
+	code, err := gojq.Compile(query)
+	if err != nil {
+		return nil, fmt.Errorf("invalid jq expression: %v", err)
+	}
+	return code, nil
+}
+
+// payloadProgram returns the compiled jq expression of a route
+func payloadProgram(expr string) (*gojq.Code, error) {
+	payloadProgramsMu.Lock()
+	defer payloadProgramsMu.Unlock()
+
+	if code, ok := payloadPrograms[expr]; ok {
+		return code, nil
+	}
+	code, err := compilePayloadJq(expr)
+	if err != nil {
+		return nil, err
+	}
+	payloadPrograms[expr] = code
+	return code, nil
+}
+
+// reshapeMessages runs each message through the route's jq expression, returning everything it
+// outputs in order. an expression can output nothing for a message, like with select, to leave it
+// out of the payload.
+func reshapeMessages(ctx context.Context, expr string, msgs []Message) ([]any, error) {
+	code, err := payloadProgram(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	outputs := []any{}
+	for _, msg := range msgs {
+		// jq works on plain json values, so the message is converted to them first
+		data, err := json.Marshal(msg)
+		if err != nil {
+			return nil, err
+		}
+		var input any
+		if err := json.Unmarshal(data, &input); err != nil {
+			return nil, err
+		}
+
+		iter := code.RunWithContext(ctx, input)
+		for {
+			v, ok := iter.Next()
+			if !ok {
+				break
+			}
+			if err, ok := v.(error); ok {
+				if err, ok := err.(*gojq.HaltError); ok && err.Value() == nil {
+					break
+				}
+				return nil, fmt.Errorf("jq expression failed: %v", err)
+			}
+			outputs = append(outputs, v)
+		}
+	}
+	return outputs, nil
+}
+
+// reshapePayload builds the body of a request from the outputs of the route's jq expression for
+// the messages. there is no body if it left every message out.
+func reshapePayload(ctx context.Context, route Route, msgs []Message, caps capabilities) ([]byte, string, error) {
+	outputs, err := reshapeMessages(ctx, route.PayloadJq, msgs)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(outputs) == 0 {
+		return nil, "", nil
+	}
+	return encodeJqPayload(outputs, caps)
+}
+
+// encodeJqPayload builds the body of a request from the outputs of a route's jq expression, in the
+// same shapes as messages are normally sent
+func encodeJqPayload(outputs []any, caps capabilities) ([]byte, string, error) {
+	if caps.object && len(outputs) == 1 {
+		body, err := json.Marshal(outputs[0])
+		return body, contentTypeJson, err
+	}
+	if !caps.ndjson {
+		body, err := json.Marshal(outputs)
+		return body, contentTypeJson, err
+	}
+
+	body := []byte{}
+	for _, output := range outputs {
+		line, err := json.Marshal(output)
+		if err != nil {
+			return nil, "", err
+		}
+		body = append(append(body, line...), '\n')
+	}
+	return body, contentTypeNdjson, nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+)
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// kubernetesClient is a minimal client for the kubernetes api using the pod's service account
+type kubernetesClient struct {
+	baseUrl   string
+	tokenFile string
+	http      *http.Client
+}
+
+type configMap struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Data map[string]string `json:"data"`
+}
+
+type watchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// configMapWatcher applies routing configuration from a key in a configmap whenever it changes
+type configMapWatcher struct {
+	client    *kubernetesClient
+	namespace string
+	name      string
+	key       string
+	store     *ConfigStore
+}
+
+func newInClusterClient() (*kubernetesClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running inside a kubernetes cluster")
+	}
+
+	ca, err := os.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cluster ca: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("failed to parse cluster ca")
+	}
+
+	return &kubernetesClient{
+		baseUrl:   "https://" + net.JoinHostPort(host, port),
+		tokenFile: filepath.Join(serviceAccountDir, "token"),
+		http: &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		},
+	}, nil
+}
+
+// get performs a get request against the api. the token is read every time as kubernetes rotates it.
+func (k *kubernetesClient) get(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	token, err := os.ReadFile(k.tokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read service account token: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", k.baseUrl+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build request: %v", err)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", strings.TrimSpace(string(token))))
+	req.Header.Set("Accept", "application/json")
+
+	res, err := k.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("kubernetes api returned %s", res.Status)
+	}
+	return res, nil
+}
+
+// newConfigMapWatcher creates a watcher for a configmap given as "name" or "namespace/name". the
+// pod's own namespace is used when none is given.
+func newConfigMapWatcher(configMapName string, key string, store *ConfigStore) (*configMapWatcher, error) {
+	client, err := newInClusterClient()
+	if err != nil {
+		return nil, err
+	}
+
+	namespace, name, found := strings.Cut(configMapName, "/")
+	if !found {
+		data, err := os.ReadFile(filepath.Join(serviceAccountDir, "namespace"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read pod namespace: %v", err)
+		}
+		namespace, name = strings.TrimSpace(string(data)), configMapName
+	}
+
+	return &configMapWatcher{
+		client:    client,
+		namespace: namespace,
+		name:      name,
+		key:       key,
+		store:     store,
+	}, nil
+}
+
+func (w *configMapWatcher) path() string {
+	return fmt.Sprintf("/api/v1/namespaces/%s/configmaps", url.PathEscape(w.namespace))
+}
+
+// apply parses the config from the configmap and swaps it into the store
+func (w *configMapWatcher) apply(cm configMap) error {
+	data, ok := cm.Data[w.key]
+	if !ok {
+		return fmt.Errorf("configmap %s/%s has no key %s", w.namespace, w.name, w.key)
+	}
+
+	cfg, err := parseConfig([]byte(data))
+	if err != nil {
+		return err
+	}
+
+	version, err := w.store.Replace(cfg)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("applied config from configmap", "configmap", w.name, "resource_version", cm.Metadata.ResourceVersion, "version", version)
+	return nil
+}
+
+// load fetches and applies the current configmap, returning its resource version to watch from
+func (w *configMapWatcher) load(ctx context.Context) (string, error) {
+	res, err := w.client.get(ctx, w.path()+"/"+url.PathEscape(w.name), url.Values{})
+	if err != nil {
+		return "", fmt.Errorf("failed to get configmap: %v", err)
+	}
+	defer res.Body.Close()
+
+	cm := configMap{}
+	if err := json.NewDecoder(res.Body).Decode(&cm); err != nil {
+		return "", fmt.Errorf("failed to decode configmap: %v", err)
+	}
+
+	return cm.Metadata.ResourceVersion, w.apply(cm)
+}
+
+// watch streams changes to the configmap from the given resource version until the watch ends
+func (w *configMapWatcher) watch(ctx context.Context, resourceVersion string, b backoff.BackOff) (string, error) {
+	res, err := w.client.get(ctx, w.path(), url.Values{
+		"watch":           {"true"},
+		"fieldSelector":   {"metadata.name=" + w.name},
+		"resourceVersion": {resourceVersion},
+	})
+	if err != nil {
+		return resourceVersion, fmt.Errorf("failed to watch configmap: %v", err)
+	}
+	defer res.Body.Close()
+
+	decoder := json.NewDecoder(res.Body)
+	for {
+		event := watchEvent{}
+		if err := decoder.Decode(&event); err != nil {
+			return resourceVersion, fmt.Errorf("failed to read watch event: %v", err)
+		}
+
+		if event.Type == "ERROR" {
+			// usually means the resource version is too old, so start again from the latest
+			return "", fmt.Errorf("watch failed: %s", string(event.Object))
+		}
+
+		cm := configMap{}
+		if err := json.Unmarshal(event.Object, &cm); err != nil {
+			return resourceVersion, fmt.Errorf("failed to decode configmap: %v", err)
+		}
+		resourceVersion = cm.Metadata.ResourceVersion
+		b.Reset()
+
+		switch event.Type {
+		case "ADDED", "MODIFIED":
+			if err := w.apply(cm); err != nil {
+				slog.Warn("ignoring invalid config from configmap", "configmap", w.name, "error", err)
+			}
+		case "DELETED":
+			slog.Warn("configmap was deleted, keeping the current config", "configmap", w.name)
+		}
+	}
+}
+
+// run watches the configmap forever, reconnecting with a backoff
+func (w *configMapWatcher) run(ctx context.Context, resourceVersion string) {
+	b := backoff.NewExponentialBackOff()
+	b.MaxElapsedTime = 0
+
+	_ = backoff.RetryNotify(func() error {
+		var err error
+		if resourceVersion == "" {
+			if resourceVersion, err = w.load(ctx); err != nil {
+				return err
+			}
+		}
+		resourceVersion, err = w.watch(ctx, resourceVersion, b)
+		return err
+	}, backoff.WithContext(b, ctx), func(err error, d time.Duration) {
+		slog.Warn("configmap watch failed", "error", err, "retry", d.String())
+	})
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// lifetime keeps counter totals across restarts, when a file to save them to is configured
+var lifetime = &lifetimeMetrics{totals: map[string]*lifetimeTotal{}}
+
+// lifetimeMetrics adds up every persisted counter, saving the totals to a file so they carry on
+// from where they were after a restart. they are exported as separate lifetime_ counters, so the
+// usual counters still reset like any other process.
+type lifetimeMetrics struct {
+	mu      sync.Mutex
+	enabled bool
+	path    string
+	meter   metric.Meter
+	names   []string
+	totals  map[string]*lifetimeTotal
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+type lifetimeTotal struct {
+	name       string
+	attributes attribute.Set
+	value      int64
+}
+
+// lifetimeSnapshot is the saved totals file
+type lifetimeSnapshot struct {
+	SavedAt  time.Time               `json:"saved_at"`
+	Counters []lifetimeSnapshotEntry `json:"counters"`
+}
+
+type lifetimeSnapshotEntry struct {
+	Name       string            `json:"name"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Value      int64             `json:"value"`
+}
+
+// persistedCounter is a counter that also adds to the lifetime totals
+type persistedCounter struct {
+	metric.Int64Counter
+	name string
+}
+
+func (c persistedCounter) Add(ctx context.Context, incr int64, options ...metric.AddOption) {
+	c.Int64Counter.Add(ctx, incr, options...)
+	lifetime.add(c.name, incr, metric.NewAddConfig(options).Attributes())
+}
+
+// lifetimeCounter creates a counter which keeps a lifetime total when persisting is enabled
+func lifetimeCounter(meter metric.Meter, name string, options ...metric.Int64CounterOption) (metric.Int64Counter, error) {
+	counter, err := meter.Int64Counter(name, options...)
+	if err != nil {
+		return counter, err
+	}
+
+	lifetime.mu.Lock()
+	defer lifetime.mu.Unlock()
+	// every route has its own counters with the same names, which add to the same totals
+	if !slices.Contains(lifetime.names, name) {
+		lifetime.names = append(lifetime.names, name)
+		if lifetime.enabled {
+			if err := lifetime.observe(name); err != nil {
+				return counter, err
+			}
+		}
+	}
+	return persistedCounter{Int64Counter: counter, name: name}, nil
+}
+
+func totalKey(name string, attributes attribute.Set) string {
+	return name + "\x00" + attributes.Encoded(attribute.DefaultEncoder())
+}
+
+func (l *lifetimeMetrics) add(name string, incr int64, attributes attribute.Set) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.enabled {
+		return
+	}
+
+	key := totalKey(name, attributes)
+	total, ok := l.totals[key]
+	if !ok {
+		total = &lifetimeTotal{name: name, attributes: attributes}
+		l.totals[key] = total
+	}
+	total.value += incr
+}
+
+// enable restores the totals from the file, if it exists, and saves them to it at the interval
+// until closed
+func (l *lifetimeMetrics) enable(meter metric.Meter, path string, interval time.Duration) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.load(path); err != nil {
+		return err
+	}
+	l.enabled = true
+	l.path = path
+	l.meter = meter
+
+	for _, name := range l.names {
+		if err := l.observe(name); err != nil {
+			return err
+		}
+	}
+
+	l.stop = make(chan struct{})
+	l.done = make(chan struct{})
+	go l.run(interval)
+
+	slog.Info("persisting lifetime metrics", "file", path, "counters", len(l.totals))
+	return nil
+}
+
+// observe exports the lifetime totals of a counter
+func (l *lifetimeMetrics) observe(name string) error {
+	_, err := l.meter.Int64ObservableCounter(
+		"lifetime_"+name,
+		metric.WithDescription(fmt.Sprintf("Value of %s including previous runs", name)),
+		metric.WithInt64Callback(func(ctx context.Context, o metric.Int64Observer) error {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			for _, total := range l.totals {
+				if total.name == name {
+					o.Observe(total.value, metric.WithAttributeSet(total.attributes))
+				}
+			}
+			return nil
+		}),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create metric: %v", err)
+	}
+	return nil
+}
+
+// load reads the saved totals. a missing file is the first run, so starts from zero.
+func (l *lifetimeMetrics) load(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read lifetime metrics: %v", err)
+	}
+
+	snapshot := lifetimeSnapshot{}
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return fmt.Errorf("failed to parse lifetime metrics %s: %v", path, err)
+	}
+	for _, entry := range snapshot.Counters {
+		kvs := make([]attribute.KeyValue, 0, len(entry.Attributes))
+		for k, v := range entry.Attributes {
+			kvs = append(kvs, attribute.String(k, v))
+		}
+		attributes := attribute.NewSet(kvs...)
+		l.totals[totalKey(entry.Name, attributes)] = &lifetimeTotal{name: entry.Name, attributes: attributes, value: entry.Value}
+	}
+	return nil
+}
+
+func (l *lifetimeMetrics) run(interval time.Duration) {
+	defer diagnostics.recoverPanic()
+	defer close(l.done)
+
+	// the totals are saved a last time when closed, once the bridge has shut down
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			if err := l.save(); err != nil {
+				slog.Warn("failed to save lifetime metrics", "file", l.path, slog.Any("error", err))
+			}
+		}
+	}
+}
+
+// save writes the totals to a temporary file and moves it into place, so a crash while saving
+// can't lose the previous totals
+func (l *lifetimeMetrics) save() error {
+	l.mu.Lock()
+	snapshot := lifetimeSnapshot{SavedAt: time.Now().UTC(), Counters: make([]lifetimeSnapshotEntry, 0, len(l.totals))}
+	for _, total := range l.totals {
+		entry := lifetimeSnapshotEntry{Name: total.name, Value: total.value}
+		if total.attributes.Len() > 0 {
+			entry.Attributes = map[string]string{}
+			for _, kv := range total.attributes.ToSlice() {
+				entry.Attributes[string(kv.Key)] = kv.Value.Emit()
+			}
+		}
+		snapshot.Counters = append(snapshot.Counters, entry)
+	}
+	l.mu.Unlock()
+
+	// keep the file stable between saves, so it is easy to diff
+	sort.Slice(snapshot.Counters, func(i, j int) bool {
+		a, b := snapshot.Counters[i], snapshot.Counters[j]
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return fmt.Sprint(a.Attributes) < fmt.Sprint(b.Attributes)
+	})
+
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(l.path), ".lifetime-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), l.path)
+}
+
+// close stops saving at the interval and saves the final totals
+func (l *lifetimeMetrics) close() error {
+	l.mu.Lock()
+	enabled := l.enabled
+	l.mu.Unlock()
+	if !enabled {
+		return nil
+	}
+
+	close(l.stop)
+	<-l.done
+	if err := l.save(); err != nil {
+		return fmt.Errorf("failed to save lifetime metrics: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"unicode"
+	"unicode/utf8"
+)
+
+// how messages with text longer than a route's max text length are delivered
+const (
+	// as several messages, one after the other, each starting with a part marker like (1/3)
+	longTextSplit = "split"
+	// as a single message, cut short with an ellipsis
+	longTextTruncate = "truncate"
+)
+
+// minSplitTextLength leaves room for the part marker and some text in every part
+const minSplitTextLength = 16
+
+// limitTextLength applies the route's max text length to a message, returning the messages to
+// deliver in order. lengths are counted in characters rather than bytes.
+func limitTextLength(msg Message, route Route) []Message {
+	if route.MaxTextLength <= 0 || utf8.RuneCountInString(msg.Text) <= route.MaxTextLength {
+		return []Message{msg}
+	}
+
+	var parts []string
+	if route.LongText != longTextTruncate {
+		parts = splitText(msg.Text, route.MaxTextLength)
+	}
+	// text too long to split into parts with room for their markers is truncated instead
+	if parts == nil {
+		msg.Text = truncateText(msg.Text, route.MaxTextLength)
+		return []Message{msg}
+	}
+
+	msgs := make([]Message, len(parts))
+	for i, part := range parts {
+		msgs[i] = msg
+		msgs[i].Text = part
+		// attachments are only sent once, with the first part
+		if i > 0 {
+			msgs[i].Attachments = nil
+		}
+	}
+	return msgs
+}
+
+// truncateText cuts text short to at most max characters, ending with an ellipsis
+func truncateText(text string, max int) string {
+	runes := []rune(text)
+	if len(runes) <= max {
+		return text
+	}
+	if max <= 1 {
+		return "…"
+	}
+	return string(trimRightSpace(runes[:max-1])) + "…"
+}
+
+// splitText splits text into parts that are at most max characters long including their part
+// markers, preferring to split at whitespace. it returns nothing if the markers would leave no
+// room for the text.
+func splitText(text string, max int) []string {
+	// the marker is wider when there are more parts, which can make more parts, so keep going
+	// until the number of parts fits the marker
+	count := 1
+	for {
+		width := max - utf8.RuneCountInString(partMarker(count, count))
+		if width < 1 {
+			return nil
+		}
+		chunks := chunkText(text, width)
+		if len(chunks) <= count || len(fmt.Sprint(len(chunks))) <= len(fmt.Sprint(count)) {
+			parts := make([]string, len(chunks))
+			for i, chunk := range chunks {
+				parts[i] = partMarker(i+1, len(chunks)) + chunk
+			}
+			return parts
+		}
+		count = len(chunks)
+	}
+}
+
+func partMarker(part int, count int) string {
+	return fmt.Sprintf("(%d/%d) ", part, count)
+}
+
+// chunkText cuts text into chunks of at most width characters. chunks end at the last whitespace
+// in their second half if there is one, so words aren't cut in two.
+func chunkText(text string, width int) []string {
+	width = max(width, 1)
+	runes := []rune(text)
+	chunks := []string{}
+	for len(runes) > width {
+		cut := width
+		for i := width; i > width/2; i-- {
+			if unicode.IsSpace(runes[i]) {
+				cut = i
+				break
+			}
+		}
+		chunks = append(chunks, string(trimRightSpace(runes[:cut])))
+		runes = trimLeftSpace(runes[cut:])
+	}
+	if len(runes) > 0 {
+		chunks = append(chunks, string(runes))
+	}
+	return chunks
+}
+
+// trimLeftSpace and trimRightSpace remove whitespace from the ends of text, without converting it
+// back to a string, so long text isn't copied for every chunk
+func trimLeftSpace(runes []rune) []rune {
+	for len(runes) > 0 && unicode.IsSpace(runes[0]) {
+		runes = runes[1:]
+	}
+	return runes
+}
+
+func trimRightSpace(runes []rune) []rune {
+	for len(runes) > 0 && unicode.IsSpace(runes[len(runes)-1]) {
+		runes = runes[:len(runes)-1]
+	}
+	return runes
+}
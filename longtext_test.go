@@ -0,0 +1,120 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestLimitTextLengthSplit(t *testing.T) {
+	route := Route{Name: "test", MaxTextLength: 20, LongText: longTextSplit}
+	msg := Message{Text: "the quick brown fox jumps over the lazy dog", Attachments: []Attachment{{Name: "a.png"}}}
+
+	msgs := limitTextLength(msg, route)
+	if len(msgs) < 2 {
+		t.Fatalf("expected the text to be split, got %d messages", len(msgs))
+	}
+	words := []string{}
+	for i, part := range msgs {
+		if n := utf8.RuneCountInString(part.Text); n > route.MaxTextLength {
+			t.Errorf("part %d is %d characters long: %q", i+1, n, part.Text)
+		}
+		marker := partMarker(i+1, len(msgs))
+		if !strings.HasPrefix(part.Text, marker) {
+			t.Errorf("part %d doesn't start with %q: %q", i+1, marker, part.Text)
+		}
+		if i > 0 && part.Attachments != nil {
+			t.Errorf("part %d has attachments, they should only be on the first part", i+1)
+		}
+		words = append(words, strings.Fields(strings.TrimPrefix(part.Text, marker))...)
+	}
+	if joined := strings.Join(words, " "); joined != msg.Text {
+		t.Errorf("parts don't add up to the text, got %q", joined)
+	}
+	if len(msgs[0].Attachments) != 1 {
+		t.Errorf("expected the first part to keep the attachment")
+	}
+}
+
+func TestLimitTextLengthTruncate(t *testing.T) {
+	route := Route{Name: "test", MaxTextLength: 10, LongText: longTextTruncate}
+
+	msgs := limitTextLength(Message{Text: "hello there world"}, route)
+	if len(msgs) != 1 {
+		t.Fatalf("expected one message, got %d", len(msgs))
+	}
+	if msgs[0].Text != "hello the…" {
+		t.Errorf("unexpected truncated text %q", msgs[0].Text)
+	}
+
+	// trailing whitespace isn't left before the ellipsis
+	msgs = limitTextLength(Message{Text: "hello    there"}, route)
+	if msgs[0].Text != "hello…" {
+		t.Errorf("unexpected truncated text %q", msgs[0].Text)
+	}
+
+	// lengths are counted in characters
+	msgs = limitTextLength(Message{Text: strings.Repeat("é", 10)}, route)
+	if msgs[0].Text != strings.Repeat("é", 10) {
+		t.Errorf("text that fits shouldn't be changed, got %q", msgs[0].Text)
+	}
+}
+
+func TestLimitTextLengthUnlimited(t *testing.T) {
+	msg := Message{Text: strings.Repeat("a", 1000)}
+	msgs := limitTextLength(msg, Route{Name: "test"})
+	if len(msgs) != 1 || msgs[0].Text != msg.Text {
+		t.Errorf("text shouldn't be changed without a max text length")
+	}
+}
+
+// with a small max, the part marker for a very long text doesn't fit, which used to split forever
+func TestSplitTextMarkerDoesNotFit(t *testing.T) {
+	done := make(chan []string)
+	go func() {
+		done <- splitText(strings.Repeat("a", 200000), minSplitTextLength)
+	}()
+
+	select {
+	case parts := <-done:
+		if parts != nil {
+			t.Errorf("expected no parts when the marker doesn't fit, got %d", len(parts))
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("splitting text didn't finish")
+	}
+
+	route := Route{Name: "test", MaxTextLength: minSplitTextLength, LongText: longTextSplit}
+	msgs := limitTextLength(Message{Text: strings.Repeat("a", 200000)}, route)
+	if len(msgs) != 1 {
+		t.Fatalf("expected text that can't be split to be truncated, got %d messages", len(msgs))
+	}
+	if n := utf8.RuneCountInString(msgs[0].Text); n != minSplitTextLength {
+		t.Errorf("expected the truncated text to be %d characters, got %d", minSplitTextLength, n)
+	}
+}
+
+func TestSplitTextManyParts(t *testing.T) {
+	text := strings.Repeat("a", 5000)
+	parts := splitText(text, minSplitTextLength)
+	if parts == nil {
+		t.Fatal("expected the text to be split")
+	}
+	total := 0
+	for i, part := range parts {
+		if n := utf8.RuneCountInString(part); n > minSplitTextLength {
+			t.Fatalf("part %d is %d characters long: %q", i+1, n, part)
+		}
+		total += utf8.RuneCountInString(strings.TrimPrefix(part, partMarker(i+1, len(parts))))
+	}
+	if total != len(text) {
+		t.Errorf("parts hold %d characters, expected %d", total, len(text))
+	}
+}
+
+func TestChunkTextWidth(t *testing.T) {
+	if chunks := chunkText("abc", 0); len(chunks) != 3 {
+		t.Errorf("expected a width below one to be treated as one, got %q", chunks)
+	}
+}
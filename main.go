@@ -1,149 +1,441 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
 	"context"
-	"encoding/base64"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"log/slog"
-	"net/http"
-	"net/url"
 	"os"
+	"os/signal"
+	"slices"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/cenkalti/backoff/v4"
+	"github.com/jake-walker/matterbridge-to-webhook/pkg/bridge"
 	slogmulti "github.com/samber/slog-multi"
 	"go.opentelemetry.io/contrib/bridges/otelslog"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const name = "github.com/jake-walker/matterbridge-to-webhook"
 const logFatal = slog.Level(13)
 
+// version is set when building releases, with -ldflags "-X main.version=v1.2.3"
+var version = "dev"
+
 var (
 	meter   = otel.Meter(name)
+	tracer  = otel.Tracer(name)
 	metrics Metrics
+
+	// feature flags from the environment, which can be overridden in the config
+	defaultFeatureFlags = map[string]FeatureFlag{}
 )
 
-// message object received from matterbridge
-type Message struct {
-	Text      string `json:"text"`
-	Channel   string `json:"channel"`
-	Username  string `json:"username"`
-	Userid    string `json:"userid"`
-	Avatar    string `json:"avatar"`
-	Account   string `json:"account"`
-	Event     string `json:"event"`
-	Protocol  string `json:"protocol"`
-	Gateway   string `json:"gateway"`
-	ParentId  string `json:"parent_id"`
-	Timestamp string `json:"timestamp"`
-	Id        string `json:"id"`
-}
-
-func processMessages(webhookUrl string, messagePrefix string, c chan Message) {
-	for {
-		msg := <-c
-
-		// if a message prefix is set, and the message doesn't begin with it, stop processing
-		if messagePrefix != "" && !strings.HasPrefix(msg.Text, messagePrefix) {
-			metrics.messageDropped.Add(context.Background(), 1)
-			slog.Debug("skipping message without prefix", "message", msg)
-			continue
-		}
+// the message types are part of the library, so sinks outside of this package can use them
+type (
+	Message       = bridge.Message
+	MessageEdit   = bridge.MessageEdit
+	AccountInfo   = bridge.AccountInfo
+	Attachment    = bridge.Attachment
+	Digest        = bridge.Digest
+	DigestChannel = bridge.DigestChannel
+	Command       = bridge.Command
+)
 
-		// parse the message
-		msgBytes, err := json.Marshal([]Message{msg})
-		if err != nil {
-			metrics.processingError.Add(context.Background(), 1)
-			slog.Warn("failed to marshal message", "message", msg, slog.Any("error", err))
+// queuedMessage is a message waiting to be forwarded, along with the context it was received in so
+// the trace carries through to the webhook request
+type queuedMessage struct {
+	ctx context.Context
+	msg Message
+
+	// set when the message is an edit of a recently seen message
+	edited       bool
+	previousText string
+	// when set, the message is only offered to these routes
+	routes []string
+}
+
+// messageSpanAttributes describes a message on a span
+func messageSpanAttributes(msg Message) trace.SpanStartOption {
+	return trace.WithAttributes(
+		attribute.String("message.id", msg.Id),
+		attribute.String("message.gateway", msg.Gateway),
+		attribute.String("message.channel", msg.Channel),
+		attribute.String("message.protocol", msg.Protocol),
+	)
+}
+
+// transformer changes messages before they are routed, returning the messages to deliver instead
+type transformer interface {
+	apply(ctx context.Context, msg Message) ([]transformed, error)
+	// the feature flag gating the transform
+	flag() string
+}
+
+// transformed is a message returned by a transformer. if routes is set, the message is only
+// offered to those routes.
+type transformed struct {
+	msg    Message
+	routes []string
+}
+
+// pipeline is the sink for the bridge, which delivers messages through the routes in the latest
+// config
+type pipeline struct {
+	store      *ConfigStore
+	sched      *scheduler
+	edits      *editTracker
+	days       *dayTracker
+	flood      *floodTracker
+	transforms []transformer
+	// when set, messages are only offered to these routes
+	routes []string
+	// the pipeline messages are read for, whose routes they are offered to
+	name string
+}
+
+func newPipeline(store *ConfigStore, sched *scheduler, transforms []transformer) *pipeline {
+	return &pipeline{
+		store:      store,
+		sched:      sched,
+		edits:      newEditTracker(editTrackerSize),
+		days:       newDayTracker(),
+		flood:      newFloodTracker(),
+		transforms: transforms,
+	}
+}
+
+// Send queues the message for every route it matches, so it never fails
+func (p *pipeline) Send(ctx context.Context, msg Message) error {
+	// holding on to the message stops the sources reading any more until the routes catch up
+	backpressure.wait(ctx, p.name, p.sched.fullest)
+
+	if dedup.duplicate(msg) {
+		metrics.messageDropped.Add(ctx, 1, messageAttributes(msg, dropReasonAttribute(dropReasonDedup)))
+		slog.Debug("skipping duplicate message", "message", msg)
+		return nil
+	}
+
+	cfg, _ := p.store.Get()
+	msgs := []transformed{{msg: msg}}
+	for _, t := range p.transforms {
+		msgs = p.transform(ctx, cfg, t, msgs)
+	}
+
+	for _, m := range msgs {
+		p.send(ctx, m)
+	}
+	return nil
+}
+
+// transform runs the messages through a transformer. messages are passed on unchanged if it
+// fails, or its flag is off for them, so a broken transform doesn't lose them.
+func (p *pipeline) transform(ctx context.Context, cfg Config, t transformer, msgs []transformed) []transformed {
+	out := []transformed{}
+	for _, m := range msgs {
+		if !featureEnabled(cfg, t.flag(), Route{}, m.msg, true) {
+			out = append(out, m)
 			continue
 		}
-
-		// build a post request to the output webhook
-		req, err := http.NewRequest("POST", webhookUrl, bytes.NewBuffer(msgBytes))
+		stageStart := time.Now()
+		results, err := t.apply(ctx, m.msg)
+		recordStage(ctx, stageTransform, stageStart)
 		if err != nil {
-			metrics.processingError.Add(context.Background(), 1)
-			slog.Warn("failed to build request", "message", msg, slog.Any("error", err))
+			metrics.processingError.Add(ctx, 1, messageAttributes(m.msg, stageAttribute(stageTransform), causeAttribute(causeTransform)))
+			slog.Warn("transform failed, passing message on unchanged", "message", m.msg, "error", err)
+			out = append(out, m)
 			continue
 		}
+		if len(results) == 0 {
+			metrics.messageDropped.Add(ctx, 1, messageAttributes(m.msg, dropReasonAttribute(dropReasonFilter)))
+			slog.Debug("message dropped by transform", "message", m.msg)
+		}
 
-		req.Header.Set("Content-Type", "application/json")
+		for _, result := range results {
+			if result.msg.Source == "" {
+				result.msg.Source = m.msg.Source
+			}
+			// routes chosen by an earlier transform are kept unless they are changed
+			if result.routes == nil {
+				result.routes = m.routes
+			}
+			out = append(out, result)
+		}
+	}
+	return out
+}
 
-		// perform request to webhook
-		_, err = http.DefaultClient.Do(req)
-		if err != nil {
-			metrics.processingError.Add(context.Background(), 1)
-			slog.Warn("failed to send webhook", "message", msg, slog.Any("error", err))
-			continue
+func (p *pipeline) send(ctx context.Context, m transformed) {
+	if p.routes != nil {
+		if m.routes == nil {
+			m.routes = p.routes
+		} else {
+			// transforms can't send messages anywhere else
+			m.routes = slices.DeleteFunc(slices.Clone(m.routes), func(name string) bool {
+				return !slices.Contains(p.routes, name)
+			})
 		}
+	}
 
-		slog.Debug("forwarded message successfully")
-		metrics.messageForwarded.Add(context.Background(), 1)
+	queued := queuedMessage{ctx: ctx, msg: m.msg, routes: m.routes}
+	queued.previousText, queued.edited = p.edits.observe(queued.msg)
+
+	full, version := p.store.Get()
+	cfg := full.forPipeline(p.name)
+	if featureEnabled(cfg, flagEnrichment, Route{}, queued.msg, true) {
+		queued.msg.AccountInfo = cfg.accountInfo(queued.msg)
+	}
+	archive.received(queued.ctx, queued.msg)
+	userNames.observe(queued.msg)
+
+	// offer the message to every route in the latest config
+	p.sched.reconcile(cfg, version)
+	allowed, notice, collapsed := p.flood.check(cfg.FloodProtection, queued.msg, time.Now())
+	if !allowed {
+		metrics.messageDropped.Add(queued.ctx, 1, messageAttributes(queued.msg, dropReasonAttribute(dropReasonRateLimit)))
+		slog.Debug("skipping message over the flood protection limit", "message", queued.msg)
+		return
+	}
+	if collapsed {
+		p.sched.dispatch(queuedMessage{ctx: queued.ctx, msg: notice, routes: queued.routes}, cfg)
 	}
+	if !queued.edited {
+		if separator, ok := p.days.separator(cfg.DaySeparators, queued.msg, time.Now()); ok {
+			p.sched.dispatch(queuedMessage{ctx: queued.ctx, msg: separator, routes: queued.routes}, cfg)
+		}
+	}
+	p.sched.dispatch(queued, cfg)
 }
 
-func getMessages(apiUrl string, username string, password string, b backoff.BackOff, c chan Message) error {
-	// create a request to the matterbridge api
-	url, err := url.JoinPath(apiUrl, "/api/stream")
+// loadTransforms loads the configured transforms, returning a function to clean them up
+func loadTransforms(ctx context.Context) ([]transformer, func() error, error) {
+	transforms := []transformer{}
+	closeTransforms := func() error { return nil }
+
+	wasm, err := loadWasmTransform(ctx)
 	if err != nil {
-		return backoff.Permanent(fmt.Errorf("failed to build url: %v", err))
+		return nil, nil, err
+	}
+	if wasm != nil {
+		transforms = append(transforms, wasm)
+		closeTransforms = func() error { return wasm.close(context.Background()) }
 	}
 
-	req, err := http.NewRequest("GET", url, nil)
+	script, err := loadScriptTransform()
 	if err != nil {
-		return backoff.Permanent(fmt.Errorf("failed to build request: %v", err))
+		closeTransforms()
+		return nil, nil, err
+	}
+	if script != nil {
+		transforms = append(transforms, script)
 	}
 
-	if username != "" && password != "" {
-		req.Header.Set(
-			"Authorization",
-			fmt.Sprintf("Basic %s", base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", username, password)))),
-		)
+	return transforms, closeTransforms, nil
+}
+
+// enqueueMessage starts a trace for a received message, and sends it to the channel to get sent to
+// the webhook
+func enqueueMessage(src *source, msg Message, c chan queuedMessage) {
+	msg.Source = src.name
+	src.loadAttachments(context.Background(), &msg)
+	avatars.rewrite(context.Background(), &msg)
+	slog.Debug("received message", "message", msg)
+	diagnostics.record(msg)
+	// start a trace for the message, which is continued when it is forwarded
+	ctx, span := tracer.Start(context.Background(), "receive message", messageSpanAttributes(msg), trace.WithSpanKind(trace.SpanKindConsumer))
+	defer span.End()
+	if age, ok := messageAge(msg, time.Now()); ok {
+		span.SetAttributes(attribute.Float64("message.age_seconds", age.Seconds()))
+		metrics.messageAge.Record(ctx, age.Seconds(), messageAttributes(msg))
 	}
+	c <- queuedMessage{ctx: ctx, msg: msg}
+	metrics.messageReceived.Add(ctx, 1, messageAttributes(msg))
+}
 
-	res, err := http.DefaultClient.Do(req)
+// stream reads messages from the source's matterbridge stream, keeping its health and metrics up
+// to date. onConnect is called once the stream is connected, before any messages are read.
+func (s *source) stream(opts sourceOptions, b backoff.BackOff, onConnect func()) *bridge.StreamSource {
+	return &bridge.StreamSource{
+		Url:             s.apiUrl,
+		Token:           s.token,
+		Username:        s.username,
+		Password:        s.password,
+		Name:            s.name,
+		MaxMessageBytes: opts.maxMessageBytes,
+		IdleTimeout:     opts.idleTimeout,
+		BackOff:         b,
+		Hooks: bridge.StreamHooks{
+			Connected: func() {
+				s.health.setConnected(true)
+				onConnect()
+			},
+			Disconnected: func() {
+				s.health.setConnected(false)
+			},
+			Received: s.health.received,
+			Decoded: func(start time.Time) {
+				recordStage(context.Background(), stageRead, start)
+			},
+			Skipped: func(err error) {
+				cause := causeUnmarshal
+				if errors.Is(err, bridge.ErrLineTooLong) {
+					cause = causeTooLarge
+				}
+				metrics.processingError.Add(context.Background(), 1, metric.WithAttributes(stageAttribute(stageRead), causeAttribute(cause)))
+			},
+			Failed: func(err error) {
+				metrics.processingError.Add(context.Background(), 1, metric.WithAttributes(stageAttribute(stageRead), causeAttribute(causeStreamRead)))
+			},
+		},
+	}
+}
 
+// loadDeliveryOptions reads the webhook delivery settings from the environment
+func loadDeliveryOptions() (opts deliveryOptions, err error) {
+	if opts.commandSla, err = durationEnv("COMMAND_RESPONSE_SLA", 0); err != nil {
+		return
+	}
+	if opts.webhookToken, err = secretEnv("WEBHOOK_TOKEN"); err != nil {
+		return
+	}
+	if opts.probeInterval, err = durationEnv("CAPABILITY_PROBE_INTERVAL", 0); err != nil {
+		return
+	}
+	maxInFlight, err := intEnv("MAX_IN_FLIGHT", 0)
 	if err != nil {
-		return fmt.Errorf("failed to request messages: %v", err)
+		return
 	}
+	if maxInFlight < 0 {
+		return opts, fmt.Errorf("MAX_IN_FLIGHT must not be negative")
+	}
+	if maxInFlight > 0 {
+		opts.inFlight = make(chan struct{}, maxInFlight)
+	}
+	opts.execHook, err = loadExecHook()
+	return
+}
 
-	slog.Info("listening for messages...")
+// splitList splits a comma separated environment variable, ignoring empty items
+func splitList(v string) []string {
+	items := []string{}
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
 
-	// loop over any messages received
-	reader := bufio.NewReader(res.Body)
-	for {
-		line, err := reader.ReadBytes('\n')
+// setupConfig loads the initial routing configuration from whichever source is configured, and
+// keeps watching the source for changes if it supports it
+func setupConfig(ctx context.Context, configFile string, webhookUrl string, messagePrefix string) (*ConfigStore, error) {
+	// the configmap is the source of truth, so load it before starting and keep watching it
+	if configMapName := os.Getenv("KUBERNETES_CONFIGMAP"); configMapName != "" {
+		configMapKey := os.Getenv("KUBERNETES_CONFIGMAP_KEY")
+		if configMapKey == "" {
+			configMapKey = "config.json"
+		}
 
+		store := newConfigStore(Config{})
+		watcher, err := newConfigMapWatcher(configMapName, configMapKey, store)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up configmap watcher: %v", err)
+		}
+		resourceVersion, err := watcher.load(ctx)
 		if err != nil {
-			return fmt.Errorf("failed to read messages: %v", err)
+			return nil, err
 		}
+		go watcher.run(ctx, resourceVersion)
+		return store, nil
+	}
 
-		msg := Message{}
-		err = json.Unmarshal(line, &msg)
+	if consulKey := os.Getenv("CONSUL_KEY"); consulKey != "" {
+		consulAddr := os.Getenv("CONSUL_HTTP_ADDR")
+		if consulAddr == "" {
+			consulAddr = "http://127.0.0.1:8500"
+		}
 
+		consulToken, err := secretEnv("CONSUL_HTTP_TOKEN")
 		if err != nil {
-			metrics.processingError.Add(context.Background(), 1)
-			slog.Warn("failed to unmarshal message, skipping", "message", string(line), "error", err)
-			continue
+			return nil, err
 		}
 
-		if msg.Event != "" {
-			slog.Info(fmt.Sprintf("received %s event", msg.Event))
-			continue
+		store := newConfigStore(Config{})
+		watcher := newConsulWatcher(consulAddr, consulKey, consulToken, os.Getenv("CONSUL_CACHE_FILE"), store)
+		index, err := watcher.load(ctx)
+		if err != nil {
+			return nil, err
+		}
+		go watcher.run(ctx, index)
+		return store, nil
+	}
+
+	cfg, err := loadConfig(configFile, webhookUrl, messagePrefix, os.Getenv("COMMANDS"))
+	if err != nil {
+		return nil, err
+	}
+	store := newConfigStore(cfg)
+
+	if configFile != "" {
+		interval, err := durationEnv("CONFIG_WATCH_INTERVAL", 10*time.Second)
+		if err != nil {
+			return nil, err
 		}
+		go newConfigFileWatcher(configFile, store, interval).run(ctx)
+	}
+	return store, nil
+}
 
-		slog.Debug("received message", "message", msg)
-		// send the message to the channel to get sent to webhook
-		c <- msg
-		metrics.messageReceived.Add(context.Background(), 1)
-		// reset the backoff function if we receive a proper message
-		b.Reset()
+// secretEnv reads an environment variable which may hold a secret. if it isn't set, the value is
+// read from the file named by the variable with a _FILE suffix instead, so secrets can be mounted
+// as files.
+func secretEnv(name string) (string, error) {
+	if v := os.Getenv(name); v != "" {
+		return v, nil
+	}
+
+	path := os.Getenv(name + "_FILE")
+	if path == "" {
+		return "", nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %v", name+"_FILE", err)
 	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// durationEnv parses a duration from an environment variable, using the fallback when it isn't set
+func durationEnv(name string, fallback time.Duration) (time.Duration, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %v", strings.ToLower(name), err)
+	}
+	return d, nil
+}
+
+// intEnv parses an integer from an environment variable, using the fallback when it isn't set
+func intEnv(name string, fallback int) (int, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return fallback, nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %v", strings.ToLower(name), err)
+	}
+	return i, nil
 }
 
 func main() {
@@ -155,6 +447,36 @@ func main() {
 		}),
 	)))
 
+	// subcommands are tools for setting up and looking after the bridge, rather than running it
+	if len(os.Args) > 1 {
+		var err error
+		switch os.Args[1] {
+		case "--version", "-version":
+			fmt.Println(versionString())
+		case "migrate":
+			err = runMigrate(os.Args[2:], os.Stdout)
+		case "routes":
+			err = runRoutes(os.Args[2:], os.Stdout)
+		case "replay":
+			err = runReplay(os.Args[2:])
+		case "backfill":
+			err = runBackfill(os.Args[2:])
+		case "self-update":
+			err = runSelfUpdate(os.Args[2:])
+		case "healthcheck":
+			err = runHealthcheck(os.Args[2:])
+		case "validate":
+			err = runValidate(os.Args[2:], os.Stdout)
+		default:
+			err = fmt.Errorf("unknown command: %s", os.Args[1])
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	if err := run(); err != nil {
 		slog.Log(context.Background(), logFatal, "failed to run", "error", err)
 		os.Exit(1)
@@ -172,19 +494,118 @@ func init() {
 }
 
 func run() (err error) {
-	apiUrl := os.Getenv("MATTERBRIDGE_API_URL")
-	username := os.Getenv("MATTERBRIDGE_API_USERNAME")
-	password := os.Getenv("MATTERBRIDGE_API_PASSWORD")
-	webhookUrl := os.Getenv("WEBHOOK_URL")
+	webhookUrl, err := secretEnv("WEBHOOK_URL")
+	if err != nil {
+		return err
+	}
 	messagePrefix := os.Getenv("MESSAGE_PREFIX")
+	configFile := os.Getenv("CONFIG_FILE")
 	enableTelemetry := os.Getenv("ENABLE_TELEMETRY") == "yes"
+	adminAddr := os.Getenv("ADMIN_ADDR")
+	adminToken, err := secretEnv("ADMIN_TOKEN")
+	if err != nil {
+		return err
+	}
+	enablePprof := os.Getenv("ENABLE_PPROF") == "yes"
+	diagnosticsDir := os.Getenv("DIAGNOSTICS_DIR")
 
-	if apiUrl == "" || webhookUrl == "" {
+	sources, err := loadSources()
+	if err != nil {
+		return err
+	}
+	receipts.enable(sources)
+
+	if webhookUrl == "" && configFile == "" && os.Getenv("KUBERNETES_CONFIGMAP") == "" && os.Getenv("CONSUL_KEY") == "" && os.Getenv("COMMANDS") == "" {
 		err = errors.Join(err, fmt.Errorf("the api and webhook urls must be set"))
 		return
 	}
 
-	ctx := context.Background()
+	// stopping the process cancels the context, so the bridge stops reading and everything is
+	// cleaned up on the way out
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	store, err := setupConfig(ctx, configFile, webhookUrl, messagePrefix)
+	if err != nil {
+		return err
+	}
+
+	// limit the gateways and channels metrics are broken down by
+	maxAttributeValues, err := intEnv("METRICS_MAX_ATTRIBUTE_VALUES", 50)
+	if err != nil {
+		return err
+	}
+	gatewayGuard = newAttributeGuard(splitList(os.Getenv("METRICS_GATEWAY_ALLOWLIST")), maxAttributeValues)
+	channelGuard = newAttributeGuard(splitList(os.Getenv("METRICS_CHANNEL_ALLOWLIST")), maxAttributeValues)
+
+	defaultFeatureFlags, err = parseFeatureFlags(os.Getenv("FEATURE_FLAGS"))
+	if err != nil {
+		return err
+	}
+
+	opts := sourceOptions{
+		transport:     os.Getenv("SOURCE_TRANSPORT"),
+		replayOnStart: os.Getenv("REPLAY_ON_START") == "yes",
+	}
+	switch opts.transport {
+	case "":
+		opts.transport = "stream"
+	case "stream", "poll", "websocket":
+	default:
+		return fmt.Errorf("unknown source transport: %s", opts.transport)
+	}
+
+	if opts.idleTimeout, err = durationEnv("STREAM_IDLE_TIMEOUT", 0); err != nil {
+		return err
+	}
+	if opts.maxMessageBytes, err = intEnv("STREAM_MAX_MESSAGE_BYTES", bridge.DefaultMaxMessageBytes); err != nil {
+		return err
+	}
+	if opts.maxMessageBytes <= 0 {
+		return fmt.Errorf("STREAM_MAX_MESSAGE_BYTES must be positive")
+	}
+	if opts.pollInterval, err = durationEnv("POLL_INTERVAL", 5*time.Second); err != nil {
+		return err
+	}
+	if opts.pingInterval, err = durationEnv("WEBSOCKET_PING_INTERVAL", 30*time.Second); err != nil {
+		return err
+	}
+	if opts.replayMaxMessages, err = intEnv("REPLAY_MAX_MESSAGES", 100); err != nil {
+		return err
+	}
+	if opts.replayMaxAge, err = durationEnv("REPLAY_MAX_AGE", 0); err != nil {
+		return err
+	}
+	if opts.maxMessageAge, err = durationEnv("MAX_MESSAGE_AGE", 0); err != nil {
+		return err
+	}
+
+	deliveryOpts, err := loadDeliveryOptions()
+	if err != nil {
+		return err
+	}
+	if clockSkewTolerance, err = durationEnv("CLOCK_SKEW_TOLERANCE", 0); err != nil {
+		return err
+	}
+	if attachments, err = loadAttachmentOptions(); err != nil {
+		return err
+	}
+
+	if proxyUrl, err := secretEnv("OUTBOUND_PROXY"); err != nil {
+		return err
+	} else if proxyUrl != "" {
+		if err := setupProxy(proxyUrl, os.Getenv("PROXY_FALLBACK_DIRECT") == "yes"); err != nil {
+			return err
+		}
+	}
+
+	// find typos in webhook urls before the first message fails to be delivered
+	if mode := os.Getenv("STARTUP_CHECK"); mode != "" {
+		cfg, _ := store.Get()
+		if err := startupCheck(ctx, cfg, mode, deliveryOpts); err != nil {
+			return err
+		}
+	}
 
 	// initialize opentelemetry sdk
 	if enableTelemetry {
@@ -198,22 +619,178 @@ func run() (err error) {
 		}()
 	}
 
-	messages := make(chan Message)
+	if enablePprof && adminAddr == "" {
+		return fmt.Errorf("the admin address must be set to enable pprof")
+	}
+	if enablePprof && adminToken == "" {
+		return fmt.Errorf("the admin token must be set to enable pprof")
+	}
 
-	// start processing messages from the channel in the background
-	go processMessages(webhookUrl, messagePrefix, messages)
+	// keep copies of avatars, for receivers that can't load the original urls
+	if avatarMode := os.Getenv("AVATARS"); avatarMode != "" {
+		if avatarMode == avatarsProxy && adminAddr == "" {
+			return fmt.Errorf("the admin address must be set to proxy avatars")
+		}
+		size, err := intEnv("AVATAR_CACHE_SIZE", defaultAvatarCacheSize)
+		if err != nil {
+			return err
+		}
+		ttl, err := durationEnv("AVATAR_CACHE_TTL", defaultAvatarCacheTtl)
+		if err != nil {
+			return err
+		}
+		if err := avatars.enable(avatarMode, os.Getenv("AVATAR_BASE_URL"), size, ttl); err != nil {
+			return err
+		}
+	}
 
-	b := backoff.NewExponentialBackOff()
+	// start the admin server for the config and queue apis and debugging endpoints
+	if adminAddr != "" {
+		adminShutdown := startAdminServer(adminAddr, adminToken, enablePprof, store)
+		defer func() {
+			err = errors.Join(err, adminShutdown(context.Background()))
+		}()
+	}
 
-	// retry loop for listening for messages from matterbridge
-	backoffErr := backoff.RetryNotify(func() error {
-		return getMessages(apiUrl, username, password, b, messages)
-	}, b, func(err error, d time.Duration) {
-		slog.Warn("get messages failed", "error", err, "retry", d.String())
-	})
+	// write diagnostic bundles on panics and SIGQUIT
+	if diagnosticsDir != "" {
+		diagnostics.enable(diagnosticsDir, store)
+		defer diagnostics.recoverPanic()
+	}
 
-	if backoffErr != nil {
-		err = errors.Join(err, fmt.Errorf("failed to get messages: %v", backoffErr))
+	// keep a copy of messages on disk for auditing
+	if archiveDir := os.Getenv("ARCHIVE_DIR"); archiveDir != "" {
+		mode := os.Getenv("ARCHIVE_MESSAGES")
+		if mode == "" {
+			mode = archiveAll
+		}
+		maxBytes, err := intEnv("ARCHIVE_MAX_BYTES", defaultArchiveMaxBytes)
+		if err != nil {
+			return err
+		}
+		maxAge, err := durationEnv("ARCHIVE_MAX_AGE", defaultArchiveMaxAge)
+		if err != nil {
+			return err
+		}
+		if err := archive.enable(archiveDir, mode, maxBytes, maxAge); err != nil {
+			return err
+		}
+		defer func() {
+			err = errors.Join(err, archive.close())
+		}()
+	}
+
+	// keep counter totals across restarts
+	if lifetimeFile := os.Getenv("METRICS_LIFETIME_FILE"); lifetimeFile != "" {
+		interval, err := durationEnv("METRICS_LIFETIME_SAVE_INTERVAL", time.Minute)
+		if err != nil {
+			return err
+		}
+		if err := lifetime.enable(meter, lifetimeFile, interval); err != nil {
+			return err
+		}
+		defer func() {
+			err = errors.Join(err, lifetime.close())
+		}()
+	}
+
+	// suppress messages matterbridge sends more than once, remembering them across restarts if
+	// there is a file to keep them in
+	dedupFile := os.Getenv("DEDUP_FILE")
+	if os.Getenv("DEDUP") == "yes" || dedupFile != "" {
+		size, err := intEnv("DEDUP_SIZE", defaultDedupSize)
+		if err != nil {
+			return err
+		}
+		if err := dedup.enable(size, dedupFile); err != nil {
+			return err
+		}
+		defer func() {
+			err = errors.Join(err, dedup.close())
+		}()
 	}
+
+	// stop reading from matterbridge while the route queues are too full, instead of dropping
+	// messages once they fill up
+	if os.Getenv("BACKPRESSURE") == "yes" {
+		high, err := intEnv("BACKPRESSURE_HIGH_WATER", defaultBackpressureHigh)
+		if err != nil {
+			return err
+		}
+		low, err := intEnv("BACKPRESSURE_LOW_WATER", defaultBackpressureLow)
+		if err != nil {
+			return err
+		}
+		if err := backpressure.enable(high, low, ctx.Done()); err != nil {
+			return err
+		}
+	}
+
+	// keep the health report in a file for container health checks
+	if path := os.Getenv("HEALTH_FILE"); path != "" {
+		if err := healthFile.enable(path); err != nil {
+			return err
+		}
+		defer func() {
+			err = errors.Join(err, healthFile.close())
+		}()
+	}
+
+	// tell systemd when the streams are connected, and keep its watchdog happy while they stay up
+	if err := systemd.enable(); err != nil {
+		return err
+	}
+	defer func() {
+		err = errors.Join(err, systemd.close())
+	}()
+
+	// read from every matterbridge instance into the shared pipeline, stopping if any of them
+	// fails for good. with pipelines in the config, each has its own bridge instead.
+	transforms, closeTransforms, err := loadTransforms(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = errors.Join(err, closeTransforms())
+	}()
+
+	if cfg, _ := store.Get(); len(cfg.Pipelines) > 0 {
+		if pipelinesErr := runPipelines(ctx, cfg.Pipelines, sources, opts, store, deliveryOpts, transforms); pipelinesErr != nil && ctx.Err() == nil {
+			err = errors.Join(err, pipelinesErr)
+		}
+		stopping(ctx)
+		return
+	}
+
+	// the queued messages are delivered before the bridge stops
+	sched := newScheduler(deliveryOpts)
+	defer sched.shutdown()
+
+	b := &bridge.Bridge{Sinks: []bridge.Sink{newPipeline(store, sched, transforms)}}
+	if opts.maxMessageAge > 0 {
+		b.Filters = append(b.Filters, staleFilter{maxAge: opts.maxMessageAge})
+	}
+	if filter := loadListFilter(); filter.enabled() {
+		b.Filters = append(b.Filters, filter)
+	}
+	for _, src := range sources {
+		b.Sources = append(b.Sources, &sourceReader{src: src, opts: opts})
+	}
+
+	// the bridge stopping because the process was asked to isn't an error
+	if bridgeErr := b.Run(ctx); bridgeErr != nil && ctx.Err() == nil {
+		err = errors.Join(err, bridgeErr)
+	}
+	stopping(ctx)
 	return
 }
+
+// stopping tells systemd the bridge is shutting down, if it was asked to stop
+func stopping(ctx context.Context) {
+	if ctx.Err() == nil {
+		return
+	}
+	slog.Info("shutting down...")
+	// any error is returned again when it is closed on the way out
+	_ = systemd.close()
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+)
+
+func TestMain(m *testing.M) {
+	// metrics go nowhere, but have to exist for messages to be handled
+	var err error
+	if metrics, err = initMetrics(otel.Meter(name)); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// matterbridgeConfig is the part of a matterbridge toml config needed to read from its api
+// accounts
+type matterbridgeConfig struct {
+	Api     map[string]matterbridgeApi `toml:"api"`
+	Gateway []matterbridgeGateway      `toml:"gateway"`
+}
+
+type matterbridgeApi struct {
+	BindAddress string
+	Token       string
+}
+
+type matterbridgeGateway struct {
+	Name   string
+	Enable bool
+	InOut  []matterbridgeAccount `toml:"inout"`
+	Out    []matterbridgeAccount `toml:"out"`
+}
+
+type matterbridgeAccount struct {
+	Account string
+	Channel string
+}
+
+// runMigrate reads a matterbridge config and writes the environment variables for reading from
+// each of its api accounts
+func runMigrate(args []string, out io.Writer) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: matterbridge-to-webhook migrate <matterbridge.toml>")
+	}
+
+	data, err := os.ReadFile(args[0])
+	if err != nil {
+		return fmt.Errorf("failed to read matterbridge config: %v", err)
+	}
+
+	cfg := matterbridgeConfig{}
+	if err := toml.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("failed to parse matterbridge config: %v", err)
+	}
+	if len(cfg.Api) == 0 {
+		return fmt.Errorf("no api accounts found in %s, add an [api.<name>] section to matterbridge first", args[0])
+	}
+
+	names := make([]string, 0, len(cfg.Api))
+	for name := range cfg.Api {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(out, "# generated from %s\n", args[0])
+	if len(names) > 1 {
+		fmt.Fprintf(out, "MATTERBRIDGE_SOURCES=%s\n", strings.Join(names, ","))
+	}
+
+	for _, name := range names {
+		api := cfg.Api[name]
+		prefix := "MATTERBRIDGE_"
+		if len(names) > 1 {
+			prefix += strings.ToUpper(name) + "_"
+		}
+
+		fmt.Fprintln(out)
+		fmt.Fprintf(out, "# api.%s", name)
+		if gateways := cfg.gatewaysFor("api." + name); len(gateways) > 0 {
+			fmt.Fprintf(out, " (gateways: %s)", strings.Join(gateways, ", "))
+		} else {
+			fmt.Fprint(out, ", not in any enabled gateway so no messages will be received")
+		}
+		fmt.Fprintln(out)
+		fmt.Fprintf(out, "%sAPI_URL=%s\n", prefix, apiUrlFromBindAddress(api.BindAddress))
+		if api.Token != "" {
+			fmt.Fprintf(out, "%sAPI_TOKEN=%s\n", prefix, api.Token)
+		}
+	}
+
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "# where messages are sent, or set CONFIG_FILE for more than one destination")
+	fmt.Fprintln(out, "WEBHOOK_URL=")
+	return nil
+}
+
+// gatewaysFor returns the names of the enabled gateways that send messages to the account
+func (c matterbridgeConfig) gatewaysFor(account string) []string {
+	gateways := []string{}
+	for _, gateway := range c.Gateway {
+		if !gateway.Enable {
+			continue
+		}
+		// the api only sees messages from gateways where it is an output
+		accounts := append(slices.Clone(gateway.InOut), gateway.Out...)
+		if slices.ContainsFunc(accounts, func(a matterbridgeAccount) bool { return a.Account == account }) {
+			gateways = append(gateways, gateway.Name)
+		}
+	}
+	return gateways
+}
+
+// apiUrlFromBindAddress turns the address matterbridge listens on into a url to connect to it.
+// listening on every interface is assumed to mean matterbridge is on the same machine.
+func apiUrlFromBindAddress(bindAddress string) string {
+	host, port, err := net.SplitHostPort(bindAddress)
+	if err != nil {
+		return "http://" + bindAddress
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	return "http://" + net.JoinHostPort(host, port)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// mqttPublishTimeout is how long a publish can wait for the broker before it is retried
+const mqttPublishTimeout = 10 * time.Second
+
+// MqttDestination publishes messages to an mqtt topic instead of posting them to a webhook
+type MqttDestination struct {
+	// the broker, such as tcp://broker:1883 or ssl://broker:8883. a username and password can be
+	// included.
+	Url string `json:"url"`
+	// a template for the topic, such as chat/{{.Gateway}}/{{.Channel}}
+	Topic string `json:"topic"`
+	// the quality of service level, defaulting to 1 so the broker acknowledges every message
+	QoS *int `json:"qos,omitempty"`
+	// ask the broker to keep the last message on each topic for new subscribers
+	Retained bool   `json:"retained,omitempty"`
+	ClientId string `json:"client_id,omitempty"`
+	Username string `json:"username,omitempty"`
+	// read from a file, so the password doesn't have to be in the config
+	PasswordFile string    `json:"password_file,omitempty"`
+	Tls          TlsConfig `json:"tls,omitempty"`
+}
+
+// mqttDestination publishes each message to the topic rendered for it
+type mqttDestination struct {
+	client  mqtt.Client
+	connect mqtt.Token
+	topic   *topicTemplate
+	qos     byte
+	retain  bool
+}
+
+func (m MqttDestination) validate() error {
+	if _, err := url.ParseRequestURI(m.Url); err != nil {
+		return fmt.Errorf("invalid mqtt url: %v", err)
+	}
+	if _, err := parseMqttTopicTemplate(m.Topic); err != nil {
+		return err
+	}
+	if m.QoS != nil && (*m.QoS < 0 || *m.QoS > 2) {
+		return fmt.Errorf("the qos must be 0, 1 or 2")
+	}
+	return m.Tls.validate()
+}
+
+// parseMqttTopicTemplate parses a topic template, keeping values from adding levels or wildcards
+func parseMqttTopicTemplate(topic string) (*topicTemplate, error) {
+	return parseTopicTemplate(topic, "/", "+", "#", "\x00")
+}
+
+// newMqttDestination connects to the broker. the connection is retried in the background, so the
+// broker doesn't need to be up yet.
+func newMqttDestination(route Route) (*mqttDestination, error) {
+	cfg := *route.Mqtt
+	topic, err := parseMqttTopicTemplate(cfg.Topic)
+	if err != nil {
+		return nil, err
+	}
+
+	options := mqtt.NewClientOptions().
+		AddBroker(cfg.Url).
+		SetConnectRetry(true).
+		SetAutoReconnect(true).
+		SetOrderMatters(false)
+
+	clientId := cfg.ClientId
+	if clientId == "" {
+		hostname, _ := os.Hostname()
+		clientId = fmt.Sprintf("matterbridge-to-webhook-%s-%s", hostname, route.Name)
+	}
+	options.SetClientID(clientId)
+
+	if cfg.Username != "" {
+		options.SetUsername(cfg.Username)
+	}
+	if cfg.PasswordFile != "" {
+		password, err := os.ReadFile(cfg.PasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read mqtt password: %v", err)
+		}
+		options.SetPassword(strings.TrimRight(string(password), "\r\n"))
+	}
+
+	tlsConfig, err := cfg.Tls.config()
+	if err != nil {
+		return nil, err
+	}
+	options.SetTLSConfig(tlsConfig)
+	if outboundDialer != nil {
+		options.SetCustomOpenConnectionFn(func(uri *url.URL, options mqtt.ClientOptions) (net.Conn, error) {
+			return dialMqtt(uri, options.TLSConfig)
+		})
+	}
+
+	qos := 1
+	if cfg.QoS != nil {
+		qos = *cfg.QoS
+	}
+
+	client := mqtt.NewClient(options)
+	return &mqttDestination{client: client, connect: client.Connect(), topic: topic, qos: byte(qos), retain: cfg.Retained}, nil
+}
+
+// dialMqtt opens a connection to the broker through the outbound proxy
+func dialMqtt(uri *url.URL, tlsConfig *tls.Config) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	switch uri.Scheme {
+	case "tcp", "mqtt":
+		return outboundDialer.DialContext(ctx, "tcp", uri.Host)
+	case "ssl", "tls", "mqtts", "tcps":
+		conn, err := outboundDialer.DialContext(ctx, "tcp", uri.Host)
+		if err != nil {
+			return nil, err
+		}
+		cfg := tlsConfig.Clone()
+		if cfg.ServerName == "" {
+			cfg.ServerName = uri.Hostname()
+		}
+		tlsConn := tls.Client(conn, cfg)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	default:
+		return nil, fmt.Errorf("mqtt over %s can't be used with an outbound proxy", uri.Scheme)
+	}
+}
+
+func (d *mqttDestination) deliver(ctx context.Context, cfg Config, route Route, opts deliveryOptions, msgs []Message, body []byte, contentType string) error {
+	topic, err := d.topic.render(msgs[0])
+	if err != nil {
+		return backoff.Permanent(err)
+	}
+
+	timeout := time.After(mqttPublishTimeout)
+	start := time.Now()
+	defer recordStage(ctx, stageDeliver, start)
+
+	// messages published while disconnected are only sent once the client reconnects, so fail and
+	// retry later instead. the first connection is waited for, as messages can arrive before it.
+	select {
+	case <-d.connect.Done():
+	case <-timeout:
+	case <-ctx.Done():
+	}
+	if !d.client.IsConnectionOpen() {
+		return fmt.Errorf("not connected to the mqtt broker")
+	}
+
+	token := d.client.Publish(topic, d.qos, d.retain, body)
+	select {
+	case <-token.Done():
+		err = token.Error()
+	case <-timeout:
+		err = fmt.Errorf("timed out waiting for the broker")
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to publish to mqtt: %v", err)
+	}
+	return nil
+}
+
+func (d *mqttDestination) close() {
+	d.client.Disconnect(250)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// natsPublishTimeout is how long a publish can wait for the server before it is retried
+const natsPublishTimeout = 10 * time.Second
+
+// NatsDestination publishes messages to a nats subject instead of posting them to a webhook
+type NatsDestination struct {
+	Url string `json:"url"`
+	// a template for the subject, such as chat.{{.Gateway}}.{{.Channel}}
+	Subject string `json:"subject"`
+	// publish with jetstream, waiting for a stream to store each message
+	JetStream bool `json:"jetstream,omitempty"`
+	// a credentials file, for servers using decentralized authentication
+	CredentialsFile string `json:"credentials_file,omitempty"`
+}
+
+// natsDestination publishes each message to the subject rendered for it
+type natsDestination struct {
+	conn    *nats.Conn
+	js      jetstream.JetStream
+	subject *topicTemplate
+}
+
+// natsDialer opens nats connections through the outbound proxy
+type natsDialer struct {
+	proxy *proxyDialer
+}
+
+func (d natsDialer) Dial(network string, address string) (net.Conn, error) {
+	return d.proxy.DialContext(context.Background(), network, address)
+}
+
+func (n NatsDestination) validate() error {
+	if n.Url == "" {
+		return fmt.Errorf("a nats url is required")
+	}
+	if _, err := parseSubjectTemplate(n.Subject); err != nil {
+		return err
+	}
+	return nil
+}
+
+// parseSubjectTemplate parses a subject template, keeping values from adding tokens or wildcards
+func parseSubjectTemplate(subject string) (*topicTemplate, error) {
+	return parseTopicTemplate(subject, ".", "*", ">")
+}
+
+// newNatsDestination connects to the nats server. the connection is retried in the background, so
+// the server doesn't need to be up yet.
+func newNatsDestination(cfg NatsDestination) (*natsDestination, error) {
+	subject, err := parseSubjectTemplate(cfg.Subject)
+	if err != nil {
+		return nil, err
+	}
+
+	options := []nats.Option{
+		nats.Name("matterbridge-to-webhook"),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+	}
+	if cfg.CredentialsFile != "" {
+		options = append(options, nats.UserCredentials(cfg.CredentialsFile))
+	}
+	if outboundDialer != nil {
+		options = append(options, nats.SetCustomDialer(natsDialer{proxy: outboundDialer}))
+	}
+
+	conn, err := nats.Connect(cfg.Url, options...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to nats: %v", err)
+	}
+
+	d := &natsDestination{conn: conn, subject: subject}
+	if cfg.JetStream {
+		if d.js, err = jetstream.New(conn); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to set up jetstream: %v", err)
+		}
+	}
+	return d, nil
+}
+
+func (d *natsDestination) deliver(ctx context.Context, cfg Config, route Route, opts deliveryOptions, msgs []Message, body []byte, contentType string) error {
+	msg := msgs[0]
+	subject, err := d.subject.render(msg)
+	if err != nil {
+		return backoff.Permanent(err)
+	}
+
+	m := nats.NewMsg(subject)
+	m.Data = body
+	m.Header.Set("Content-Type", contentType)
+	// pass the trace on to subscribers so they can continue it
+	if featureEnabled(cfg, flagPropagateTraceContext, route, msg, true) {
+		otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(http.Header(m.Header)))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, natsPublishTimeout)
+	defer cancel()
+
+	start := time.Now()
+	if d.js != nil {
+		_, err = d.js.PublishMsg(ctx, m)
+	} else if err = d.conn.PublishMsg(m); err == nil {
+		// plain nats doesn't acknowledge messages, so flush to at least know the server has it
+		err = d.conn.FlushWithContext(ctx)
+	}
+	recordStage(ctx, stageDeliver, start)
+	if errors.Is(err, nats.ErrMaxPayload) || errors.Is(err, nats.ErrBadSubject) {
+		return backoff.Permanent(fmt.Errorf("failed to publish to nats: %v", err))
+	} else if err != nil {
+		return fmt.Errorf("failed to publish to nats: %v", err)
+	}
+	return nil
+}
+
+func (d *natsDestination) close() {
+	d.conn.Close()
+}
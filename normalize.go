@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// the steps text can be normalized with before it is delivered
+const (
+	// discord mentions like <@123> are replaced with the names of the users
+	normalizeDiscordMentions = "discord_mentions"
+	// discord custom emoji like <:party:123> are replaced with their :name:
+	normalizeDiscordEmoji = "discord_emoji"
+	// irc bold, colour and other formatting codes are removed
+	normalizeIrcFormatting = "irc_formatting"
+	// markdown formatting is removed, leaving plain text
+	normalizeMarkdown = "markdown"
+)
+
+// normalizers rewrite the text of a message, by step
+var normalizers = map[string]func(msg Message, text string) string{
+	normalizeDiscordMentions: discordMentionsToNames,
+	normalizeDiscordEmoji:    discordEmojiToNames,
+	normalizeIrcFormatting:   stripIrcFormatting,
+	normalizeMarkdown:        markdownToPlainText,
+}
+
+// validateNormalize checks a route's normalization steps are all known
+func validateNormalize(steps []string) error {
+	for _, step := range steps {
+		if _, ok := normalizers[step]; !ok {
+			return fmt.Errorf("unknown step %s", step)
+		}
+	}
+	return nil
+}
+
+// normalizeDelivery runs the text of a queued message, and of the message before it was edited,
+// through the route's normalization steps in order
+func normalizeDelivery(d delivery, steps []string) delivery {
+	for _, step := range steps {
+		normalize := normalizers[step]
+		d.msg.Text = normalize(d.msg, d.msg.Text)
+		if d.edited {
+			d.previousText = normalize(d.msg, d.previousText)
+		}
+	}
+	return d
+}
+
+var (
+	discordMentionPattern = regexp.MustCompile(`<@!?(\d+)>`)
+	discordRolePattern    = regexp.MustCompile(`<@&\d+>`)
+	discordChannelPattern = regexp.MustCompile(`<#\d+>`)
+	discordEmojiPattern   = regexp.MustCompile(`<a?:(\w+):\d+>`)
+)
+
+// discordMentionsToNames replaces mentions of users with their names, for the users seen sending
+// messages on the same account. roles and channels can't be looked up, so are left generic.
+func discordMentionsToNames(msg Message, text string) string {
+	text = discordMentionPattern.ReplaceAllStringFunc(text, func(mention string) string {
+		id := discordMentionPattern.FindStringSubmatch(mention)[1]
+		if name, ok := userNames.name(msg.Account, id); ok {
+			return "@" + name
+		}
+		return "@unknown-user"
+	})
+	text = discordRolePattern.ReplaceAllString(text, "@role")
+	return discordChannelPattern.ReplaceAllString(text, "#channel")
+}
+
+func discordEmojiToNames(msg Message, text string) string {
+	return discordEmojiPattern.ReplaceAllString(text, ":$1:")
+}
+
+var ircFormattingPattern = regexp.MustCompile("\x03(\\d{1,2}(,\\d{1,2})?)?|\x04([0-9a-fA-F]{6}(,[0-9a-fA-F]{6})?)?|[\x02\x0f\x11\x16\x1d\x1e\x1f]")
+
+func stripIrcFormatting(msg Message, text string) string {
+	return ircFormattingPattern.ReplaceAllString(text, "")
+}
+
+// markdown patterns, in the order they are removed
+var markdownPatterns = []struct {
+	pattern *regexp.Regexp
+	replace string
+}{
+	{regexp.MustCompile("(?s)```[a-zA-Z0-9_+-]*\n?(.*?)\n?```"), "$1"},
+	{regexp.MustCompile("`([^`\n]+)`"), "$1"},
+	{regexp.MustCompile(`!?\[([^\]\n]*)\]\(([^)\s]+)\)`), "$1 ($2)"},
+	{regexp.MustCompile(`\*\*([^*\n]+)\*\*`), "$1"},
+	{regexp.MustCompile(`__([^_\n]+)__`), "$1"},
+	{regexp.MustCompile(`~~([^~\n]+)~~`), "$1"},
+	{regexp.MustCompile(`\|\|([^|\n]+)\|\|`), "$1"},
+	{regexp.MustCompile(`(^|[\s(])\*([^*\s][^*\n]*)\*`), "$1$2"},
+	{regexp.MustCompile(`(^|[\s(])_([^_\s][^_\n]*)_`), "$1$2"},
+	{regexp.MustCompile(`(?m)^#{1,6}\s+`), ""},
+	{regexp.MustCompile(`(?m)^>\s?`), ""},
+}
+
+// markdownToPlainText removes the common markdown formatting, keeping the text of links with
+// their urls
+func markdownToPlainText(msg Message, text string) string {
+	for _, p := range markdownPatterns {
+		text = p.pattern.ReplaceAllString(text, p.replace)
+	}
+	return text
+}
+
+// userNamesSize is how many users are remembered before starting again
+const userNamesSize = 10000
+
+var userNames = &userDirectory{names: map[string]string{}}
+
+// userDirectory remembers the names of users seen sending messages, so mentions of them by id can
+// be shown by name
+type userDirectory struct {
+	mu    sync.Mutex
+	names map[string]string
+}
+
+func (d *userDirectory) observe(msg Message) {
+	if msg.Userid == "" || msg.Username == "" {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.names) >= userNamesSize {
+		clear(d.names)
+	}
+	// user ids are only unique within an account
+	d.names[msg.Account+"/"+msg.Userid] = strings.TrimSpace(msg.Username)
+}
+
+func (d *userDirectory) name(account string, id string) (string, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	name, ok := d.names[account+"/"+id]
+	return name, ok
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/jake-walker/matterbridge-to-webhook/pkg/bridge"
+)
+
+// Pipeline is an independent bridge run in the same process as others, with its own sources,
+// filters and routes. a pipeline's routes are named after it, like team-a/deploy, so their queues
+// and metrics are kept apart from other pipelines.
+type Pipeline struct {
+	Name string `json:"name"`
+	// the matterbridge instances the pipeline reads from, by their names in MATTERBRIDGE_SOURCES
+	Sources []string `json:"sources"`
+	// channels and gateways the pipeline's messages are limited to, as with CHANNELS_ALLOW etc.
+	AllowChannels []string `json:"allow_channels,omitempty"`
+	DenyChannels  []string `json:"deny_channels,omitempty"`
+	AllowGateways []string `json:"allow_gateways,omitempty"`
+	DenyGateways  []string `json:"deny_gateways,omitempty"`
+
+	Routes          []Route                `json:"routes"`
+	Priority        Priority               `json:"priority,omitempty"`
+	Accounts        map[string]AccountInfo `json:"accounts,omitempty"`
+	DaySeparators   DaySeparators          `json:"day_separators,omitempty"`
+	FloodProtection FloodProtection        `json:"flood_protection,omitempty"`
+}
+
+func (p Pipeline) validate() error {
+	if p.Name == "" || strings.Contains(p.Name, "/") {
+		return fmt.Errorf("pipelines must have a name without a /")
+	}
+	if len(p.Sources) == 0 {
+		return fmt.Errorf("pipeline %s must read from at least one source", p.Name)
+	}
+	if len(p.Routes) == 0 {
+		return fmt.Errorf("pipeline %s must have at least one route", p.Name)
+	}
+	for i, route := range p.Routes {
+		if route.Name == "" {
+			return fmt.Errorf("route %d of pipeline %s must have a name", i, p.Name)
+		}
+	}
+	if _, err := p.DaySeparators.location(); err != nil {
+		return fmt.Errorf("pipeline %s: %v", p.Name, err)
+	}
+	if err := p.FloodProtection.validate(); err != nil {
+		return fmt.Errorf("pipeline %s: %v", p.Name, err)
+	}
+	return nil
+}
+
+// routes returns the pipeline's routes, named after the pipeline
+func (p Pipeline) routes() []Route {
+	routes := make([]Route, len(p.Routes))
+	for i, route := range p.Routes {
+		route.Name = p.Name + "/" + route.Name
+		routes[i] = route
+	}
+	return routes
+}
+
+func (p Pipeline) filter() listFilter {
+	return listFilter{
+		allowChannels: p.AllowChannels,
+		denyChannels:  p.DenyChannels,
+		allowGateways: p.AllowGateways,
+		denyGateways:  p.DenyGateways,
+	}
+}
+
+// allRoutes returns the routes of the config and of every pipeline in it
+func (c Config) allRoutes() []Route {
+	routes := slices.Clone(c.Routes)
+	for _, p := range c.Pipelines {
+		routes = append(routes, p.routes()...)
+	}
+	return routes
+}
+
+// forPipeline returns the config messages read by a pipeline are delivered with, which only has
+// its routes. without a name, it has the routes of every pipeline, for messages that aren't read
+// from matterbridge, like replays.
+func (c Config) forPipeline(name string) Config {
+	if name == "" {
+		cfg := c
+		cfg.Routes = c.allRoutes()
+		cfg.Pipelines = nil
+		return cfg
+	}
+	for _, p := range c.Pipelines {
+		if p.Name == name {
+			return Config{
+				Routes:          p.routes(),
+				Features:        c.Features,
+				Priority:        p.Priority,
+				Accounts:        p.Accounts,
+				DaySeparators:   p.DaySeparators,
+				FloodProtection: p.FloodProtection,
+			}
+		}
+	}
+	// the pipeline was removed from the config, so its messages have nowhere to go until restarted
+	return Config{Features: c.Features}
+}
+
+// runPipelines runs a bridge for each pipeline, reading from its sources into its routes. the
+// pipelines are set up when the bridge starts. a pipeline that fails for good, or panics, is
+// stopped without stopping the others.
+func runPipelines(ctx context.Context, pipelines []Pipeline, sources []*source, opts sourceOptions, store *ConfigStore, delivery deliveryOptions, transforms []transformer) error {
+	byName := map[string]*source{}
+	for _, src := range sources {
+		byName[src.name] = src
+	}
+
+	// the pipeline reading each source
+	readBy := map[string]string{}
+	for _, p := range pipelines {
+		for _, name := range p.Sources {
+			if _, ok := byName[name]; !ok {
+				return fmt.Errorf("pipeline %s reads from unknown source %s", p.Name, name)
+			}
+			if other, ok := readBy[name]; ok {
+				return fmt.Errorf("source %s is read by both pipelines %s and %s", name, other, p.Name)
+			}
+			readBy[name] = p.Name
+		}
+	}
+	for name := range byName {
+		if _, ok := readBy[name]; !ok {
+			slog.Warn("source isn't read by any pipeline", "source", name)
+		}
+	}
+
+	errs := make([]error, len(pipelines))
+	var wg sync.WaitGroup
+	for i, p := range pipelines {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = runPipeline(ctx, p, byName, opts, store, delivery, transforms)
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// runPipeline runs the bridge for a single pipeline. it has its own scheduler, so its queues,
+// backpressure, pausing and slots for requests are kept apart from other pipelines, and a panic in
+// any of its sources or routes only stops the pipeline.
+func runPipeline(ctx context.Context, p Pipeline, sources map[string]*source, opts sourceOptions, store *ConfigStore, delivery deliveryOptions, transforms []transformer) (err error) {
+	ctx, stop := context.WithCancelCause(ctx)
+	defer stop(nil)
+	onPanic := func(r any) {
+		slog.Error("pipeline panicked, stopping it", "pipeline", p.Name, "panic", r)
+		stop(fmt.Errorf("pipeline %s panicked: %v", p.Name, r))
+	}
+
+	delivery = delivery.isolated()
+	delivery.onPanic = onPanic
+	// however the pipeline stops, its queued messages are delivered and its routes are removed
+	sched := newScheduler(delivery)
+	defer sched.shutdown()
+	sink := newPipeline(store, sched, transforms)
+	sink.name = p.Name
+	b := &bridge.Bridge{Sinks: []bridge.Sink{sink}}
+	// the filters from the environment apply to every pipeline
+	if opts.maxMessageAge > 0 {
+		b.Filters = append(b.Filters, staleFilter{maxAge: opts.maxMessageAge})
+	}
+	if filter := loadListFilter(); filter.enabled() {
+		b.Filters = append(b.Filters, filter)
+	}
+	if filter := p.filter(); filter.enabled() {
+		b.Filters = append(b.Filters, filter)
+	}
+	for _, name := range p.Sources {
+		b.Sources = append(b.Sources, &sourceReader{src: sources[name], opts: opts, pipeline: p.Name, onPanic: onPanic})
+	}
+
+	// a panic stops the pipeline through its context, so it is reported in place of the error
+	// from running it
+	defer func() {
+		if cause := context.Cause(ctx); cause != nil && !errors.Is(cause, context.Canceled) {
+			err = cause
+		}
+	}()
+	defer diagnostics.recoverPanicWith(onPanic)
+
+	slog.Info("starting pipeline", "pipeline", p.Name)
+	if err := b.Run(ctx); err != nil {
+		slog.Error("pipeline stopped", "pipeline", p.Name, slog.Any("error", err))
+		return fmt.Errorf("pipeline %s stopped: %v", p.Name, err)
+	}
+	return nil
+}
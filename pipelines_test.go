@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// matterbridge serves a stream with a single message, then leaves it open
+func matterbridge(t *testing.T, text string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"text":"`+text+`","channel":"general","username":"bob"}`+"\n")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestPipelinePanicOnlyStopsThatPipeline(t *testing.T) {
+	received := make(chan []Message, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var msgs []Message
+		json.NewDecoder(r.Body).Decode(&msgs)
+		received <- msgs
+	}))
+	defer webhook.Close()
+
+	// without its health, reading the broken source panics as soon as it connects
+	broken := &source{name: "broken", apiUrl: matterbridge(t, "from broken").URL}
+	working := newSource("working", matterbridge(t, "from working").URL, "", "", "")
+	pipelines := []Pipeline{
+		{Name: "a", Sources: []string{"broken"}, Routes: []Route{{Name: "hook", WebhookUrl: webhook.URL}}},
+		{Name: "b", Sources: []string{"working"}, Routes: []Route{{Name: "hook", WebhookUrl: webhook.URL}}},
+	}
+	store := newConfigStore(Config{Pipelines: pipelines})
+
+	running := len(allSchedulers())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		done <- runPipelines(ctx, pipelines, []*source{broken, working}, sourceOptions{}, store, deliveryOptions{}, nil)
+	}()
+
+	select {
+	case msgs := <-received:
+		if len(msgs) != 1 || msgs[0].Text != "from working" || msgs[0].Pipeline != "b" {
+			t.Errorf("expected the message read by the working pipeline, got %+v", msgs)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the working pipeline didn't deliver anything")
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "pipeline a panicked") {
+			t.Errorf("expected the broken pipeline's panic to be reported, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("pipelines didn't stop")
+	}
+	if left := len(allSchedulers()) - running; left != 0 {
+		t.Errorf("expected the stopped pipelines' schedulers to be shut down, %d are left", left)
+	}
+}
+
+func TestBackpressureIsPerPipeline(t *testing.T) {
+	done := make(chan struct{})
+	defer close(done)
+	gate := &backpressureGate{}
+	if err := gate.enable(80, 50, done); err != nil {
+		t.Fatal(err)
+	}
+
+	release := make(chan struct{})
+	waited := make(chan struct{})
+	go func() {
+		gate.wait(context.Background(), "full", func() int {
+			select {
+			case <-release:
+				return 0
+			default:
+				return 100
+			}
+		})
+		close(waited)
+	}()
+
+	// the other pipeline carries on while the full one is paused
+	for gate.pausedFor() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	returned := make(chan struct{})
+	go func() {
+		gate.wait(context.Background(), "empty", func() int { return 0 })
+		close(returned)
+	}()
+	select {
+	case <-returned:
+	case <-time.After(time.Second):
+		t.Fatal("a pipeline with empty queues was paused")
+	}
+
+	close(release)
+	<-waited
+	if paused := gate.pausedFor(); paused != 0 {
+		t.Errorf("expected nothing to be paused once the queues drained, got %s", paused)
+	}
+}
+
+func TestIsolatedDeliveryOptions(t *testing.T) {
+	opts := deliveryOptions{inFlight: make(chan struct{}, 2)}
+	opts.inFlight <- struct{}{}
+	opts.inFlight <- struct{}{}
+
+	isolated := opts.isolated()
+	if cap(isolated.inFlight) != 2 || len(isolated.inFlight) != 0 {
+		t.Errorf("expected free slots of the same size, got %d of %d used", len(isolated.inFlight), cap(isolated.inFlight))
+	}
+	if (deliveryOptions{}).isolated().inFlight != nil {
+		t.Error("expected no limit to stay unlimited")
+	}
+}
@@ -0,0 +1,190 @@
+// Package bridge reads messages from matterbridge and passes them on to sinks. It is what the
+// matterbridge-to-webhook binary is built on, and can be used to embed the bridge in another
+// program with custom sources, filters and sinks.
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+)
+
+// Message is a message received from matterbridge
+type Message struct {
+	Text      string `json:"text"`
+	Channel   string `json:"channel"`
+	Username  string `json:"username"`
+	Userid    string `json:"userid"`
+	Avatar    string `json:"avatar"`
+	Account   string `json:"account"`
+	Event     string `json:"event"`
+	Protocol  string `json:"protocol"`
+	Gateway   string `json:"gateway"`
+	ParentId  string `json:"parent_id"`
+	Timestamp string `json:"timestamp"`
+	Id        string `json:"id"`
+
+	// the name of the matterbridge instance the message was read from
+	Source string `json:"source,omitempty"`
+	// the pipeline reading the message, when the config has pipelines
+	Pipeline string `json:"pipeline,omitempty"`
+	// what changed, when an edit is delivered as a diff
+	Edit *MessageEdit `json:"edit,omitempty"`
+	// details of the account from the config
+	AccountInfo *AccountInfo `json:"account_info,omitempty"`
+	// anything else matterbridge sent with the message, such as replies, keyed by type. files are
+	// moved to the attachments.
+	Extra map[string][]json.RawMessage `json:"extra,omitempty"`
+	// the files attached to the message
+	Attachments []Attachment `json:"attachments,omitempty"`
+	// the messages summarised, for the digests of routes that deliver them instead of each message
+	Digest *Digest `json:"digest,omitempty"`
+	// the command the message invokes, for routes that handle commands
+	Command *Command `json:"command,omitempty"`
+}
+
+// Command is a chat command, the first word of a message's text, along with the rest of the text
+type Command struct {
+	Name string `json:"name"`
+	Args string `json:"args"`
+}
+
+// MessageEdit describes what changed when a message was edited
+type MessageEdit struct {
+	Before string `json:"before,omitempty"`
+	After  string `json:"after,omitempty"`
+	Diff   string `json:"diff,omitempty"`
+}
+
+// AccountInfo describes a matterbridge account, so receivers can show something friendlier than
+// the account name
+type AccountInfo struct {
+	DisplayName string `json:"display_name,omitempty"`
+	IconUrl     string `json:"icon_url,omitempty"`
+}
+
+// Attachment is a file attached to a message
+type Attachment struct {
+	Name    string `json:"name"`
+	Url     string `json:"url,omitempty"`
+	Size    int64  `json:"size,omitempty"`
+	Comment string `json:"comment,omitempty"`
+	// the contents of the file, when attachments are downloaded, which is base64 in json
+	Data []byte `json:"data,omitempty"`
+}
+
+// Digest summarises the messages collected by a route over an interval, by channel
+type Digest struct {
+	Start    string          `json:"start"`
+	End      string          `json:"end"`
+	Count    int             `json:"count"`
+	Channels []DigestChannel `json:"channels"`
+}
+
+// DigestChannel summarises the messages from one channel in a digest
+type DigestChannel struct {
+	Source         string `json:"source,omitempty"`
+	Gateway        string `json:"gateway"`
+	Channel        string `json:"channel"`
+	Count          int    `json:"count"`
+	FirstTimestamp string `json:"first_timestamp"`
+	LastTimestamp  string `json:"last_timestamp"`
+	// the messages as lines of username: text, up to the route's limit
+	Text string `json:"text"`
+}
+
+// Emit passes a received message to the bridge. The context is used for the rest of the message's
+// trace.
+type Emit func(ctx context.Context, msg Message)
+
+// Source reads messages, passing each one to emit, until it fails for good or the context is
+// cancelled
+type Source interface {
+	Read(ctx context.Context, emit Emit) error
+}
+
+// Filter decides whether a message is passed on to the sinks
+type Filter interface {
+	Allow(ctx context.Context, msg Message) bool
+}
+
+// Sink delivers messages. Send is never called concurrently, so sinks that are slow to deliver
+// should queue messages rather than block.
+type Sink interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// FilterFunc lets a function be used as a filter
+type FilterFunc func(ctx context.Context, msg Message) bool
+
+func (f FilterFunc) Allow(ctx context.Context, msg Message) bool {
+	return f(ctx, msg)
+}
+
+// Bridge reads messages from every source, and passes the ones allowed by every filter on to
+// every sink
+type Bridge struct {
+	Sources []Source
+	Filters []Filter
+	Sinks   []Sink
+
+	// OnError is called when a sink fails to send a message. Errors are logged if it is not set.
+	OnError func(ctx context.Context, msg Message, err error)
+}
+
+// received is a message on its way from a source to the sinks
+type received struct {
+	ctx context.Context
+	msg Message
+}
+
+// Run reads from the sources until one of them stops, returning its error, or the context is
+// cancelled
+func (b *Bridge) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	messages := make(chan received)
+	emit := func(msgCtx context.Context, msg Message) {
+		select {
+		case messages <- received{ctx: msgCtx, msg: msg}:
+		case <-ctx.Done():
+		}
+	}
+
+	sourceErrs := make(chan error, len(b.Sources))
+	for _, src := range b.Sources {
+		go func(src Source) {
+			sourceErrs <- src.Read(ctx, emit)
+		}(src)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-sourceErrs:
+			return err
+		case r := <-messages:
+			b.deliver(r.ctx, r.msg)
+		}
+	}
+}
+
+func (b *Bridge) deliver(ctx context.Context, msg Message) {
+	for _, filter := range b.Filters {
+		if !filter.Allow(ctx, msg) {
+			return
+		}
+	}
+
+	for _, sink := range b.Sinks {
+		if err := sink.Send(ctx, msg); err != nil {
+			if b.OnError != nil {
+				b.OnError(ctx, msg, err)
+			} else {
+				slog.Warn("failed to send message", "message", msg, "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package bridge
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// sliceSource emits its messages, then fails
+type sliceSource struct {
+	msgs []Message
+	err  error
+}
+
+func (s *sliceSource) Read(ctx context.Context, emit Emit) error {
+	for _, msg := range s.msgs {
+		emit(ctx, msg)
+	}
+	return s.err
+}
+
+type recordingSink struct {
+	msgs []Message
+	err  error
+}
+
+func (s *recordingSink) Send(ctx context.Context, msg Message) error {
+	s.msgs = append(s.msgs, msg)
+	return s.err
+}
+
+func TestBridgeRun(t *testing.T) {
+	stopped := errors.New("stopped")
+	sink := &recordingSink{}
+	failing := &recordingSink{err: errors.New("failed")}
+	failed := 0
+	b := &Bridge{
+		Sources: []Source{&sliceSource{msgs: []Message{{Text: "!one"}, {Text: "two"}, {Text: "!three"}}, err: stopped}},
+		Filters: []Filter{PrefixFilter("!")},
+		Sinks:   []Sink{failing, sink},
+		OnError: func(ctx context.Context, msg Message, err error) { failed++ },
+	}
+
+	if err := b.Run(context.Background()); !errors.Is(err, stopped) {
+		t.Errorf("expected the error of the source, got %v", err)
+	}
+	if len(sink.msgs) != 2 || sink.msgs[0].Text != "!one" || sink.msgs[1].Text != "!three" {
+		t.Errorf("expected the filtered messages in order, got %+v", sink.msgs)
+	}
+	if failed != 2 {
+		t.Errorf("expected a failing sink to be reported, without stopping the others, got %d errors", failed)
+	}
+}
+
+func TestFilterFunc(t *testing.T) {
+	filter := FilterFunc(func(ctx context.Context, msg Message) bool { return msg.Channel == "general" })
+	if !filter.Allow(context.Background(), Message{Channel: "general"}) || filter.Allow(context.Background(), Message{Channel: "random"}) {
+		t.Error("expected the function to decide")
+	}
+}
@@ -0,0 +1,265 @@
+package bridge
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+)
+
+// DefaultMaxMessageBytes is the largest message accepted from matterbridge by default
+const DefaultMaxMessageBytes = 1 << 20
+
+// ErrLineTooLong is returned by ReadLine when a line is longer than the limit
+var ErrLineTooLong = errors.New("line is too long")
+
+// ReadLine reads a single line from a matterbridge stream. Lines longer than maxBytes are read to
+// the end and thrown away, returning ErrLineTooLong, so a broken bridge can't use up all the
+// memory.
+func ReadLine(reader *bufio.Reader, maxBytes int) ([]byte, error) {
+	line := []byte{}
+	tooLong := false
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if !tooLong && len(line)+len(chunk) > maxBytes {
+			tooLong = true
+			line = nil
+		} else if !tooLong {
+			line = append(line, chunk...)
+		}
+
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if tooLong {
+			return nil, ErrLineTooLong
+		}
+		return line, nil
+	}
+}
+
+// DecodeMessage decodes a line of the matterbridge stream. Blank lines, which some proxies send to
+// keep the connection open, decode to nothing without an error.
+func DecodeMessage(line []byte) (Message, bool, error) {
+	msg := Message{}
+	if len(bytes.TrimSpace(line)) == 0 {
+		return msg, false, nil
+	}
+	if err := json.Unmarshal(line, &msg); err != nil {
+		return msg, false, err
+	}
+	return msg, true, nil
+}
+
+// Authorize adds credentials for the matterbridge api to a request. matterbridge's own api
+// authentication uses a bearer token, but basic authentication is still supported for when it is
+// behind a proxy.
+func Authorize(req *http.Request, token string, username string, password string) {
+	if token != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	} else if username != "" && password != "" {
+		req.Header.Set(
+			"Authorization",
+			fmt.Sprintf("Basic %s", base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", username, password)))),
+		)
+	}
+}
+
+// StreamHooks are called as a StreamSource reads the stream, so programs embedding the bridge can
+// keep track of it, such as for metrics and health checks. Any of them can be left out.
+type StreamHooks struct {
+	// Connected is called once the stream is connected, before any messages are read
+	Connected func()
+	// Disconnected is called when a connected stream is closed
+	Disconnected func()
+	// Received is called for every line read from the stream, including the blank ones sent to
+	// keep it open
+	Received func()
+	// Decoded is called after a line is decoded, with the time decoding started
+	Decoded func(start time.Time)
+	// Skipped is called when a line is thrown away, with ErrLineTooLong or the error decoding it
+	Skipped func(err error)
+	// Failed is called when reading from the stream fails, other than for going idle
+	Failed func(err error)
+}
+
+// StreamSource reads messages from the matterbridge api stream, reconnecting with a backoff when
+// the connection is lost
+type StreamSource struct {
+	// the url to the base of the matterbridge api, excluding /api/...
+	Url string
+	// the token set for the api account in matterbridge, if any
+	Token string
+	// basic authentication for matterbridge behind a proxy, used if there is no token
+	Username string
+	Password string
+	// the name given to messages from this source
+	Name string
+	// the largest message accepted, defaulting to DefaultMaxMessageBytes
+	MaxMessageBytes int
+	// the connection is restarted if nothing arrives for this long, as some proxies leave the
+	// stream open but silent. it is never restarted if this isn't set.
+	IdleTimeout time.Duration
+	// the client used for requests, defaulting to http.DefaultClient
+	Client *http.Client
+	// the backoff between reconnections, which is reset whenever a message is received. it
+	// defaults to an exponential backoff that never gives up.
+	BackOff backoff.BackOff
+	Hooks   StreamHooks
+}
+
+func (s *StreamSource) Read(ctx context.Context, emit Emit) error {
+	b := s.BackOff
+	if b == nil {
+		exponential := backoff.NewExponentialBackOff()
+		exponential.MaxElapsedTime = 0
+		b = exponential
+	}
+
+	return backoff.RetryNotify(func() error {
+		return s.readStream(ctx, b, emit)
+	}, backoff.WithContext(b, ctx), func(err error, d time.Duration) {
+		slog.Warn("get messages failed", "source", s.Name, "error", err, "retry", d.String())
+	})
+}
+
+// readStream reads from a single connection to the stream until it fails
+func (s *StreamSource) readStream(ctx context.Context, b backoff.BackOff, emit Emit) error {
+	connCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	streamUrl, err := url.JoinPath(s.Url, "/api/stream")
+	if err != nil {
+		return backoff.Permanent(fmt.Errorf("failed to build url: %v", err))
+	}
+	req, err := http.NewRequestWithContext(connCtx, "GET", streamUrl, nil)
+	if err != nil {
+		return backoff.Permanent(fmt.Errorf("failed to build request: %v", err))
+	}
+	Authorize(req, s.Token, s.Username, s.Password)
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to request messages: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to request messages: matterbridge returned %s", res.Status)
+	}
+
+	maxBytes := s.MaxMessageBytes
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxMessageBytes
+	}
+
+	slog.Info("listening for messages...", "source", s.Name)
+	if s.Hooks.Connected != nil {
+		s.Hooks.Connected()
+	}
+	if s.Hooks.Disconnected != nil {
+		defer s.Hooks.Disconnected()
+	}
+
+	// tear down the connection if nothing arrives for too long
+	var watchdog *time.Timer
+	if s.IdleTimeout > 0 {
+		watchdog = time.AfterFunc(s.IdleTimeout, func() {
+			cancel(fmt.Errorf("nothing received for %s", s.IdleTimeout))
+		})
+		defer watchdog.Stop()
+	}
+
+	reader := bufio.NewReader(res.Body)
+	for {
+		line, err := ReadLine(reader, maxBytes)
+		if errors.Is(err, ErrLineTooLong) {
+			slog.Warn("message is too long, skipping", "source", s.Name, "max_bytes", maxBytes)
+			if s.Hooks.Skipped != nil {
+				s.Hooks.Skipped(err)
+			}
+			continue
+		} else if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if cause := context.Cause(connCtx); cause != nil {
+				return fmt.Errorf("stream idle, reconnecting: %v", cause)
+			}
+			if s.Hooks.Failed != nil {
+				s.Hooks.Failed(err)
+			}
+			return fmt.Errorf("failed to read messages: %v", err)
+		}
+		if s.Hooks.Received != nil {
+			s.Hooks.Received()
+		}
+		if watchdog != nil {
+			watchdog.Reset(s.IdleTimeout)
+		}
+
+		start := time.Now()
+		msg, ok, err := DecodeMessage(line)
+		if s.Hooks.Decoded != nil && (ok || err != nil) {
+			s.Hooks.Decoded(start)
+		}
+		if err != nil {
+			slog.Warn("failed to unmarshal message, skipping", "source", s.Name, "message", Truncate(line), "error", err)
+			if s.Hooks.Skipped != nil {
+				s.Hooks.Skipped(err)
+			}
+			continue
+		} else if !ok {
+			continue
+		}
+
+		if msg.Event != "" {
+			slog.Info(fmt.Sprintf("received %s event", msg.Event), "source", s.Name)
+			continue
+		}
+
+		msg.Source = s.Name
+		// the stream isn't read while the message is being handled, which isn't it going idle
+		if watchdog != nil {
+			watchdog.Stop()
+		}
+		emit(ctx, msg)
+		if watchdog != nil {
+			watchdog.Reset(s.IdleTimeout)
+		}
+		// a proper message means the connection is healthy again
+		b.Reset()
+	}
+}
+
+// Truncate shortens invalid input before it is logged, keeping the start of it and its length
+func Truncate(data []byte) string {
+	const maxLogged = 200
+	if len(data) > maxLogged {
+		return fmt.Sprintf("%s... (%d bytes)", data[:maxLogged], len(data))
+	}
+	return string(data)
+}
+
+// PrefixFilter only allows messages starting with the prefix
+type PrefixFilter string
+
+func (f PrefixFilter) Allow(ctx context.Context, msg Message) bool {
+	return strings.HasPrefix(msg.Text, string(f))
+}
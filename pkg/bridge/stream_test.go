@@ -0,0 +1,333 @@
+package bridge
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+)
+
+func TestReadLine(t *testing.T) {
+	reader := bufio.NewReaderSize(strings.NewReader("short\n"+strings.Repeat("a", 100)+"\nafter\nend"), 16)
+
+	line, err := ReadLine(reader, 32)
+	if err != nil || string(line) != "short\n" {
+		t.Fatalf("expected the first line, got %q, %v", line, err)
+	}
+	if _, err := ReadLine(reader, 32); !errors.Is(err, ErrLineTooLong) {
+		t.Fatalf("expected the long line to be skipped, got %v", err)
+	}
+	line, err = ReadLine(reader, 32)
+	if err != nil || string(line) != "after\n" {
+		t.Fatalf("expected the line after the long one, got %q, %v", line, err)
+	}
+	if _, err := ReadLine(reader, 32); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected an unfinished line to fail, got %v", err)
+	}
+}
+
+func TestDecodeMessage(t *testing.T) {
+	msg, ok, err := DecodeMessage([]byte(`{"text":"hello","username":"bob"}` + "\n"))
+	if err != nil || !ok || msg.Text != "hello" || msg.Username != "bob" {
+		t.Errorf("unexpected message %+v, %v, %v", msg, ok, err)
+	}
+	if _, ok, err := DecodeMessage([]byte(" \r\n")); ok || err != nil {
+		t.Errorf("expected a blank line to decode to nothing, got %v, %v", ok, err)
+	}
+	if _, ok, err := DecodeMessage([]byte("{not json")); ok || err == nil {
+		t.Errorf("expected invalid json to fail, got %v, %v", ok, err)
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	req := httptest.NewRequest("GET", "/api/stream", nil)
+	Authorize(req, "secret", "user", "pass")
+	if got := req.Header.Get("Authorization"); got != "Bearer secret" {
+		t.Errorf("expected the token to be used, got %q", got)
+	}
+
+	req = httptest.NewRequest("GET", "/api/stream", nil)
+	Authorize(req, "", "user", "pass")
+	if username, password, ok := req.BasicAuth(); !ok || username != "user" || password != "pass" {
+		t.Errorf("expected basic authentication, got %q", req.Header.Get("Authorization"))
+	}
+
+	req = httptest.NewRequest("GET", "/api/stream", nil)
+	Authorize(req, "", "user", "")
+	if got := req.Header.Get("Authorization"); got != "" {
+		t.Errorf("expected no credentials without a password, got %q", got)
+	}
+}
+
+// collector gathers the messages emitted by a source
+type collector struct {
+	mu   sync.Mutex
+	msgs []Message
+	got  chan struct{}
+}
+
+func newCollector() *collector {
+	return &collector{got: make(chan struct{}, 100)}
+}
+
+func (c *collector) emit(ctx context.Context, msg Message) {
+	c.mu.Lock()
+	c.msgs = append(c.msgs, msg)
+	c.mu.Unlock()
+	c.got <- struct{}{}
+}
+
+func (c *collector) wait(t *testing.T, n int) []Message {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		select {
+		case <-c.got:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected %d messages, got %d", n, i)
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Message{}, c.msgs...)
+}
+
+func TestStreamSourceRead(t *testing.T) {
+	lines := strings.Join([]string{
+		`{"text":"","event":"api_connected"}`,
+		``,
+		`{not json`,
+		`{"text":"` + strings.Repeat("a", 200) + `"}`,
+		`{"text":"hello","username":"bob","channel":"general"}`,
+		``,
+	}, "\n")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/stream" || r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		io.WriteString(w, lines)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	var mu sync.Mutex
+	connected, skipped, received := 0, []error{}, 0
+	src := &StreamSource{
+		Url:             server.URL,
+		Token:           "secret",
+		Name:            "test",
+		MaxMessageBytes: 100,
+		Hooks: StreamHooks{
+			Connected: func() { mu.Lock(); connected++; mu.Unlock() },
+			Received:  func() { mu.Lock(); received++; mu.Unlock() },
+			Skipped:   func(err error) { mu.Lock(); skipped = append(skipped, err); mu.Unlock() },
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := newCollector()
+	done := make(chan error)
+	go func() { done <- src.Read(ctx, c.emit) }()
+
+	msgs := c.wait(t, 1)
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the source to stop with the context, got %v", err)
+	}
+
+	if msgs[0].Text != "hello" || msgs[0].Source != "test" {
+		t.Errorf("unexpected message %+v", msgs[0])
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if connected != 1 {
+		t.Errorf("expected to connect once, got %d", connected)
+	}
+	if received != 4 {
+		t.Errorf("expected every line that fits to be received, got %d", received)
+	}
+	if len(skipped) != 2 || errors.Is(skipped[0], ErrLineTooLong) || !errors.Is(skipped[1], ErrLineTooLong) {
+		t.Errorf("expected the invalid and long lines to be skipped, got %v", skipped)
+	}
+}
+
+func TestStreamSourceRejected(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, password, ok := r.BasicAuth(); !ok || password != "right" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		io.WriteString(w, `{"text":"hello"}`+"\n")
+	}))
+	defer server.Close()
+
+	src := &StreamSource{
+		Url:      server.URL,
+		Username: "user",
+		Password: "wrong",
+		BackOff:  backoff.WithMaxRetries(&backoff.ZeroBackOff{}, 2),
+	}
+	c := newCollector()
+	err := src.Read(context.Background(), c.emit)
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("expected the source to fail with the rejected credentials, got %v", err)
+	}
+	if len(c.msgs) != 0 {
+		t.Errorf("expected no messages, got %v", c.msgs)
+	}
+}
+
+func TestStreamSourceIdle(t *testing.T) {
+	var mu sync.Mutex
+	connections := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		connections++
+		n := connections
+		mu.Unlock()
+		fmt.Fprintf(w, `{"text":"message %d"}`+"\n", n)
+		w.(http.Flusher).Flush()
+		// go silent, leaving the connection open
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	src := &StreamSource{
+		Url:         server.URL,
+		IdleTimeout: 100 * time.Millisecond,
+		BackOff:     &backoff.ZeroBackOff{},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := newCollector()
+	go src.Read(ctx, c.emit)
+
+	msgs := c.wait(t, 2)
+	if msgs[0].Text != "message 1" || msgs[1].Text != "message 2" {
+		t.Errorf("expected the silent stream to be reconnected, got %v", msgs)
+	}
+}
+
+func TestStreamSourceSlowEmitIsNotIdle(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"text":"one"}`+"\n"+`{"text":"two"}`+"\n")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	disconnected := make(chan struct{}, 10)
+	src := &StreamSource{
+		Url:         server.URL,
+		IdleTimeout: 50 * time.Millisecond,
+		BackOff:     &backoff.ZeroBackOff{},
+		Hooks:       StreamHooks{Disconnected: func() { disconnected <- struct{}{} }},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := newCollector()
+	go src.Read(ctx, func(ctx context.Context, msg Message) {
+		// holding on to the first message for longer than the idle timeout
+		if msg.Text == "one" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		c.emit(ctx, msg)
+	})
+
+	msgs := c.wait(t, 2)
+	if msgs[1].Text != "two" {
+		t.Errorf("expected the second message on the same connection, got %v", msgs)
+	}
+	select {
+	case <-disconnected:
+		t.Error("expected the stream to stay connected while a message was being handled")
+	default:
+	}
+}
+
+func TestPrefixFilter(t *testing.T) {
+	ctx := context.Background()
+	if !PrefixFilter("!").Allow(ctx, Message{Text: "!deploy"}) {
+		t.Error("expected a message with the prefix to be allowed")
+	}
+	if PrefixFilter("!").Allow(ctx, Message{Text: "deploy!"}) {
+		t.Error("expected a message without the prefix to be dropped")
+	}
+	if !PrefixFilter("").Allow(ctx, Message{Text: "anything"}) {
+		t.Error("expected an empty prefix to allow everything")
+	}
+}
+
+func FuzzReadLine(f *testing.F) {
+	f.Add([]byte("{\"text\":\"hello\"}\n{\"text\":\"world\"}\n"), 64)
+	f.Add([]byte(strings.Repeat("a", 100)+"\nshort\n"), 16)
+	f.Add([]byte("\n\n\r\n"), 1)
+	f.Add([]byte("no newline"), 4)
+
+	f.Fuzz(func(t *testing.T, data []byte, maxBytes int) {
+		if maxBytes <= 0 || maxBytes > 1<<16 {
+			return
+		}
+		// a small buffer, so long lines are read in many chunks
+		reader := bufio.NewReaderSize(bytes.NewReader(data), 16)
+		read := 0
+		for {
+			line, err := ReadLine(reader, maxBytes)
+			if errors.Is(err, ErrLineTooLong) {
+				continue
+			} else if err != nil {
+				break
+			}
+			if len(line) > maxBytes {
+				t.Fatalf("line of %d bytes is longer than the limit of %d", len(line), maxBytes)
+			}
+			if len(line) == 0 || line[len(line)-1] != '\n' {
+				t.Fatalf("line %q doesn't end with a newline", line)
+			}
+			read += len(line)
+			if read > len(data) {
+				t.Fatalf("read %d bytes from %d bytes of input", read, len(data))
+			}
+		}
+	})
+}
+
+func FuzzDecodeMessage(f *testing.F) {
+	f.Add([]byte(`{"text":"hello","channel":"general","username":"bob","gateway":"gw1","timestamp":"2024-01-01T00:00:00Z"}`))
+	f.Add([]byte(`{"text":"","event":"api_connected"}`))
+	f.Add([]byte(`{"extra":{"file":[{"name":"a.png","url":"http://x/a.png"}]}}`))
+	f.Add([]byte(`{"attachments":[{"name":"a","data":"aGVsbG8="}],"edit":{"diff":"x"}}`))
+	f.Add([]byte("  \n"))
+	f.Add([]byte(`{"text":`))
+
+	f.Fuzz(func(t *testing.T, line []byte) {
+		msg, ok, err := DecodeMessage(line)
+		if err != nil || !ok {
+			return
+		}
+		// anything decoded can be sent on to a webhook, and decodes to the same message again
+		encoded, err := json.Marshal(msg)
+		if err != nil {
+			t.Fatalf("failed to encode decoded message %+v: %v", msg, err)
+		}
+		again, ok, err := DecodeMessage(encoded)
+		if err != nil || !ok {
+			t.Fatalf("failed to decode encoded message %s: %v", encoded, err)
+		}
+		if again.Text != msg.Text || again.Channel != msg.Channel || again.Username != msg.Username {
+			t.Fatalf("message changed when encoded, %+v became %+v", msg, again)
+		}
+	})
+}
@@ -0,0 +1,83 @@
+package bridge
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ErrInvalidRequest is returned by WebhookSink.Post when the request to the webhook can't be built,
+// such as when the url is invalid
+var ErrInvalidRequest = errors.New("failed to build request")
+
+// StatusError is returned by WebhookSink.Post when the webhook responds with a status other than
+// 2xx
+type StatusError struct {
+	StatusCode int
+	Status     string
+	// the headers of the response, such as Retry-After
+	Header http.Header
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("webhook returned %s", e.Status)
+}
+
+// WebhookSink posts each message to a webhook, as a json array containing the message
+type WebhookSink struct {
+	Url string
+	// sent as a bearer token, if set
+	Token string
+	// the client used for requests, defaulting to http.DefaultClient
+	Client *http.Client
+	// when set, the trace of the message is passed on to the webhook in the request headers
+	PropagateTrace bool
+}
+
+func (s *WebhookSink) Send(ctx context.Context, msg Message) error {
+	body, err := json.Marshal([]Message{msg})
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %v", err)
+	}
+	return s.Post(ctx, body, "application/json")
+}
+
+// Post makes a single attempt at posting a payload to the webhook. The status of the response is
+// added to the span in the context, if there is one.
+func (s *WebhookSink) Post(ctx context.Context, body []byte, contentType string) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", s.Url, bytes.NewBuffer(body))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidRequest, err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	if s.Token != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", s.Token))
+	}
+	if s.PropagateTrace {
+		otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	}
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int("http.response.status_code", res.StatusCode))
+
+	if res.StatusCode >= 300 {
+		return &StatusError{StatusCode: res.StatusCode, Status: res.Status, Header: res.Header}
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWebhookSinkSend(t *testing.T) {
+	var got []Message
+	var auth, contentType string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth, contentType = r.Header.Get("Authorization"), r.Header.Get("Content-Type")
+		body, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &got); err != nil {
+			t.Errorf("webhook was sent invalid json: %v", err)
+		}
+	}))
+	defer server.Close()
+
+	sink := &WebhookSink{Url: server.URL, Token: "secret"}
+	if err := sink.Send(context.Background(), Message{Text: "hello", Username: "bob"}); err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+	if len(got) != 1 || got[0].Text != "hello" || got[0].Username != "bob" {
+		t.Errorf("expected an array with the message, got %+v", got)
+	}
+	if auth != "Bearer secret" {
+		t.Errorf("expected the token to be sent, got %q", auth)
+	}
+	if contentType != "application/json" {
+		t.Errorf("unexpected content type %q", contentType)
+	}
+}
+
+func TestWebhookSinkStatusError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "5")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	sink := &WebhookSink{Url: server.URL}
+	err := sink.Post(context.Background(), []byte("{}"), "application/json")
+	status := &StatusError{}
+	if !errors.As(err, &status) {
+		t.Fatalf("expected a status error, got %v", err)
+	}
+	if status.StatusCode != http.StatusTooManyRequests || status.Header.Get("Retry-After") != "5" {
+		t.Errorf("unexpected status error %+v", status)
+	}
+}
+
+func TestWebhookSinkInvalidUrl(t *testing.T) {
+	sink := &WebhookSink{Url: "http://[::1"}
+	if err := sink.Post(context.Background(), []byte("{}"), "application/json"); !errors.Is(err, ErrInvalidRequest) {
+		t.Errorf("expected an invalid request error, got %v", err)
+	}
+}
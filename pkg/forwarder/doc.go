@@ -0,0 +1,5 @@
+// Package forwarder has the gRPC service the bridge can deliver messages to instead of a webhook,
+// generated from forwarder.proto. Servers implement ForwarderServer.
+package forwarder
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative forwarder.proto
@@ -0,0 +1,125 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             v5.28.2
+// source: forwarder.proto
+
+package forwarder
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Forwarder_Forward_FullMethodName = "/matterbridge.forwarder.v1.Forwarder/Forward"
+)
+
+// ForwarderClient is the client API for Forwarder service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Forwarder is implemented by servers receiving messages from the bridge, as an alternative to a
+// webhook.
+type ForwarderClient interface {
+	// Forward streams messages to the server. The server must reply with an Ack for every request,
+	// in any order, and each message is retried until it is acknowledged without an error.
+	Forward(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[ForwardRequest, Ack], error)
+}
+
+type forwarderClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewForwarderClient(cc grpc.ClientConnInterface) ForwarderClient {
+	return &forwarderClient{cc}
+}
+
+func (c *forwarderClient) Forward(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[ForwardRequest, Ack], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Forwarder_ServiceDesc.Streams[0], Forwarder_Forward_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[ForwardRequest, Ack]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Forwarder_ForwardClient = grpc.BidiStreamingClient[ForwardRequest, Ack]
+
+// ForwarderServer is the server API for Forwarder service.
+// All implementations must embed UnimplementedForwarderServer
+// for forward compatibility.
+//
+// Forwarder is implemented by servers receiving messages from the bridge, as an alternative to a
+// webhook.
+type ForwarderServer interface {
+	// Forward streams messages to the server. The server must reply with an Ack for every request,
+	// in any order, and each message is retried until it is acknowledged without an error.
+	Forward(grpc.BidiStreamingServer[ForwardRequest, Ack]) error
+	mustEmbedUnimplementedForwarderServer()
+}
+
+// UnimplementedForwarderServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedForwarderServer struct{}
+
+func (UnimplementedForwarderServer) Forward(grpc.BidiStreamingServer[ForwardRequest, Ack]) error {
+	return status.Errorf(codes.Unimplemented, "method Forward not implemented")
+}
+func (UnimplementedForwarderServer) mustEmbedUnimplementedForwarderServer() {}
+func (UnimplementedForwarderServer) testEmbeddedByValue()                   {}
+
+// UnsafeForwarderServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ForwarderServer will
+// result in compilation errors.
+type UnsafeForwarderServer interface {
+	mustEmbedUnimplementedForwarderServer()
+}
+
+func RegisterForwarderServer(s grpc.ServiceRegistrar, srv ForwarderServer) {
+	// If the following call pancis, it indicates UnimplementedForwarderServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Forwarder_ServiceDesc, srv)
+}
+
+func _Forwarder_Forward_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(ForwarderServer).Forward(&grpc.GenericServerStream[ForwardRequest, Ack]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Forwarder_ForwardServer = grpc.BidiStreamingServer[ForwardRequest, Ack]
+
+// Forwarder_ServiceDesc is the grpc.ServiceDesc for Forwarder service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Forwarder_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "matterbridge.forwarder.v1.Forwarder",
+	HandlerType: (*ForwarderServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Forward",
+			Handler:       _Forwarder_Forward_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "forwarder.proto",
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+)
+
+// pollMessages fetches buffered messages from matterbridge on an interval until it fails or the
+// context is cancelled, for deployments where long-lived streaming responses don't make it through
+func pollMessages(ctx context.Context, src *source, interval time.Duration, b backoff.BackOff, c chan queuedMessage) error {
+	defer src.health.setConnected(false)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		msgs, err := fetchHistory(ctx, src)
+		if ctx.Err() != nil {
+			return backoff.Permanent(ctx.Err())
+		} else if err != nil {
+			return fmt.Errorf("failed to poll messages: %v", err)
+		}
+
+		if !src.health.isConnected() {
+			slog.Info("polling for messages...", "source", src.name, "interval", interval.String())
+			src.health.setConnected(true)
+		}
+		src.health.received()
+		b.Reset()
+
+		for _, msg := range msgs {
+			if msg.Event != "" {
+				slog.Info(fmt.Sprintf("received %s event", msg.Event))
+				continue
+			}
+			enqueueMessage(src, msg, c)
+		}
+
+		select {
+		case <-ctx.Done():
+			return backoff.Permanent(ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
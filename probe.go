@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// headers a webhook can use to advertise its limits in response to a probe
+const (
+	headerMaxPayloadBytes = "X-Webhook-Max-Payload-Bytes"
+	headerMaxBatch        = "X-Webhook-Max-Batch"
+)
+
+// content types messages can be sent as
+const (
+	contentTypeJson   = "application/json"
+	contentTypeNdjson = "application/x-ndjson"
+)
+
+// capabilities are what a webhook advertised the last time it was probed. zero values mean it
+// didn't say, so the defaults of one message per json request with no size limit are used.
+type capabilities struct {
+	// the largest request body the webhook accepts
+	maxPayloadBytes int
+	// the most messages the webhook accepts in one request
+	maxBatch int
+	// the webhook only accepts newline delimited json rather than a json array
+	ndjson bool
+	// each message is sent on its own as a json object rather than in an array
+	object bool
+}
+
+// probeCapabilities asks the webhook what it supports with an options request. webhooks that don't
+// support options requests get the defaults. when a route has several endpoints, they are assumed
+// to be the same so only the first is probed.
+func probeCapabilities(ctx context.Context, route Route, opts deliveryOptions) (capabilities, error) {
+	caps := capabilities{}
+	target := route.ProbeUrl
+	if target == "" && route.WebhookUrl != "" {
+		target = route.WebhookUrl
+	} else if target == "" && len(route.Failover) > 0 {
+		target = route.Failover[0]
+	} else if target == "" {
+		target = route.Endpoints[0].Url
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodOptions, target, nil)
+	if err != nil {
+		return caps, fmt.Errorf("failed to build request: %v", err)
+	}
+	if opts.webhookToken != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", opts.webhookToken))
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return caps, err
+	}
+	res.Body.Close()
+
+	if res.StatusCode == http.StatusMethodNotAllowed || res.StatusCode == http.StatusNotImplemented {
+		return caps, nil
+	}
+	if res.StatusCode >= 300 {
+		return caps, fmt.Errorf("probe returned %s", res.Status)
+	}
+
+	if caps.maxPayloadBytes, err = positiveHeader(res.Header, headerMaxPayloadBytes); err != nil {
+		return caps, err
+	}
+	if caps.maxBatch, err = positiveHeader(res.Header, headerMaxBatch); err != nil {
+		return caps, err
+	}
+
+	// accept-post is the standard way to list what can be posted, but plenty of servers reuse accept
+	accepted := res.Header.Values("Accept-Post")
+	if len(accepted) == 0 {
+		accepted = res.Header.Values("Accept")
+	}
+	types := mediaTypes(accepted)
+	if len(types) > 0 && !acceptsJson(types) {
+		if !types[contentTypeNdjson] {
+			return caps, fmt.Errorf("webhook doesn't accept %s or %s", contentTypeJson, contentTypeNdjson)
+		}
+		caps.ndjson = true
+	}
+
+	return caps, nil
+}
+
+// positiveHeader parses a header holding a positive number, returning 0 if it isn't set
+func positiveHeader(header http.Header, name string) (int, error) {
+	v := header.Get(name)
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid %s header: %s", name, v)
+	}
+	return n, nil
+}
+
+// mediaTypes parses a list of content types, ignoring their parameters
+func mediaTypes(values []string) map[string]bool {
+	types := map[string]bool{}
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			if t, _, err := mime.ParseMediaType(strings.TrimSpace(item)); err == nil {
+				types[t] = true
+			}
+		}
+	}
+	return types
+}
+
+func acceptsJson(types map[string]bool) bool {
+	return types[contentTypeJson] || types["application/*"] || types["*/*"]
+}
+
+// probe finds out the runner's capabilities when it starts, then keeps them up to date at the
+// probe interval until it is stopped, if there is one. if a probe fails, the capabilities from the
+// last successful probe are kept.
+func (r *routeRunner) probe(opts deliveryOptions) {
+	defer diagnostics.recoverPanicWith(opts.onPanic)
+
+	func() {
+		defer close(r.probed)
+		r.updateCapabilities(opts)
+	}()
+	if opts.probeInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(opts.probeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+		}
+		r.updateCapabilities(opts)
+	}
+}
+
+func (r *routeRunner) updateCapabilities(opts deliveryOptions) {
+	// the first probe is still being waited for, so the capabilities are read directly
+	previous := capabilities{}
+	if p := r.caps.Load(); p != nil {
+		previous = *p
+	}
+
+	caps, err := probeCapabilities(context.Background(), r.route, opts)
+	if err != nil {
+		slog.Warn("failed to probe webhook capabilities", "route", r.route.Name, slog.Any("error", err))
+	} else if caps != previous {
+		slog.Info("webhook capabilities changed", "route", r.route.Name, "max_payload_bytes", caps.maxPayloadBytes,
+			"max_batch", caps.maxBatch, "ndjson", caps.ndjson)
+		r.caps.Store(&caps)
+	}
+}
+
+// capabilities returns what the webhook advertised in the last successful probe, waiting for the
+// first probe if the route has only just started
+func (r *routeRunner) capabilities() capabilities {
+	<-r.probed
+	if caps := r.caps.Load(); caps != nil {
+		return *caps
+	}
+	return capabilities{}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"golang.org/x/net/proxy"
+)
+
+// proxyDialer opens connections through an http CONNECT or socks5 proxy, optionally connecting
+// directly when the proxy can't be reached
+type proxyDialer struct {
+	proxyUrl *url.URL
+	fallback bool
+	direct   *net.Dialer
+	socks    proxy.ContextDialer
+}
+
+// outboundDialer is the proxy dialer, for clients that don't use http.DefaultTransport. it is nil
+// when no proxy is configured.
+var outboundDialer *proxyDialer
+
+// setupProxy sends every outgoing connection through the proxy
+func setupProxy(rawUrl string, fallback bool) error {
+	proxyUrl, err := url.Parse(rawUrl)
+	if err != nil {
+		return fmt.Errorf("invalid proxy url: %v", err)
+	}
+
+	d := &proxyDialer{
+		proxyUrl: proxyUrl,
+		fallback: fallback,
+		direct:   &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second},
+	}
+	switch proxyUrl.Scheme {
+	case "http":
+	case "socks5", "socks5h":
+		socks, err := proxy.FromURL(proxyUrl, d.direct)
+		if err != nil {
+			return fmt.Errorf("invalid proxy url: %v", err)
+		}
+		d.socks = socks.(proxy.ContextDialer)
+	default:
+		return fmt.Errorf("unsupported proxy scheme %s, must be http or socks5", proxyUrl.Scheme)
+	}
+
+	// the proxy is used for every connection, so the usual proxy environment variables are ignored
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = d.DialContext
+	http.DefaultTransport = transport
+	outboundDialer = d
+	websocketDialer = &websocket.Dialer{
+		NetDialContext:   d.DialContext,
+		HandshakeTimeout: websocket.DefaultDialer.HandshakeTimeout,
+	}
+
+	slog.Info("connecting through proxy", "proxy", proxyUrl.Redacted(), "fallback", fallback)
+	return nil
+}
+
+func (d *proxyDialer) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	start := time.Now()
+	conn, err := d.tunnel(ctx, network, addr)
+
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	attrs := metric.WithAttributes(attribute.String("proxy", d.proxyUrl.Host), attribute.String("result", result))
+	metrics.proxyConnections.Add(ctx, 1, attrs)
+	metrics.proxyConnectDuration.Record(ctx, time.Since(start).Seconds(), attrs)
+
+	if err == nil {
+		return conn, nil
+	}
+	if !d.fallback {
+		return nil, fmt.Errorf("failed to connect through proxy: %v", err)
+	}
+
+	slog.Warn("failed to connect through proxy, connecting directly", "proxy", d.proxyUrl.Host, "addr", addr, "error", err)
+	metrics.proxyFallbacks.Add(ctx, 1, metric.WithAttributes(attribute.String("proxy", d.proxyUrl.Host)))
+	return d.direct.DialContext(ctx, network, addr)
+}
+
+// tunnel opens a connection to the address through the proxy
+func (d *proxyDialer) tunnel(ctx context.Context, network string, addr string) (net.Conn, error) {
+	if d.socks != nil {
+		return d.socks.DialContext(ctx, network, addr)
+	}
+
+	conn, err := d.direct.DialContext(ctx, "tcp", d.proxyUrl.Host)
+	if err != nil {
+		return nil, err
+	}
+	// give up on the proxy if it doesn't answer before the request is cancelled
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if user := d.proxyUrl.User; user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	res, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy returned %s", res.Status)
+	}
+	return conn, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// defaultReceiptText is the reply posted once a command has been delivered
+const defaultReceiptText = "✅ forwarded"
+
+// receiptTimeout is how long matterbridge has to accept a receipt
+const receiptTimeout = 10 * time.Second
+
+// ReceiptConfig replies in the chat once a command has been delivered, so whoever sent it knows
+// it was accepted
+type ReceiptConfig struct {
+	// a go template for the reply, filled in from the message, defaulting to "✅ forwarded"
+	Text string `json:"text,omitempty"`
+	// the name the reply is posted as, defaulting to the name of matterbridge's api account
+	Username string `json:"username,omitempty"`
+}
+
+func (r ReceiptConfig) validate() error {
+	_, err := formatTemplate(r.Text)
+	return err
+}
+
+var receipts = &receiptPoster{}
+
+// receiptPoster posts receipts to the matterbridge instance each message came from
+type receiptPoster struct {
+	sources map[string]*source
+}
+
+// enable starts posting receipts for routes that ask for them
+func (p *receiptPoster) enable(sources []*source) {
+	p.sources = map[string]*source{}
+	for _, src := range sources {
+		p.sources[src.name] = src
+	}
+}
+
+// post replies to a delivered message in its gateway through matterbridge's api. failures are
+// only logged, as the message itself was delivered.
+func (p *receiptPoster) post(ctx context.Context, route Route, msg Message) {
+	src, ok := p.sources[msg.Source]
+	if !ok || msg.Event != "" || msg.Gateway == "" {
+		return
+	}
+
+	text, err := renderFormat(route.Receipt.Text, msg, defaultReceiptText)
+	if err == nil {
+		err = src.postMessage(ctx, Message{Text: text, Username: route.Receipt.Username, Gateway: msg.Gateway})
+	}
+	if err != nil {
+		slog.Warn("failed to post delivery receipt", "message", msg, "route", route.Name, "source", src.name, slog.Any("error", err))
+		return
+	}
+	slog.Debug("posted delivery receipt", "message", msg, "route", route.Name)
+}
+
+// postMessage sends a message to every channel of a gateway through the source's matterbridge api
+func (s *source) postMessage(ctx context.Context, msg Message) error {
+	ctx, cancel := context.WithTimeout(ctx, receiptTimeout)
+	defer cancel()
+
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	url, err := url.JoinPath(s.apiUrl, "/api/message")
+	if err != nil {
+		return fmt.Errorf("failed to build url: %v", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to build request: %v", err)
+	}
+	req.Header.Set("Content-Type", contentTypeJson)
+	s.authorize(req)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("matterbridge returned %s", res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// configFileWatcher reloads the config file when the process receives SIGHUP, or when the file is
+// seen to have changed. the new config is swapped in without touching the matterbridge connection.
+type configFileWatcher struct {
+	path     string
+	store    *ConfigStore
+	interval time.Duration
+	last     []byte
+	modTime  time.Time
+}
+
+func newConfigFileWatcher(path string, store *ConfigStore, interval time.Duration) *configFileWatcher {
+	w := &configFileWatcher{
+		path:     path,
+		store:    store,
+		interval: interval,
+	}
+	if info, err := os.Stat(path); err == nil {
+		w.modTime = info.ModTime()
+	}
+	w.last, _ = os.ReadFile(path)
+	return w
+}
+
+// reload reads the file and applies it if it has changed and is valid
+func (w *configFileWatcher) reload(reason string) {
+	data, err := os.ReadFile(w.path)
+	if err != nil {
+		slog.Warn("failed to read config file, keeping the current config", "file", w.path, "error", err)
+		return
+	}
+	if bytes.Equal(data, w.last) {
+		slog.Debug("config file unchanged", "file", w.path)
+		return
+	}
+
+	cfg, err := parseConfig(data)
+	if err != nil {
+		slog.Warn("ignoring invalid config file", "file", w.path, "error", err)
+		return
+	}
+
+	version, err := w.store.Replace(cfg)
+	if err != nil {
+		slog.Warn("ignoring invalid config file", "file", w.path, "error", err)
+		return
+	}
+	w.last = data
+	slog.Info("reloaded config file", "file", w.path, "reason", reason, "version", version)
+}
+
+// run reloads the config on SIGHUP, and checks the file's modification time on the interval if
+// one is set
+func (w *configFileWatcher) run(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	if w.interval > 0 {
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			w.reload("SIGHUP")
+		case <-tick:
+			info, err := os.Stat(w.path)
+			if err != nil || info.ModTime().Equal(w.modTime) {
+				continue
+			}
+			w.modTime = info.ModTime()
+			w.reload("file changed")
+		}
+	}
+}
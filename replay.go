@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"github.com/jake-walker/matterbridge-to-webhook/pkg/bridge"
+	"golang.org/x/time/rate"
+)
+
+// runReplay sends messages from an archive file through the routes again, for recovering from a
+// webhook being down
+func runReplay(args []string) (err error) {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	perSecond := flags.Float64("rate", 5, "the maximum number of messages replayed per second")
+	route := flags.String("route", "", "only replay messages that were forwarded to this route, for archives of forwarded messages")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: matterbridge-to-webhook replay [-rate 5] [-route name] <messages.jsonl>")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("an archive file must be given")
+	}
+	if *perSecond <= 0 {
+		return fmt.Errorf("the rate must be positive")
+	}
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return fmt.Errorf("failed to open archive: %v", err)
+	}
+	defer file.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store, err := setupOfflineConfig(ctx)
+	if err != nil {
+		return err
+	}
+	sink, closeSink, err := newOfflinePipeline(ctx, store)
+	if err != nil {
+		return err
+	}
+	defer closeSink()
+
+	limiter := rate.NewLimiter(rate.Limit(*perSecond), 1)
+	// the same message can be archived more than once for a route, such as when the same file is
+	// given twice
+	seen := map[string]struct{}{}
+	replayed := 0
+	err = readArchive(file, func(entry archiveEntry) error {
+		if *route != "" && entry.Route != *route {
+			return nil
+		}
+		key := entry.Route + "\x00" + archiveKey(entry.Message)
+		if _, ok := seen[key]; ok {
+			return nil
+		}
+		seen[key] = struct{}{}
+
+		if err := limiter.Wait(ctx); err != nil {
+			return err
+		}
+		// archives of forwarded messages have a line for every route a message was delivered to,
+		// which only goes back to that route. received messages go through every route again.
+		sink.routes = nil
+		if entry.Route != "" {
+			sink.routes = []string{entry.Route}
+		}
+		sink.Send(ctx, entry.Message)
+		replayed++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	slog.Info("replayed messages, waiting for them to be delivered", "count", replayed)
+	return nil
+}
+
+// setupOfflineConfig loads the routing configuration for commands that don't run the bridge
+func setupOfflineConfig(ctx context.Context) (*ConfigStore, error) {
+	webhookUrl, err := secretEnv("WEBHOOK_URL")
+	if err != nil {
+		return nil, err
+	}
+	configFile := os.Getenv("CONFIG_FILE")
+	if webhookUrl == "" && configFile == "" && os.Getenv("KUBERNETES_CONFIGMAP") == "" && os.Getenv("CONSUL_KEY") == "" && os.Getenv("COMMANDS") == "" {
+		return nil, fmt.Errorf("the webhook url or config must be set")
+	}
+	return setupConfig(ctx, configFile, webhookUrl, os.Getenv("MESSAGE_PREFIX"))
+}
+
+// newOfflinePipeline sets up the usual pipeline for sending messages that aren't read from
+// matterbridge. closing it waits for everything queued to be delivered.
+func newOfflinePipeline(ctx context.Context, store *ConfigStore) (*pipeline, func(), error) {
+	deliveryOpts, err := loadDeliveryOptions()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sched := newScheduler(deliveryOpts)
+	transforms, closeTransforms, err := loadTransforms(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return newPipeline(store, sched, transforms), func() {
+		sched.shutdown()
+		closeTransforms()
+	}, nil
+}
+
+// readArchive calls fn with every entry in an archive file, skipping lines that can't be read
+func readArchive(r io.Reader, fn func(entry archiveEntry) error) error {
+	reader := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		data, err := bridge.ReadLine(reader, bridge.DefaultMaxMessageBytes)
+		if errors.Is(err, bridge.ErrLineTooLong) {
+			slog.Warn("skipping line that is too long", "line", line)
+			continue
+		} else if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to read archive: %v", err)
+		}
+		if len(bytes.TrimSpace(data)) == 0 {
+			continue
+		}
+
+		entry := archiveEntry{}
+		if err := json.Unmarshal(data, &entry); err != nil {
+			slog.Warn("skipping invalid line", "line", line, "error", err)
+			continue
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+}
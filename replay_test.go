@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReplayForwardedArchive(t *testing.T) {
+	var mu sync.Mutex
+	received := map[string][]string{}
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msgs []Message
+		json.NewDecoder(r.Body).Decode(&msgs)
+		mu.Lock()
+		defer mu.Unlock()
+		for _, msg := range msgs {
+			received[r.URL.Path] = append(received[r.URL.Path], msg.Text)
+		}
+	}))
+	defer webhook.Close()
+
+	dir := t.TempDir()
+	cfg, _ := json.Marshal(Config{Routes: []Route{
+		{Name: "a", WebhookUrl: webhook.URL + "/a"},
+		{Name: "b", WebhookUrl: webhook.URL + "/b"},
+	}})
+	configFile := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(configFile, cfg, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", configFile)
+
+	now := time.Now()
+	first := Message{Text: "first", Id: "1", Channel: "general"}
+	second := Message{Text: "second", Id: "2", Channel: "general"}
+	archive := filepath.Join(dir, "messages.jsonl")
+	file, err := os.Create(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoder := json.NewEncoder(file)
+	for _, entry := range []archiveEntry{
+		{Time: now, Route: "a", Message: first},
+		{Time: now, Route: "b", Message: first},
+		// archived again for the same route
+		{Time: now, Route: "a", Message: first},
+		{Time: now, Route: "b", Message: second},
+	} {
+		encoder.Encode(entry)
+	}
+	file.Close()
+
+	if err := runReplay([]string{"-rate", "1000", archive}); err != nil {
+		t.Fatalf("replay failed: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if got := received["/a"]; len(got) != 1 || got[0] != "first" {
+		t.Errorf("expected route a to only get the message forwarded to it once, got %v", got)
+	}
+	if got := received["/b"]; len(got) != 2 || got[0] != "first" || got[1] != "second" {
+		t.Errorf("expected route b to get both messages forwarded to it, got %v", got)
+	}
+}
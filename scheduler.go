@@ -0,0 +1,936 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"reflect"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/jake-walker/matterbridge-to-webhook/pkg/bridge"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
+)
+
+// defaults for the per-route scheduling settings
+const (
+	defaultRouteWorkers   = 1
+	defaultRouteQueueSize = 100
+)
+
+// recentErrorCount is the number of delivery errors kept for the admin api
+const recentErrorCount = 20
+
+// deliveryOptions are the settings for delivering to webhooks, shared by every route
+type deliveryOptions struct {
+	commandSla   time.Duration
+	webhookToken string
+	execHook     *execHook
+	// how often webhook capabilities are probed again after a route starts, or 0 to only probe
+	// when it starts
+	probeInterval time.Duration
+	// slots for requests to destinations, shared by every route using the options, or nil for no
+	// limit
+	inFlight chan struct{}
+	// called with the panic when delivering panics, instead of carrying on panicking
+	onPanic func(any)
+}
+
+// isolated returns a copy of the options with their own slots for requests, so routes using them
+// don't wait on the requests of routes using the original
+func (o deliveryOptions) isolated() deliveryOptions {
+	if o.inFlight != nil {
+		o.inFlight = make(chan struct{}, cap(o.inFlight))
+	}
+	return o
+}
+
+// delivery is a message queued for a route, along with the config it was matched against
+type delivery struct {
+	queuedMessage
+	config Config
+}
+
+// scheduler gives every route its own queue, workers, rate limit and retry budget, so a slow or
+// failing destination can only hold up its own messages
+type scheduler struct {
+	mu      sync.Mutex
+	opts    deliveryOptions
+	version uint64
+	runners map[string]*routeRunner
+	gate    *pauseGate
+	errLog  *errorLog
+}
+
+// routeRunner delivers the messages queued for a single route. high priority messages have their
+// own queue which is always emptied first.
+type routeRunner struct {
+	route   Route
+	queue   chan delivery
+	urgent  chan delivery
+	limiter *rate.Limiter
+	dest    destination
+	gate    *pauseGate
+	errLog  *errorLog
+	workers sync.WaitGroup
+	caps    atomic.Pointer[capabilities]
+	// closed once the first probe of the webhook's capabilities has finished
+	probed chan struct{}
+	done   chan struct{}
+	// holds up delivery while the webhook has asked for time
+	throttle throttle
+}
+
+// pauseGate holds up delivery while it is paused, so messages wait in the route queues
+type pauseGate struct {
+	mu     sync.Mutex
+	resume chan struct{}
+}
+
+// deliveryError is a failed delivery, kept for the admin api
+type deliveryError struct {
+	Time      time.Time `json:"time"`
+	Route     string    `json:"route"`
+	MessageId string    `json:"message_id"`
+	Error     string    `json:"error"`
+}
+
+// errorLog keeps the most recent delivery errors
+type errorLog struct {
+	mu     sync.Mutex
+	recent []deliveryError
+	next   int
+}
+
+func newScheduler(opts deliveryOptions) *scheduler {
+	s := &scheduler{
+		opts:    opts,
+		runners: map[string]*routeRunner{},
+		gate:    &pauseGate{},
+		errLog:  &errorLog{},
+	}
+
+	schedulersMu.Lock()
+	defer schedulersMu.Unlock()
+	schedulers[s] = struct{}{}
+	return s
+}
+
+// schedulers are the schedulers that haven't been shut down, for reporting their queue depths
+var (
+	schedulersMu sync.Mutex
+	schedulers   = map[*scheduler]struct{}{}
+)
+
+// allSchedulers returns every scheduler that hasn't been shut down
+func allSchedulers() []*scheduler {
+	schedulersMu.Lock()
+	defer schedulersMu.Unlock()
+	all := make([]*scheduler, 0, len(schedulers))
+	for s := range schedulers {
+		all = append(all, s)
+	}
+	return all
+}
+
+// eachQueueDepth calls fn with the number of messages waiting for each route of every scheduler
+func eachQueueDepth(fn func(route string, depth int)) {
+	for _, s := range allSchedulers() {
+		for name, depth := range s.queueDepths() {
+			fn(name, depth)
+		}
+	}
+}
+
+// inFlightRequests is the number of requests to destinations waiting for a response
+var inFlightRequests atomic.Int64
+
+// reconcile starts, replaces and stops route runners to match the config. replaced and removed
+// runners finish delivering what is already queued in the background.
+func (s *scheduler) reconcile(cfg Config, version uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if version == s.version {
+		return
+	}
+	s.version = version
+
+	wanted := map[string]bool{}
+	for _, route := range cfg.allRoutes() {
+		wanted[route.Name] = true
+
+		existing, ok := s.runners[route.Name]
+		if ok && reflect.DeepEqual(existing.route, route) {
+			continue
+		}
+		if ok {
+			existing.stop()
+		}
+		s.runners[route.Name] = newRouteRunner(route, s.opts, s.gate, s.errLog)
+	}
+
+	for name, runner := range s.runners {
+		if !wanted[name] {
+			runner.stop()
+			delete(s.runners, name)
+		}
+	}
+}
+
+// dispatch offers a message to every route, queueing it for the routes it matches
+func (s *scheduler) dispatch(queued queuedMessage, cfg Config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, route := range cfg.Routes {
+		runner, ok := s.runners[route.Name]
+		if !ok {
+			continue
+		}
+		if queued.routes != nil && !slices.Contains(queued.routes, route.Name) {
+			continue
+		}
+
+		// if a message prefix is set, and the message doesn't begin with it, stop processing
+		stageStart := time.Now()
+		matched := bridge.PrefixFilter(route.MessagePrefix).Allow(queued.ctx, queued.msg)
+		command, invoked := route.matchCommand(queued.msg)
+		allowed := route.allowsUser(queued.msg)
+		sampled := route.sampled(queued.msg)
+		recordStage(queued.ctx, stageFilter, stageStart)
+		if !matched {
+			scopeFor(route).metrics.messageDropped.Add(queued.ctx, 1, routeAttributes(queued.msg, route, dropReasonAttribute(dropReasonPrefix)))
+			slog.Debug("skipping message without prefix", "message", queued.msg, "route", route.Name)
+			continue
+		}
+		if !invoked {
+			scopeFor(route).metrics.messageDropped.Add(queued.ctx, 1, routeAttributes(queued.msg, route, dropReasonAttribute(dropReasonCommand)))
+			slog.Debug("skipping message without a command for the route", "message", queued.msg, "route", route.Name)
+			continue
+		}
+		if !allowed {
+			scopeFor(route).metrics.messageDropped.Add(queued.ctx, 1, routeAttributes(queued.msg, route, dropReasonAttribute(dropReasonUser)))
+			slog.Debug("skipping message from user who isn't allowed", "message", queued.msg, "route", route.Name)
+			continue
+		}
+		if !sampled {
+			scopeFor(route).metrics.messageDropped.Add(queued.ctx, 1, routeAttributes(queued.msg, route, dropReasonAttribute(dropReasonSampled)))
+			slog.Debug("skipping message outside of the sample", "message", queued.msg, "route", route.Name)
+			continue
+		}
+
+		routed := queued
+		routed.msg.Command = command
+		if !runner.enqueue(delivery{queuedMessage: routed, config: cfg}, cfg.Priority.isHighPriority(queued.msg)) {
+			scopeFor(route).metrics.messageDropped.Add(queued.ctx, 1, routeAttributes(queued.msg, route, dropReasonAttribute(dropReasonQueueFull)))
+			slog.Warn("route queue is full, dropping message", "message", queued.msg, "route", route.Name)
+		}
+	}
+}
+
+// queueDepths returns the number of messages waiting for each route
+func (s *scheduler) queueDepths() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	depths := map[string]int{}
+	for name, runner := range s.runners {
+		depths[name] = len(runner.queue) + len(runner.urgent)
+	}
+	return depths
+}
+
+// fullest returns how full the fullest route queue is, as a percentage of its size
+func (s *scheduler) fullest() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fullest := 0
+	for _, runner := range s.runners {
+		if size := cap(runner.queue); size > 0 {
+			fullest = max(fullest, 100*(len(runner.queue)+len(runner.urgent))/size)
+		}
+	}
+	return fullest
+}
+
+// shutdown stops every route runner, waiting for them to deliver what is already queued
+func (s *scheduler) shutdown() {
+	schedulersMu.Lock()
+	delete(schedulers, s)
+	schedulersMu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for name, runner := range s.runners {
+		runner.stop()
+		runner.workers.Wait()
+		delete(s.runners, name)
+	}
+}
+
+// pause stops delivering messages until resume is called. messages keep being queued until the
+// route queues are full.
+func (s *scheduler) pause() {
+	s.gate.pause()
+}
+
+func (s *scheduler) resume() {
+	s.gate.unpause()
+}
+
+func (s *scheduler) paused() bool {
+	return s.gate.paused()
+}
+
+// clear drops every queued message, returning the number dropped from each route
+func (s *scheduler) clear() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cleared := map[string]int{}
+	for name, runner := range s.runners {
+		cleared[name] = runner.drain(runner.urgent) + runner.drain(runner.queue)
+	}
+	return cleared
+}
+
+func (g *pauseGate) pause() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.resume == nil {
+		g.resume = make(chan struct{})
+	}
+}
+
+func (g *pauseGate) unpause() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.resume != nil {
+		close(g.resume)
+		g.resume = nil
+	}
+}
+
+func (g *pauseGate) paused() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.resume != nil
+}
+
+// wait blocks while the gate is paused
+func (g *pauseGate) wait() {
+	g.mu.Lock()
+	resume := g.resume
+	g.mu.Unlock()
+	if resume != nil {
+		<-resume
+	}
+}
+
+func (l *errorLog) add(e deliveryError) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.recent) < recentErrorCount {
+		l.recent = append(l.recent, e)
+		return
+	}
+	l.recent[l.next] = e
+	l.next = (l.next + 1) % recentErrorCount
+}
+
+// list returns the recent errors, oldest first
+func (l *errorLog) list() []deliveryError {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	errs := make([]deliveryError, 0, len(l.recent))
+	errs = append(errs, l.recent[l.next:]...)
+	return append(errs, l.recent[:l.next]...)
+}
+
+func newRouteRunner(route Route, opts deliveryOptions, gate *pauseGate, errLog *errorLog) *routeRunner {
+	workers := route.Workers
+	if workers == 0 {
+		workers = defaultRouteWorkers
+	}
+	queueSize := route.QueueSize
+	if queueSize == 0 {
+		queueSize = defaultRouteQueueSize
+	}
+
+	dest, err := newDestination(route)
+	if err != nil {
+		slog.Error("failed to set up route destination", "route", route.Name, slog.Any("error", err))
+		dest = &failedDestination{err: err}
+	}
+
+	r := &routeRunner{
+		route:  route,
+		queue:  make(chan delivery, queueSize),
+		urgent: make(chan delivery, queueSize),
+		dest:   dest,
+		gate:   gate,
+		errLog: errLog,
+		done:   make(chan struct{}),
+		probed: make(chan struct{}),
+	}
+	if route.RateLimit > 0 {
+		r.limiter = rate.NewLimiter(rate.Limit(route.RateLimit), int(math.Max(1, math.Ceil(route.RateLimit))))
+	}
+
+	if route.Digest != nil {
+		// digests collect every message in one place, so they only have a single worker
+		interval, _ := route.Digest.interval()
+		r.workers.Add(1)
+		go r.collect(opts, interval)
+	} else {
+		r.workers.Add(workers)
+		for i := 0; i < workers; i++ {
+			go r.work(opts)
+		}
+	}
+	if !isWebhook(dest) {
+		// message brokers take one message at a time, without wrapping it in an array
+		r.caps.Store(&capabilities{object: true})
+		close(r.probed)
+	} else {
+		go r.probe(opts)
+	}
+
+	// the destination is closed once everything queued has been delivered
+	go func() {
+		r.workers.Wait()
+		r.dest.close()
+	}()
+	return r
+}
+
+// enqueue adds a message to the route's queue without blocking, returning false if it is full
+func (r *routeRunner) enqueue(d delivery, highPriority bool) bool {
+	queue := r.queue
+	if highPriority {
+		queue = r.urgent
+	}
+
+	select {
+	case queue <- d:
+		return true
+	default:
+		return false
+	}
+}
+
+// drain empties a queue without delivering, returning the number of messages dropped
+func (r *routeRunner) drain(queue chan delivery) int {
+	count := 0
+	for {
+		select {
+		case d, ok := <-queue:
+			if !ok {
+				return count
+			}
+			scopeFor(r.route).metrics.messageDropped.Add(d.ctx, 1, routeAttributes(d.msg, r.route, dropReasonAttribute(dropReasonCleared)))
+			count++
+		default:
+			return count
+		}
+	}
+}
+
+// stop lets the workers exit once they have delivered everything already queued
+func (r *routeRunner) stop() {
+	close(r.done)
+	close(r.urgent)
+	close(r.queue)
+}
+
+// fill adds messages that are already queued to a batch without waiting, until it has max messages
+func (r *routeRunner) fill(batch []delivery, max int) []delivery {
+	for len(batch) < max {
+		select {
+		case d, ok := <-r.urgent:
+			if ok {
+				batch = append(batch, d)
+				continue
+			}
+		default:
+		}
+
+		select {
+		case d, ok := <-r.queue:
+			if ok {
+				batch = append(batch, d)
+				continue
+			}
+		default:
+		}
+		break
+	}
+	return batch
+}
+
+// next waits for the next message to deliver, preferring high priority messages. it returns false
+// once the runner is stopped and both queues are empty.
+func (r *routeRunner) next() (delivery, bool) {
+	select {
+	case d, ok := <-r.urgent:
+		if ok {
+			return d, true
+		}
+	default:
+	}
+
+	select {
+	case d, ok := <-r.urgent:
+		if ok {
+			return d, true
+		}
+		d, ok = <-r.queue
+		return d, ok
+	case d, ok := <-r.queue:
+		if ok {
+			return d, true
+		}
+		d, ok = <-r.urgent
+		return d, ok
+	}
+}
+
+func (r *routeRunner) work(opts deliveryOptions) {
+	defer diagnostics.recoverPanicWith(opts.onPanic)
+	defer r.workers.Done()
+
+	for {
+		// wait both before taking a message, so it stays queued while paused, and after, in case
+		// delivery was paused while waiting for one
+		r.gate.wait()
+		d, ok := r.next()
+		if !ok {
+			return
+		}
+		r.gate.wait()
+		// a cancelled message fails when it is forwarded
+		_ = r.throttle.wait(d.ctx)
+
+		// webhooks that accept batches get whatever else is already queued in the same request.
+		// the exec hook builds the payload for a single message, and chat services take one message
+		// per post, so they can't be batched.
+		caps := r.capabilities()
+		batch := []delivery{d}
+		batched := caps.maxBatch > 1 && opts.execHook == nil && r.route.Format == nil
+		if batched {
+			batch = r.fill(batch, caps.maxBatch)
+		}
+
+		if r.limiter != nil {
+			_ = r.limiter.Wait(context.Background())
+		}
+		msgs := []Message{}
+		for _, d := range batch {
+			d = normalizeDelivery(d, gatedRoute(d.config, r.route, d.msg).Normalize)
+			msg := d.msg
+			if d.edited {
+				msg = applyEditMode(d.msg, d.previousText, r.route.EditMode)
+			}
+			msgs = append(msgs, limitTextLength(msg, r.route)...)
+		}
+
+		// the parts of a split message go in separate requests unless the webhook takes batches,
+		// and stop at the first one that fails so they aren't delivered out of order
+		size := 1
+		if batched {
+			size = caps.maxBatch
+		}
+		delivered, sent := true, false
+		for len(msgs) > 0 {
+			n := min(size, len(msgs))
+			ok, err := r.forward(d.ctx, d.config, opts, caps, msgs[:n])
+			sent = sent || ok
+			if err != nil {
+				for _, msg := range msgs {
+					r.errLog.add(deliveryError{Time: time.Now(), Route: r.route.Name, MessageId: msg.Id, Error: err.Error()})
+				}
+				delivered = false
+				break
+			}
+			msgs = msgs[n:]
+		}
+
+		// let the senders of commands know they were accepted, as long as they weren't left out
+		if delivered && sent && r.route.Receipt != nil {
+			for _, d := range batch {
+				receipts.post(d.ctx, r.route, d.msg)
+			}
+		}
+	}
+}
+
+// forward delivers messages to the route's destination. when the webhook asks for time, the route
+// is held up until then and the messages are sent again, before anything else.
+func (r *routeRunner) forward(ctx context.Context, cfg Config, opts deliveryOptions, caps capabilities, msgs []Message) (bool, error) {
+	for attempt := 1; ; attempt++ {
+		if err := r.throttle.wait(ctx); err != nil {
+			return false, err
+		}
+		sent, err := forwardMessages(ctx, cfg, r.route, r.dest, opts, caps, msgs)
+		throttled := &throttledError{}
+		if !errors.As(err, &throttled) {
+			return sent, err
+		}
+
+		if attempt >= maxThrottledAttempts {
+			for _, msg := range msgs {
+				scopeFor(r.route).metrics.processingError.Add(ctx, 1, routeAttributes(msg, r.route, stageAttribute(stageDeliver), causeAttribute(causeNon2xx)))
+			}
+			slog.Warn("failed to deliver message", "messages", msgs, "route", r.route.Name, slog.Any("error", err))
+			return false, err
+		}
+		r.throttle.hold(throttled.retryAfter)
+	}
+}
+
+// collect summarises the messages queued for a digest route, delivering the digest at every
+// interval, and once more when the route is stopped
+func (r *routeRunner) collect(opts deliveryOptions, interval time.Duration) {
+	defer diagnostics.recoverPanicWith(opts.onPanic)
+	defer r.workers.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	digest := newDigestCollector(*r.route.Digest, time.Now())
+	// the config the last message was matched against, for delivering the digest
+	var cfg Config
+	flush := func() {
+		msg, ok := digest.flush(time.Now())
+		if !ok {
+			return
+		}
+		r.gate.wait()
+		caps := r.capabilities()
+		if _, err := r.forward(context.Background(), cfg, opts, caps, []Message{msg}); err != nil {
+			r.errLog.add(deliveryError{Time: time.Now(), Route: r.route.Name, Error: err.Error()})
+		}
+	}
+
+	urgent, queue := r.urgent, r.queue
+	for urgent != nil || queue != nil {
+		var d delivery
+		var ok bool
+		select {
+		case d, ok = <-urgent:
+			if !ok {
+				urgent = nil
+				continue
+			}
+		case d, ok = <-queue:
+			if !ok {
+				queue = nil
+				continue
+			}
+		case <-ticker.C:
+			flush()
+			continue
+		}
+
+		cfg = d.config
+		d = normalizeDelivery(d, r.route.Normalize)
+		msg := d.msg
+		if d.edited {
+			msg = applyEditMode(d.msg, d.previousText, r.route.EditMode)
+		}
+		digest.add(msg)
+	}
+	flush()
+}
+
+// encodePayload builds the request body for a batch of messages, in the format the webhook accepts
+func encodePayload(msgs []Message, caps capabilities) ([]byte, string, error) {
+	if caps.object {
+		body, err := json.Marshal(msgs[0])
+		return body, contentTypeJson, err
+	}
+	if !caps.ndjson {
+		body, err := json.Marshal(msgs)
+		return body, contentTypeJson, err
+	}
+
+	body := []byte{}
+	for _, msg := range msgs {
+		line, err := json.Marshal(msg)
+		if err != nil {
+			return nil, "", err
+		}
+		body = append(append(body, line...), '\n')
+	}
+	return body, contentTypeNdjson, nil
+}
+
+// forwardMessages sends a batch of messages to the route's webhook in one request, retrying up to
+// the route's limit. batches larger than the webhook accepts are split. failures are logged and
+// counted before being returned. it reports whether anything was sent, which it isn't when the jq
+// expression or exec hook leaves the messages out.
+func forwardMessages(ctx context.Context, cfg Config, route Route, dest destination, opts deliveryOptions, caps capabilities, msgs []Message) (bool, error) {
+	route = gatedRoute(cfg, route, msgs[0])
+
+	// parse the messages, reshaping them with the route's jq expression or format if it has one
+	stageStart := time.Now()
+	var msgBytes []byte
+	var contentType string
+	var err error
+	switch {
+	case opts.execHook != nil || (route.PayloadJq == "" && route.Format == nil):
+		msgBytes, contentType, err = encodePayload(msgs, caps)
+	case route.Format != nil:
+		msgBytes, contentType, err = formatMessage(msgs[0], *route.Format)
+	default:
+		msgBytes, contentType, err = reshapePayload(ctx, route, msgs, caps)
+	}
+	recordStage(ctx, stageTransform, stageStart)
+	if err == nil && msgBytes == nil {
+		// only the jq expression can leave every message out
+		for _, msg := range msgs {
+			scopeFor(route).metrics.messageDropped.Add(ctx, 1, routeAttributes(msg, route, dropReasonAttribute(dropReasonJq)))
+		}
+		slog.Debug("skipping messages left out by jq expression", "messages", msgs, "route", route.Name)
+		return false, nil
+	}
+	if err == nil && caps.maxPayloadBytes > 0 && len(msgBytes) > caps.maxPayloadBytes && len(msgs) > 1 {
+		half := len(msgs) / 2
+		sentFirst, errFirst := forwardMessages(ctx, cfg, route, dest, opts, caps, msgs[:half])
+		sentRest, errRest := forwardMessages(ctx, cfg, route, dest, opts, caps, msgs[half:])
+		return sentFirst || sentRest, errors.Join(errFirst, errRest)
+	}
+
+	scope := scopeFor(route)
+	ctx, span := scope.tracer.Start(ctx, "forward message", messageSpanAttributes(msgs[0]), trace.WithSpanKind(trace.SpanKindProducer))
+	defer span.End()
+	span.SetAttributes(attribute.String("route.name", route.Name), attribute.Int("messaging.batch.message_count", len(msgs)))
+
+	if err != nil && route.Format != nil && opts.execHook == nil {
+		for _, msg := range msgs {
+			scope.metrics.processingError.Add(ctx, 1, routeAttributes(msg, route, stageAttribute(stageTransform), causeAttribute(causeTransform)))
+		}
+		span.SetStatus(codes.Error, "failed to format message")
+		slog.Warn("failed to format message", "messages", msgs, "route", route.Name, "format", route.Format.Type, slog.Any("error", err))
+		return false, err
+	} else if err != nil && route.PayloadJq != "" && opts.execHook == nil {
+		for _, msg := range msgs {
+			scope.metrics.processingError.Add(ctx, 1, routeAttributes(msg, route, stageAttribute(stageTransform), causeAttribute(causeTransform)))
+		}
+		span.SetStatus(codes.Error, "failed to reshape message")
+		slog.Warn("failed to reshape message with jq", "messages", msgs, "route", route.Name, slog.Any("error", err))
+		return false, err
+	} else if err != nil {
+		for _, msg := range msgs {
+			scope.metrics.processingError.Add(ctx, 1, routeAttributes(msg, route, stageAttribute(stageTransform), causeAttribute(causeMarshal)))
+		}
+		span.SetStatus(codes.Error, "failed to marshal message")
+		slog.Warn("failed to marshal message", "messages", msgs, slog.Any("error", err))
+		return false, fmt.Errorf("failed to marshal message: %v", err)
+	}
+
+	// the exec hook replaces the payload with its own
+	if opts.execHook != nil {
+		msg := msgs[0]
+		stageStart = time.Now()
+		input, _ := json.Marshal(msg)
+		msgBytes, err = opts.execHook.run(ctx, route, input)
+		contentType = contentTypeJson
+		recordStage(ctx, stageTransform, stageStart)
+		if errors.Is(err, errHookDropped) {
+			scope.metrics.messageDropped.Add(ctx, 1, routeAttributes(msg, route, dropReasonAttribute(dropReasonFilter)))
+			slog.Debug("skipping message dropped by exec hook", "message", msg, "route", route.Name, "error", err)
+			return false, nil
+		} else if err != nil {
+			scope.metrics.processingError.Add(ctx, 1, routeAttributes(msg, route, stageAttribute(stageTransform), causeAttribute(causeTransform)))
+			span.SetStatus(codes.Error, "exec hook failed")
+			slog.Warn("exec hook failed", "message", msg, "route", route.Name, slog.Any("error", err))
+			return false, err
+		}
+	}
+
+	// webhooks can be sent the contents of attachments as files rather than base64 in the payload.
+	// chat services are sent links to attachments instead.
+	if attachments.mode == attachmentsMultipart && opts.execHook == nil && route.Format == nil && isWebhook(dest) {
+		if detached, files := detachFiles(msgs); len(files) > 0 {
+			if route.PayloadJq == "" {
+				msgBytes, contentType, err = encodePayload(detached, caps)
+			} else {
+				msgBytes, contentType, err = reshapePayload(ctx, route, detached, caps)
+			}
+			if err == nil {
+				msgBytes, contentType, err = multipartPayload(msgBytes, contentType, files)
+			}
+			if err != nil {
+				for _, msg := range msgs {
+					scope.metrics.processingError.Add(ctx, 1, routeAttributes(msg, route, stageAttribute(stageTransform), causeAttribute(causeMarshal)))
+				}
+				span.SetStatus(codes.Error, "failed to build multipart payload")
+				slog.Warn("failed to build multipart payload", "messages", msgs, "route", route.Name, slog.Any("error", err))
+				return false, fmt.Errorf("failed to build multipart payload: %v", err)
+			}
+		}
+	}
+
+	// a single message that is still too large would only be rejected by the webhook
+	if caps.maxPayloadBytes > 0 && len(msgBytes) > caps.maxPayloadBytes {
+		for _, msg := range msgs {
+			scope.metrics.processingError.Add(ctx, 1, routeAttributes(msg, route, stageAttribute(stageTransform), causeAttribute(causeTooLarge)))
+		}
+		err = fmt.Errorf("message is %d bytes, but the webhook accepts at most %d", len(msgBytes), caps.maxPayloadBytes)
+		span.SetStatus(codes.Error, "message too large")
+		slog.Warn("message is too large for webhook", "messages", msgs, "route", route.Name, slog.Any("error", err))
+		return false, err
+	}
+
+	// routes with failover urls try each of them in turn, with the usual retries for each
+	tiers := []failoverTier{{dest: dest}}
+	if failover, ok := dest.(*failoverDestination); ok {
+		tiers = failover.tiers
+	}
+
+	start := time.Now()
+	served := ""
+	for i, tier := range tiers {
+		if i > 0 {
+			for _, msg := range msgs {
+				scope.metrics.webhookFailover.Add(ctx, 1, routeAttributes(msg, route, attribute.String("from", tiers[i-1].name), attribute.String("to", tier.name)))
+			}
+			slog.Warn("failing over to the next webhook", "route", route.Name, "from", tiers[i-1].name, "to", tier.name, slog.Any("error", err))
+		}
+
+		b := backoff.WithContext(backoff.WithMaxRetries(backoff.NewExponentialBackOff(), uint64(route.MaxRetries)), ctx)
+		err = backoff.RetryNotify(func() error {
+			// only a limited number of requests are sent at once, however many routes and workers
+			// there are
+			if opts.inFlight != nil {
+				select {
+				case opts.inFlight <- struct{}{}:
+					defer func() { <-opts.inFlight }()
+				case <-ctx.Done():
+					return backoff.Permanent(ctx.Err())
+				}
+			}
+			inFlightRequests.Add(1)
+			defer inFlightRequests.Add(-1)
+			return tier.dest.deliver(ctx, cfg, route, opts, msgs, msgBytes, contentType)
+		}, b, func(err error, d time.Duration) {
+			slog.Debug("retrying webhook", "route", route.Name, "error", err, "retry", d.String())
+		})
+		if err == nil {
+			served = tier.name
+			break
+		}
+		// a webhook asking for time isn't down, so there's no need to fail over
+		if ctx.Err() != nil || errors.As(err, new(*throttledError)) {
+			break
+		}
+	}
+
+	// the route is held up and the messages sent again when a webhook asks for time, which is up
+	// to the route runner
+	throttled := &throttledError{}
+	if errors.As(err, &throttled) {
+		for _, msg := range msgs {
+			scope.metrics.webhookThrottled.Add(ctx, 1, routeAttributes(msg, route))
+		}
+		span.SetStatus(codes.Error, "webhook is rate limiting")
+		slog.Warn("webhook is rate limiting, holding up the route", "route", route.Name, "retry_after", throttled.retryAfter)
+		return false, err
+	}
+
+	// a command only counts as answered if the webhook accepted it within the sla
+	for _, msg := range msgs {
+		recordCommandSla(ctx, msg, route, opts.commandSla, err == nil && time.Since(start) <= opts.commandSla)
+	}
+
+	if err != nil {
+		for _, msg := range msgs {
+			scope.metrics.processingError.Add(ctx, 1, routeAttributes(msg, route, stageAttribute(stageDeliver), causeAttribute(errorCause(err))))
+		}
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to deliver message")
+		slog.Warn("failed to deliver message", "messages", msgs, "route", route.Name, slog.Any("error", err))
+		return false, err
+	}
+
+	slog.Debug("forwarded messages successfully", "route", route.Name, "count", len(msgs))
+	// the webhook that took the messages is recorded for routes with failover
+	extra := []attribute.KeyValue{}
+	if len(tiers) > 1 {
+		extra = append(extra, attribute.String("endpoint", served))
+		span.SetAttributes(attribute.String("route.endpoint", served))
+	}
+	for _, msg := range msgs {
+		scope.metrics.messageForwarded.Add(ctx, 1, routeAttributes(msg, route, extra...))
+		archive.forwarded(ctx, route, msg)
+	}
+	return true, nil
+}
+
+// sendWebhook makes a single attempt at posting the payload to the webhook. errors that won't be
+// fixed by retrying are marked as permanent.
+func sendWebhook(ctx context.Context, cfg Config, route Route, target string, opts deliveryOptions, msg Message, body []byte, contentType string) error {
+	sink := &bridge.WebhookSink{
+		Url:   target,
+		Token: opts.webhookToken,
+		// pass the trace on to the webhook so it can continue it
+		PropagateTrace: featureEnabled(cfg, flagPropagateTraceContext, route, msg, true),
+	}
+
+	start := time.Now()
+	err := sink.Post(ctx, body, contentType)
+	recordStage(ctx, stageDeliver, start)
+
+	status := &bridge.StatusError{}
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, bridge.ErrInvalidRequest):
+		return backoff.Permanent(withCause(causeBuildRequest, err))
+	case !errors.As(err, &status):
+		return withCause(errorCause(err), err)
+	}
+
+	err = withCause(causeNon2xx, err)
+	// a rate limited webhook that says when to come back is waited for, rather than retried
+	if status.StatusCode == http.StatusTooManyRequests {
+		if retryAfter, ok := parseRetryAfter(status.Header.Get("Retry-After"), time.Now()); ok {
+			return backoff.Permanent(&throttledError{retryAfter: retryAfter, err: err})
+		}
+	}
+	// client errors other than rate limiting will fail again
+	if status.StatusCode >= 400 && status.StatusCode < 500 && status.StatusCode != http.StatusTooManyRequests {
+		return backoff.Permanent(err)
+	}
+	return err
+}
+
+// recordCommandSla counts whether a forwarded command got a response from the webhook within the
+// configured sla. it does nothing unless both a message prefix and an sla are configured.
+func recordCommandSla(ctx context.Context, msg Message, route Route, commandSla time.Duration, met bool) {
+	if (route.MessagePrefix == "" && len(route.Commands) == 0) || commandSla <= 0 {
+		return
+	}
+	scope := scopeFor(route)
+
+	if met {
+		scope.metrics.commandSlaMet.Add(ctx, 1, routeAttributes(msg, route))
+	} else {
+		scope.metrics.commandSlaMissed.Add(ctx, 1, routeAttributes(msg, route))
+	}
+}
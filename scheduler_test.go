@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testWebhook records the messages delivered to it. handle, if set, decides the response, and can
+// hold requests up. capability probes are refused, so routes deliver as usual.
+type testWebhook struct {
+	*httptest.Server
+	mu       sync.Mutex
+	texts    []string
+	requests int
+	handle   func(w http.ResponseWriter) bool
+}
+
+func newTestWebhook(t *testing.T, handle func(w http.ResponseWriter) bool) *testWebhook {
+	h := &testWebhook{handle: handle}
+	h.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		h.mu.Lock()
+		h.requests++
+		h.mu.Unlock()
+		if h.handle != nil && !h.handle(w) {
+			return
+		}
+		var msgs []Message
+		json.NewDecoder(r.Body).Decode(&msgs)
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		for _, msg := range msgs {
+			h.texts = append(h.texts, msg.Text)
+		}
+	}))
+	t.Cleanup(h.Close)
+	return h
+}
+
+func (h *testWebhook) delivered() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]string{}, h.texts...)
+}
+
+func (h *testWebhook) attempts() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.requests
+}
+
+// waitFor fails the test if the condition isn't met in time
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// startScheduler starts a scheduler for the routes, returning a function that offers it messages
+func startScheduler(t *testing.T, routes ...Route) (*scheduler, func(texts ...string)) {
+	sched := newScheduler(deliveryOptions{})
+	cfg := Config{Routes: routes}
+	sched.reconcile(cfg, 1)
+	return sched, func(texts ...string) {
+		for _, text := range texts {
+			sched.dispatch(queuedMessage{ctx: context.Background(), msg: Message{Text: text}}, cfg)
+		}
+	}
+}
+
+func TestSlowRouteDoesNotDelayOthers(t *testing.T) {
+	release := make(chan struct{})
+	slow := newTestWebhook(t, func(w http.ResponseWriter) bool {
+		<-release
+		return true
+	})
+	fast := newTestWebhook(t, nil)
+	sched, send := startScheduler(t,
+		Route{Name: "slow", WebhookUrl: slow.URL},
+		Route{Name: "fast", WebhookUrl: fast.URL},
+	)
+
+	send("one", "two", "three")
+	waitFor(t, "the fast route to get every message", func() bool { return len(fast.delivered()) == 3 })
+	if got := slow.delivered(); len(got) != 0 {
+		t.Errorf("expected the slow route to still be held up, got %v", got)
+	}
+
+	close(release)
+	sched.shutdown()
+	if got := slow.delivered(); len(got) != 3 {
+		t.Errorf("expected the slow route to catch up once released, got %v", got)
+	}
+}
+
+func TestFailingRouteOnlyExhaustsItsOwnRetries(t *testing.T) {
+	failing := newTestWebhook(t, func(w http.ResponseWriter) bool {
+		http.Error(w, "down", http.StatusInternalServerError)
+		return false
+	})
+	working := newTestWebhook(t, nil)
+	sched, send := startScheduler(t,
+		Route{Name: "failing", WebhookUrl: failing.URL, MaxRetries: 1},
+		Route{Name: "working", WebhookUrl: working.URL, MaxRetries: 1},
+	)
+
+	send("one", "two")
+	waitFor(t, "the working route to get every message", func() bool { return len(working.delivered()) == 2 })
+	sched.shutdown()
+
+	// every message is tried once, then retried max_retries times, before being given up on
+	if attempts := failing.attempts(); attempts != 4 {
+		t.Errorf("expected 2 attempts for each message to the failing route, got %d", attempts)
+	}
+	if attempts := working.attempts(); attempts != 2 {
+		t.Errorf("expected a single attempt for each message to the working route, got %d", attempts)
+	}
+	errs := sched.errLog.list()
+	if len(errs) != 2 {
+		t.Fatalf("expected an error for each message given up on, got %+v", errs)
+	}
+	for _, err := range errs {
+		if err.Route != "failing" {
+			t.Errorf("expected only the failing route to give up, got %+v", err)
+		}
+	}
+}
+
+func TestRateLimitIsPerRoute(t *testing.T) {
+	limited := newTestWebhook(t, nil)
+	unlimited := newTestWebhook(t, nil)
+	sched, send := startScheduler(t,
+		Route{Name: "limited", WebhookUrl: limited.URL, RateLimit: 2},
+		Route{Name: "unlimited", WebhookUrl: unlimited.URL},
+	)
+	defer sched.shutdown()
+
+	texts := []string{}
+	for i := 0; i < 6; i++ {
+		texts = append(texts, fmt.Sprint(i))
+	}
+	send(texts...)
+
+	waitFor(t, "the unlimited route to get every message", func() bool { return len(unlimited.delivered()) == 6 })
+	// the limited route only has its burst of 2, and whatever the rate has allowed since
+	if got := limited.delivered(); len(got) > 3 {
+		t.Errorf("expected the limited route to be held to its rate, got %d messages", len(got))
+	}
+	waitFor(t, "the limited route to catch up", func() bool { return len(limited.delivered()) == 6 })
+}
+
+func TestQueueSizeIsPerRoute(t *testing.T) {
+	release := make(chan struct{})
+	blocked := newTestWebhook(t, func(w http.ResponseWriter) bool {
+		<-release
+		return true
+	})
+	other := newTestWebhook(t, nil)
+	sched, send := startScheduler(t,
+		Route{Name: "blocked", WebhookUrl: blocked.URL, QueueSize: 1},
+		Route{Name: "other", WebhookUrl: other.URL, QueueSize: 10},
+	)
+
+	// the blocked route's worker holds on to the first message, so only one more fits in its queue
+	send("first")
+	waitFor(t, "the blocked route to take the first message", func() bool { return blocked.attempts() == 1 })
+	send("two", "three", "four", "five")
+
+	if depths := sched.queueDepths(); depths["blocked"] != 1 {
+		t.Errorf("expected the blocked route's queue to be full, got %v", depths)
+	}
+	waitFor(t, "the other route to get every message", func() bool { return len(other.delivered()) == 5 })
+
+	close(release)
+	sched.shutdown()
+	if got := blocked.delivered(); len(got) != 2 || got[0] != "first" || got[1] != "two" {
+		t.Errorf("expected the messages that didn't fit in the blocked route's queue to be dropped, got %v", got)
+	}
+}
+
+func TestReceiptsOnlyForSentMessages(t *testing.T) {
+	var mu sync.Mutex
+	posted := []string{}
+	mb := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg Message
+		json.NewDecoder(r.Body).Decode(&msg)
+		mu.Lock()
+		defer mu.Unlock()
+		posted = append(posted, msg.Text)
+	}))
+	defer mb.Close()
+	receipts.enable([]*source{newSource("receipts", mb.URL, "", "", "")})
+	t.Cleanup(func() { receipts.sources = nil })
+
+	webhook := newTestWebhook(t, nil)
+	sched := newScheduler(deliveryOptions{})
+	cfg := Config{Routes: []Route{
+		{Name: "kept", WebhookUrl: webhook.URL, Receipt: &ReceiptConfig{Text: "kept"}},
+		// the jq expression leaves every message out, so nothing is sent
+		{Name: "left-out", WebhookUrl: webhook.URL, PayloadJq: "empty", Receipt: &ReceiptConfig{Text: "left out"}},
+	}}
+	sched.reconcile(cfg, 1)
+	sched.dispatch(queuedMessage{ctx: context.Background(), msg: Message{Text: "!deploy", Source: "receipts", Gateway: "gw"}}, cfg)
+	sched.shutdown()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(posted) != 1 || posted[0] != "kept" {
+		t.Errorf("expected a receipt only from the route that sent the message, got %v", posted)
+	}
+}
+
+func TestRoutesAreProbedWhenTheyStart(t *testing.T) {
+	var mu sync.Mutex
+	requests := []string{}
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, r.Method)
+		if r.Method == http.MethodOptions {
+			w.Header().Set("X-Webhook-Max-Batch", "10")
+		}
+	}))
+	defer webhook.Close()
+
+	// without a probe interval, the webhook is still probed once, before anything is delivered
+	sched, send := startScheduler(t, Route{Name: "probed", WebhookUrl: webhook.URL})
+	send("one")
+	sched.shutdown()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(requests) != 2 || requests[0] != http.MethodOptions || requests[1] != http.MethodPost {
+		t.Errorf("expected a probe before the delivery, got %v", requests)
+	}
+}
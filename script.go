@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	starlarkjson "go.starlark.net/lib/json"
+	"go.starlark.net/starlark"
+)
+
+// scriptTransform runs a starlark script's process(msg) function for every message. msg is a dict
+// of the message's fields, and process returns the message to deliver, a list of messages, or None
+// to drop it. a message can have a "routes" list to only be delivered to those routes.
+type scriptTransform struct {
+	path    string
+	timeout time.Duration
+	process starlark.Callable
+}
+
+// loadScriptTransform loads the script set in SCRIPT_FILE, if there is one
+func loadScriptTransform() (*scriptTransform, error) {
+	path := os.Getenv("SCRIPT_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	timeout, err := durationEnv("SCRIPT_TIMEOUT", 100*time.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+
+	thread := newScriptThread(path)
+	predeclared := starlark.StringDict{"json": starlarkjson.Module}
+	globals, err := starlark.ExecFile(thread, path, nil, predeclared)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load script: %v", err)
+	}
+	// scripts can't keep state between messages
+	globals.Freeze()
+
+	process, ok := globals["process"].(starlark.Callable)
+	if !ok {
+		return nil, fmt.Errorf("script must define a process(msg) function")
+	}
+
+	slog.Info("loaded script", "file", path)
+	return &scriptTransform{path: path, timeout: timeout, process: process}, nil
+}
+
+func newScriptThread(path string) *starlark.Thread {
+	return &starlark.Thread{
+		Name: path,
+		Print: func(thread *starlark.Thread, msg string) {
+			slog.Info("script: "+msg, "file", path)
+		},
+	}
+}
+
+func (t *scriptTransform) flag() string {
+	return flagScriptTransform
+}
+
+func (t *scriptTransform) apply(ctx context.Context, msg Message) ([]transformed, error) {
+	thread := newScriptThread(t.path)
+	timer := time.AfterFunc(t.timeout, func() {
+		thread.Cancel(fmt.Sprintf("took longer than %s", t.timeout))
+	})
+	defer timer.Stop()
+
+	// messages go through json to convert between go and starlark values
+	input, err := json.Marshal(msg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal message: %v", err)
+	}
+	value, err := starlark.Call(thread, starlarkjson.Module.Members["decode"], starlark.Tuple{starlark.String(input)}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert message: %v", err)
+	}
+
+	result, err := starlark.Call(thread, t.process, starlark.Tuple{value}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("script failed: %v", err)
+	}
+
+	values := []starlark.Value{}
+	switch result := result.(type) {
+	case starlark.NoneType:
+	case *starlark.List:
+		for i := 0; i < result.Len(); i++ {
+			values = append(values, result.Index(i))
+		}
+	case starlark.Tuple:
+		values = result
+	default:
+		values = append(values, result)
+	}
+
+	msgs := []transformed{}
+	for _, value := range values {
+		if _, ok := value.(*starlark.Dict); !ok {
+			return nil, fmt.Errorf("process must return a dict, a list of dicts or None, not %s", value.Type())
+		}
+		output, err := starlark.Call(thread, starlarkjson.Module.Members["encode"], starlark.Tuple{value}, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert result: %v", err)
+		}
+
+		out := struct {
+			Message
+			Routes []string `json:"routes"`
+		}{}
+		if err := json.Unmarshal([]byte(output.(starlark.String)), &out); err != nil {
+			return nil, fmt.Errorf("script returned an invalid message: %v", err)
+		}
+		msgs = append(msgs, transformed{msg: out.Message, routes: out.Routes})
+	}
+	return msgs, nil
+}
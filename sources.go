@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/jake-walker/matterbridge-to-webhook/pkg/bridge"
+)
+
+// source is a matterbridge instance messages are read from
+type source struct {
+	name     string
+	apiUrl   string
+	username string
+	password string
+	token    string
+	health   *streamHealth
+}
+
+// sourceOptions are the settings for reading messages, shared by every source
+type sourceOptions struct {
+	transport         string
+	pollInterval      time.Duration
+	pingInterval      time.Duration
+	idleTimeout       time.Duration
+	maxMessageBytes   int
+	replayOnStart     bool
+	replayMaxMessages int
+	replayMaxAge      time.Duration
+	// messages older than this are dropped, if set
+	maxMessageAge time.Duration
+}
+
+func newSource(name string, apiUrl string, username string, password string, token string) *source {
+	return &source{
+		name:     name,
+		apiUrl:   apiUrl,
+		username: username,
+		password: password,
+		token:    token,
+		health:   registerHealth(name),
+	}
+}
+
+// loadSources reads the matterbridge instances from the environment. MATTERBRIDGE_SOURCES lists
+// the names of the instances, each configured with MATTERBRIDGE_<NAME>_API_URL etc. without it, a
+// single source named "default" uses MATTERBRIDGE_API_URL etc.
+func loadSources() ([]*source, error) {
+	names := splitList(os.Getenv("MATTERBRIDGE_SOURCES"))
+	if len(names) == 0 {
+		src, err := loadSource("default", "MATTERBRIDGE_")
+		if err != nil {
+			return nil, err
+		}
+		return []*source{src}, nil
+	}
+
+	sources := []*source{}
+	for _, name := range names {
+		src, err := loadSource(name, "MATTERBRIDGE_"+strings.ToUpper(name)+"_")
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, src)
+	}
+	return sources, nil
+}
+
+// loadSource reads a single matterbridge instance from the environment variables with the prefix
+func loadSource(name string, prefix string) (*source, error) {
+	apiUrl := os.Getenv(prefix + "API_URL")
+	if apiUrl == "" {
+		return nil, fmt.Errorf("the api url must be set for source %s (%sAPI_URL)", name, prefix)
+	}
+
+	username, err := secretEnv(prefix + "API_USERNAME")
+	if err != nil {
+		return nil, err
+	}
+	password, err := secretEnv(prefix + "API_PASSWORD")
+	if err != nil {
+		return nil, err
+	}
+	token, err := secretEnv(prefix + "API_TOKEN")
+	if err != nil {
+		return nil, err
+	}
+
+	return newSource(name, apiUrl, username, password, token), nil
+}
+
+// newRequest creates a request to the source's matterbridge api
+func (s *source) newRequest(ctx context.Context, method string, path string) (*http.Request, error) {
+	url, err := url.JoinPath(s.apiUrl, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build url: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build request: %v", err)
+	}
+	s.authorize(req)
+	return req, nil
+}
+
+// authorize adds the source's credentials to a request
+func (s *source) authorize(req *http.Request) {
+	bridge.Authorize(req, s.token, s.username, s.password)
+}
+
+// sourceReader reads from a matterbridge instance for the bridge
+type sourceReader struct {
+	src  *source
+	opts sourceOptions
+	// the pipeline the source is read by, if any
+	pipeline string
+	// called with the panic if reading panics, instead of carrying on panicking
+	onPanic func(any)
+}
+
+func (r *sourceReader) Read(ctx context.Context, emit bridge.Emit) error {
+	c := make(chan queuedMessage)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for queued := range c {
+			queued.msg.Pipeline = r.pipeline
+			emit(queued.ctx, queued.msg)
+		}
+	}()
+	defer func() {
+		close(c)
+		<-done
+	}()
+
+	defer diagnostics.recoverPanicWith(r.onPanic)
+	return readSource(ctx, r.src, r.opts, c)
+}
+
+// readSource reads messages from a source with the configured transport, reconnecting with a
+// backoff until it fails for good
+func readSource(ctx context.Context, src *source, opts sourceOptions, c chan queuedMessage) error {
+	// forward the history matterbridge has buffered once the stream first connects, so messages
+	// from before the bridge started aren't missed
+	var replayOnce sync.Once
+	onConnect := func() {
+		if !opts.replayOnStart {
+			return
+		}
+		replayOnce.Do(func() {
+			replayHistory(ctx, src, opts.replayMaxMessages, opts.replayMaxAge, time.Now(), c)
+		})
+	}
+
+	b := backoff.NewExponentialBackOff()
+
+	var err error
+	switch opts.transport {
+	case "poll", "websocket":
+		// retry loop for listening for messages from matterbridge, until the context is cancelled
+		err = backoff.RetryNotify(func() error {
+			if opts.transport == "poll" {
+				return pollMessages(ctx, src, opts.pollInterval, b, c)
+			}
+			return getWebsocketMessages(ctx, src, opts.pingInterval, opts.maxMessageBytes, onConnect, b, c)
+		}, backoff.WithContext(b, ctx), func(err error, d time.Duration) {
+			slog.Warn("get messages failed", "source", src.name, "error", err, "retry", d.String())
+		})
+	default:
+		// the stream reconnects with the same backoff itself
+		err = src.stream(opts, b, onConnect).Read(ctx, func(_ context.Context, msg Message) {
+			recordClockSkew(src, msg)
+			enqueueMessage(src, msg, c)
+		})
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to get messages from %s: %v", src.name, err)
+	}
+	return nil
+}
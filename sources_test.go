@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// readUntilCancelled reads from the source until the server has been asked for messages, then
+// cancels the context and fails the test if reading doesn't stop
+func readUntilCancelled(t *testing.T, src *source, opts sourceOptions, requested chan struct{}) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		readSource(ctx, src, opts, make(chan queuedMessage))
+		close(done)
+	}()
+
+	select {
+	case <-requested:
+	case <-time.After(5 * time.Second):
+		t.Fatal("matterbridge wasn't asked for messages")
+	}
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the source kept reading after the context was cancelled")
+	}
+}
+
+func TestPollStopsWithContext(t *testing.T) {
+	requested := make(chan struct{}, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested <- struct{}{}
+		io.WriteString(w, "[]")
+	}))
+	defer server.Close()
+
+	src := newSource("poll", server.URL, "", "", "")
+	readUntilCancelled(t, src, sourceOptions{transport: "poll", pollInterval: time.Hour}, requested)
+}
+
+func TestWebsocketStopsWithContext(t *testing.T) {
+	requested := make(chan struct{}, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		requested <- struct{}{}
+		// stay connected without sending anything, until the bridge goes away
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	src := newSource("websocket", server.URL, "", "", "")
+	opts := sourceOptions{transport: "websocket", pingInterval: time.Hour, maxMessageBytes: 1024}
+	readUntilCancelled(t, src, opts, requested)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// systemdReadyCheckInterval is how often the streams are checked before systemd is told the bridge
+// is ready
+const systemdReadyCheckInterval = time.Second
+
+var systemd = &systemdNotifier{}
+
+// systemdNotifier tells systemd when the bridge is ready, keeps its watchdog from firing while the
+// streams are connected, and tells it when the bridge is stopping
+type systemdNotifier struct {
+	conn     *net.UnixConn
+	watchdog time.Duration
+	stop     chan struct{}
+	done     chan struct{}
+	closed   sync.Once
+	err      error
+}
+
+// enable starts notifying systemd, if the bridge was started by it with Type=notify
+func (n *systemdNotifier) enable() error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// abstract sockets are given with an @ in place of the leading nul byte
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("failed to connect to the systemd notify socket: %v", err)
+	}
+
+	// the watchdog is meant for this process if systemd doesn't say otherwise
+	if usec := os.Getenv("WATCHDOG_USEC"); usec != "" {
+		micros, err := strconv.ParseInt(usec, 10, 64)
+		if err != nil || micros <= 0 {
+			conn.Close()
+			return fmt.Errorf("invalid WATCHDOG_USEC from systemd: %s", usec)
+		}
+		if pid := os.Getenv("WATCHDOG_PID"); pid == "" || pid == strconv.Itoa(os.Getpid()) {
+			n.watchdog = time.Duration(micros) * time.Microsecond
+		}
+	}
+
+	n.conn = conn
+	n.stop = make(chan struct{})
+	n.done = make(chan struct{})
+	go n.run()
+
+	slog.Info("notifying systemd", "watchdog", n.watchdog)
+	return nil
+}
+
+func (n *systemdNotifier) run() {
+	defer diagnostics.recoverPanic()
+	defer close(n.done)
+
+	ready := time.NewTicker(systemdReadyCheckInterval)
+	defer ready.Stop()
+
+	// keepalives are sent at twice the rate systemd expects them, as it recommends
+	var keepalive <-chan time.Time
+	if n.watchdog > 0 {
+		ticker := time.NewTicker(n.watchdog / 2)
+		defer ticker.Stop()
+		keepalive = ticker.C
+	}
+
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-ready.C:
+			if streamsConnected() {
+				n.notify("READY=1\nSTATUS=connected to matterbridge")
+				ready.Stop()
+			}
+		case <-keepalive:
+			// a stream that stays disconnected stops the keepalives, so systemd restarts the
+			// bridge once the watchdog timeout passes
+			if streamsConnected() {
+				n.notify("WATCHDOG=1")
+			} else {
+				n.notify("STATUS=reconnecting to matterbridge")
+			}
+		}
+	}
+}
+
+// notify sends a state change to systemd
+func (n *systemdNotifier) notify(state string) {
+	if _, err := n.conn.Write([]byte(state)); err != nil {
+		slog.Warn("failed to notify systemd", "state", state, slog.Any("error", err))
+	}
+}
+
+// close tells systemd the bridge is stopping, if it is being notified. it is called as soon as the
+// bridge stops reading messages, so systemd doesn't count the time taken to deliver the queued
+// messages and clean up as the service hanging. it is safe to call more than once.
+func (n *systemdNotifier) close() error {
+	if n.conn == nil {
+		return nil
+	}
+	n.closed.Do(func() {
+		close(n.stop)
+		<-n.done
+		n.notify("STOPPING=1")
+		n.err = n.conn.Close()
+	})
+	return n.err
+}
+
+// streamsConnected reports whether the stream from every matterbridge instance is connected
+func streamsConnected() bool {
+	connected, count := true, 0
+	eachHealth(func(name string, h *streamHealth) {
+		count++
+		connected = connected && h.isConnected()
+	})
+	return connected && count > 0
+}
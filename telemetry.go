@@ -4,25 +4,74 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
 	"time"
 
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlplog/otlploggrpc"
 	"go.opentelemetry.io/otel/exporters/otlp/otlplog/otlploghttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
 	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
 	"go.opentelemetry.io/otel/log/global"
 	"go.opentelemetry.io/otel/metric"
 	"go.opentelemetry.io/otel/propagation"
 	"go.opentelemetry.io/otel/sdk/log"
 	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
 	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// pipeline stages, used to break down timings and errors
+const (
+	stageRead      = "read"
+	stageFilter    = "filter"
+	stageTransform = "transform"
+	stageDeliver   = "deliver"
+)
+
+// the otlp protocols telemetry can be exported with
+const (
+	otlpGrpc         = "grpc"
+	otlpHttpProtobuf = "http/protobuf"
+)
+
+// defaultMetricExportInterval is how often metrics are exported, in milliseconds like
+// OTEL_METRIC_EXPORT_INTERVAL
+const defaultMetricExportInterval = 3000
+
 type Metrics struct {
-	messageReceived  metric.Int64Counter
-	messageForwarded metric.Int64Counter
-	messageDropped   metric.Int64Counter
-	processingError  metric.Int64Counter
+	messageReceived metric.Int64Counter
+	messageDropped  metric.Int64Counter
+	processingError metric.Int64Counter
+	streamConnected metric.Int64ObservableGauge
+	lastMessageAge  metric.Float64ObservableGauge
+	stageDuration   metric.Float64Histogram
+	archiveBytes    metric.Int64Counter
+
+	proxyConnections     metric.Int64Counter
+	proxyConnectDuration metric.Float64Histogram
+	proxyFallbacks       metric.Int64Counter
+
+	clockSkew  metric.Float64Histogram
+	messageAge metric.Float64Histogram
+
+	backpressurePause  metric.Float64Histogram
+	backpressurePaused metric.Float64ObservableGauge
+
+	queueDepth       metric.Int64ObservableGauge
+	requestsInFlight metric.Int64ObservableGauge
+
+	buildInfo metric.Int64ObservableGauge
 }
 
 func setupOTelSdk(ctx context.Context) (shutdown func(context.Context) error, err error) {
@@ -44,12 +93,20 @@ func setupOTelSdk(ctx context.Context) (shutdown func(context.Context) error, er
 	res := resource.NewWithAttributes(
 		semconv.SchemaURL,
 		semconv.ServiceName("matterbridge-to-webhook"),
-		semconv.ServiceVersion("1.0.0"),
+		semconv.ServiceVersion(version),
 	)
 
 	prop := newPropagator()
 	otel.SetTextMapPropagator(prop)
 
+	tracerProvider, err := newTracerProvider(res)
+	if err != nil {
+		handleErr(err)
+		return
+	}
+	shutdownFuncs = append(shutdownFuncs, tracerProvider.Shutdown)
+	otel.SetTracerProvider(tracerProvider)
+
 	meterProvider, err := newMeterProvider(res)
 	if err != nil {
 		handleErr(err)
@@ -76,8 +133,63 @@ func newPropagator() propagation.TextMapPropagator {
 	)
 }
 
+// otlpProtocol returns the protocol a signal is exported with, from the variable for the signal
+// such as OTEL_EXPORTER_OTLP_TRACES_PROTOCOL, or OTEL_EXPORTER_OTLP_PROTOCOL for every signal
+func otlpProtocol(signal string) (string, error) {
+	protocol := os.Getenv("OTEL_EXPORTER_OTLP_" + strings.ToUpper(signal) + "_PROTOCOL")
+	if protocol == "" {
+		protocol = os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL")
+	}
+	switch protocol {
+	case "":
+		return otlpHttpProtobuf, nil
+	case otlpGrpc, otlpHttpProtobuf:
+		return protocol, nil
+	default:
+		return "", fmt.Errorf("unsupported otlp protocol for %s: %s, must be %s or %s", signal, protocol, otlpGrpc, otlpHttpProtobuf)
+	}
+}
+
+func newTracerProvider(res *resource.Resource) (*sdktrace.TracerProvider, error) {
+	protocol, err := otlpProtocol("traces")
+	if err != nil {
+		return nil, err
+	}
+	var traceExporter sdktrace.SpanExporter
+	if protocol == otlpGrpc {
+		traceExporter, err = otlptracegrpc.New(context.Background())
+	} else {
+		traceExporter, err = otlptracehttp.New(context.Background())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tracerProvider := sdktrace.NewTracerProvider(
+		sdktrace.WithResource(res),
+		sdktrace.WithBatcher(traceExporter),
+	)
+	return tracerProvider, nil
+}
+
 func newMeterProvider(res *resource.Resource) (*sdkmetric.MeterProvider, error) {
-	metricExporter, err := otlpmetrichttp.New(context.Background())
+	protocol, err := otlpProtocol("metrics")
+	if err != nil {
+		return nil, err
+	}
+	interval, err := intEnv("OTEL_METRIC_EXPORT_INTERVAL", defaultMetricExportInterval)
+	if err != nil {
+		return nil, err
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("OTEL_METRIC_EXPORT_INTERVAL must be positive")
+	}
+	var metricExporter sdkmetric.Exporter
+	if protocol == otlpGrpc {
+		metricExporter, err = otlpmetricgrpc.New(context.Background())
+	} else {
+		metricExporter, err = otlpmetrichttp.New(context.Background())
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -85,7 +197,7 @@ func newMeterProvider(res *resource.Resource) (*sdkmetric.MeterProvider, error)
 	meterProvider := sdkmetric.NewMeterProvider(
 		sdkmetric.WithResource(res),
 		sdkmetric.WithReader(
-			sdkmetric.NewPeriodicReader(metricExporter, sdkmetric.WithInterval(3*time.Second)),
+			sdkmetric.NewPeriodicReader(metricExporter, sdkmetric.WithInterval(time.Duration(interval)*time.Millisecond)),
 		),
 	)
 
@@ -93,7 +205,16 @@ func newMeterProvider(res *resource.Resource) (*sdkmetric.MeterProvider, error)
 }
 
 func newLoggerProvider(res *resource.Resource) (*log.LoggerProvider, error) {
-	logExporter, err := otlploghttp.New(context.Background())
+	protocol, err := otlpProtocol("logs")
+	if err != nil {
+		return nil, err
+	}
+	var logExporter log.Exporter
+	if protocol == otlpGrpc {
+		logExporter, err = otlploggrpc.New(context.Background())
+	} else {
+		logExporter, err = otlploghttp.New(context.Background())
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -105,29 +226,304 @@ func newLoggerProvider(res *resource.Resource) (*log.LoggerProvider, error) {
 	return loggerProvider, nil
 }
 
+func stageAttribute(stage string) attribute.KeyValue {
+	return attribute.String("stage", stage)
+}
+
+// causes of processing errors, so failing destinations can be told apart from bad messages
+const (
+	causeMarshal      = "marshal"
+	causeBuildRequest = "build_request"
+	causeNetwork      = "network"
+	causeNon2xx       = "non_2xx"
+	causeTimeout      = "timeout"
+	causeStreamRead   = "stream_read"
+	causeUnmarshal    = "unmarshal"
+	causeTooLarge     = "too_large"
+	causeTransform    = "transform"
+)
+
+func causeAttribute(cause string) attribute.KeyValue {
+	return attribute.String("cause", cause)
+}
+
+// causeError is an error with the cause it is counted under
+type causeError struct {
+	cause string
+	err   error
+}
+
+func withCause(cause string, err error) error {
+	return &causeError{cause: cause, err: err}
+}
+
+func (e *causeError) Error() string {
+	return e.err.Error()
+}
+
+func (e *causeError) Unwrap() error {
+	return e.err
+}
+
+// errorCause classifies a delivery error. errors without a cause are from connecting to or
+// talking to the destination.
+func errorCause(err error) string {
+	var tagged *causeError
+	if errors.As(err, &tagged) {
+		return tagged.cause
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return causeTimeout
+	}
+	return causeNetwork
+}
+
+// reasons messages are dropped
+const (
+	dropReasonPrefix    = "prefix"
+	dropReasonCommand   = "no_command"
+	dropReasonUser      = "user_not_allowed"
+	dropReasonQueueFull = "queue_full"
+	dropReasonSampled   = "sampled_out"
+	dropReasonDedup     = "dedup"
+	dropReasonJq        = "jq_empty"
+	dropReasonRateLimit = "rate_limit"
+	dropReasonFilter    = "filter"
+	dropReasonCleared   = "cleared"
+	dropReasonStale     = "stale"
+)
+
+func dropReasonAttribute(reason string) attribute.KeyValue {
+	return attribute.String("reason", reason)
+}
+
+// recordStage records how long a pipeline stage took
+func recordStage(ctx context.Context, stage string, start time.Time) {
+	metrics.stageDuration.Record(ctx, time.Since(start).Seconds(), metric.WithAttributes(stageAttribute(stage)))
+}
+
 func initMetrics(meter metric.Meter) (Metrics, error) {
 	m := Metrics{}
 
-	var err1, err2, err3, err4 error
+	var err1, err2, err3, err4, err5, err6, err7, err8, err9, err10, err11, err12, err13, err14, err15, err16, err17 error
 
-	m.messageReceived, err1 = meter.Int64Counter(
+	m.messageReceived, err1 = lifetimeCounter(
+		meter,
 		"messages_received_total",
 		metric.WithDescription("Total number of messages received"),
 	)
-	m.messageForwarded, err2 = meter.Int64Counter(
+	m.messageDropped, err2 = lifetimeCounter(
+		meter,
+		"messages_dropped_total",
+		metric.WithDescription("Total number of messages not eligable for forwarding"),
+	)
+	m.processingError, err3 = lifetimeCounter(
+		meter,
+		"processing_errors_total",
+		metric.WithDescription("Total number of processing errors"),
+	)
+	m.streamConnected, err4 = meter.Int64ObservableGauge(
+		"stream_connected",
+		metric.WithDescription("Whether the matterbridge stream is connected (1) or not (0)"),
+		metric.WithInt64Callback(func(ctx context.Context, o metric.Int64Observer) error {
+			eachHealth(func(name string, h *streamHealth) {
+				connected := int64(0)
+				if h.isConnected() {
+					connected = 1
+				}
+				o.Observe(connected, metric.WithAttributes(attribute.String("source", name)))
+			})
+			return nil
+		}),
+	)
+	m.lastMessageAge, err5 = meter.Float64ObservableGauge(
+		"last_message_age_seconds",
+		metric.WithDescription("Seconds since anything was last received from the matterbridge stream"),
+		metric.WithUnit("s"),
+		metric.WithFloat64Callback(func(ctx context.Context, o metric.Float64Observer) error {
+			eachHealth(func(name string, h *streamHealth) {
+				o.Observe(h.lastMessageAge().Seconds(), metric.WithAttributes(attribute.String("source", name)))
+			})
+			return nil
+		}),
+	)
+	m.stageDuration, err6 = meter.Float64Histogram(
+		"pipeline_stage_duration_seconds",
+		metric.WithDescription("Time taken by each stage of processing a message"),
+		metric.WithUnit("s"),
+	)
+	m.archiveBytes, err7 = lifetimeCounter(
+		meter,
+		"archive_bytes_written_total",
+		metric.WithDescription("Total number of bytes written to archive files"),
+		metric.WithUnit("By"),
+	)
+	m.proxyConnections, err8 = lifetimeCounter(
+		meter,
+		"proxy_connections_total",
+		metric.WithDescription("Total number of connections attempted through the proxy"),
+	)
+	m.proxyConnectDuration, err9 = meter.Float64Histogram(
+		"proxy_connect_duration_seconds",
+		metric.WithDescription("Time taken to open a connection through the proxy"),
+		metric.WithUnit("s"),
+	)
+	m.proxyFallbacks, err10 = lifetimeCounter(
+		meter,
+		"proxy_direct_fallbacks_total",
+		metric.WithDescription("Total number of connections made directly after the proxy failed"),
+	)
+	m.clockSkew, err11 = meter.Float64Histogram(
+		"message_clock_skew_seconds",
+		metric.WithDescription("Difference between message timestamps and the local clock when they are received"),
+		metric.WithUnit("s"),
+	)
+
+	m.buildInfo, err12 = meter.Int64ObservableGauge(
+		"build_info",
+		metric.WithDescription("Always 1, with the version and commit of the running build as attributes"),
+		metric.WithInt64Callback(func(ctx context.Context, o metric.Int64Observer) error {
+			o.Observe(1, metric.WithAttributes(
+				attribute.String("version", version),
+				attribute.String("commit", commit),
+				attribute.String("go_version", runtime.Version()),
+			))
+			return nil
+		}),
+	)
+
+	m.backpressurePause, err13 = meter.Float64Histogram(
+		"backpressure_pause_duration_seconds",
+		metric.WithDescription("Time spent not reading from matterbridge while the route queues drained"),
+		metric.WithUnit("s"),
+	)
+	m.backpressurePaused, err14 = meter.Float64ObservableGauge(
+		"backpressure_paused_seconds",
+		metric.WithDescription("Seconds reading from matterbridge has currently been paused for, or 0 if it isn't"),
+		metric.WithUnit("s"),
+		metric.WithFloat64Callback(func(ctx context.Context, o metric.Float64Observer) error {
+			o.Observe(backpressure.pausedFor().Seconds())
+			return nil
+		}),
+	)
+	m.queueDepth, err15 = meter.Int64ObservableGauge(
+		"route_queue_depth",
+		metric.WithDescription("Number of messages waiting to be delivered by each route"),
+		metric.WithInt64Callback(func(ctx context.Context, o metric.Int64Observer) error {
+			eachQueueDepth(func(route string, depth int) {
+				o.Observe(int64(depth), metric.WithAttributes(attribute.String("destination", route)))
+			})
+			return nil
+		}),
+	)
+	m.requestsInFlight, err16 = meter.Int64ObservableGauge(
+		"requests_in_flight",
+		metric.WithDescription("Number of requests to destinations waiting for a response"),
+		metric.WithInt64Callback(func(ctx context.Context, o metric.Int64Observer) error {
+			o.Observe(inFlightRequests.Load())
+			return nil
+		}),
+	)
+	m.messageAge, err17 = meter.Float64Histogram(
+		"message_age_seconds",
+		metric.WithDescription("How long ago messages were sent, according to their timestamps, when they are received"),
+		metric.WithUnit("s"),
+	)
+
+	for _, err := range []error{err1, err2, err3, err4, err5, err6, err7, err8, err9, err10, err11, err12, err13, err14, err15, err16, err17} {
+		if err != nil {
+			return m, fmt.Errorf("failed to create metric: %v", err)
+		}
+	}
+
+	return m, nil
+}
+
+// routeMetrics are the metrics for a single route
+type routeMetrics struct {
+	messageForwarded metric.Int64Counter
+	messageDropped   metric.Int64Counter
+	processingError  metric.Int64Counter
+	commandSlaMet    metric.Int64Counter
+	commandSlaMissed metric.Int64Counter
+	webhookFailover  metric.Int64Counter
+	webhookThrottled metric.Int64Counter
+}
+
+// routeScope is the telemetry for a route, in an instrumentation scope named after it, so each
+// integration can be told apart in deployments with many routes
+type routeScope struct {
+	tracer  trace.Tracer
+	metrics routeMetrics
+}
+
+var (
+	routeScopesMu sync.Mutex
+	routeScopes   = map[string]*routeScope{}
+)
+
+// scopeFor returns the telemetry scope for a route, creating it the first time the route is used
+func scopeFor(route Route) *routeScope {
+	routeScopesMu.Lock()
+	defer routeScopesMu.Unlock()
+
+	if scope, ok := routeScopes[route.Name]; ok {
+		return scope
+	}
+
+	scopeName := name + "/routes/" + route.Name
+	m, err := initRouteMetrics(otel.Meter(scopeName))
+	if err != nil {
+		slog.Warn("failed to create route metrics", "route", route.Name, slog.Any("error", err))
+	}
+	scope := &routeScope{tracer: otel.Tracer(scopeName), metrics: m}
+	routeScopes[route.Name] = scope
+	return scope
+}
+
+func initRouteMetrics(meter metric.Meter) (routeMetrics, error) {
+	m := routeMetrics{}
+
+	var err1, err2, err3, err4, err5, err6, err7 error
+
+	m.messageForwarded, err1 = lifetimeCounter(
+		meter,
 		"messages_forwarded_total",
 		metric.WithDescription("Total number of messages forwarded to the webhook"),
 	)
-	m.messageDropped, err3 = meter.Int64Counter(
+	m.messageDropped, err2 = lifetimeCounter(
+		meter,
 		"messages_dropped_total",
 		metric.WithDescription("Total number of messages not eligable for forwarding"),
 	)
-	m.processingError, err4 = meter.Int64Counter(
+	m.processingError, err3 = lifetimeCounter(
+		meter,
 		"processing_errors_total",
 		metric.WithDescription("Total number of processing errors"),
 	)
+	m.commandSlaMet, err4 = lifetimeCounter(
+		meter,
+		"command_response_sla_met_total",
+		metric.WithDescription("Total number of forwarded commands the webhook responded to within the SLA"),
+	)
+	m.commandSlaMissed, err5 = lifetimeCounter(
+		meter,
+		"command_response_sla_missed_total",
+		metric.WithDescription("Total number of forwarded commands the webhook failed to respond to within the SLA"),
+	)
+	m.webhookFailover, err6 = lifetimeCounter(
+		meter,
+		"webhook_failovers_total",
+		metric.WithDescription("Total number of messages moved on to the next failover webhook"),
+	)
+	m.webhookThrottled, err7 = lifetimeCounter(
+		meter,
+		"webhook_throttled_total",
+		metric.WithDescription("Total number of messages the webhook asked to be sent later with a 429 response"),
+	)
 
-	for _, err := range []error{err1, err2, err3, err4} {
+	for _, err := range []error{err1, err2, err3, err4, err5, err6, err7} {
 		if err != nil {
 			return m, fmt.Errorf("failed to create metric: %v", err)
 		}
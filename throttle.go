@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxRetryAfter is the longest a webhook can hold up its route for, so a mistaken header can't
+// stall delivery for days
+const maxRetryAfter = 10 * time.Minute
+
+// maxThrottledAttempts is how many times messages are sent to a webhook that keeps asking for them
+// to be sent later, before they fail like any other error
+const maxThrottledAttempts = 5
+
+// throttledError is a 429 response from a webhook that said how long to wait before sending again
+type throttledError struct {
+	retryAfter time.Duration
+	err        error
+}
+
+func (e *throttledError) Error() string {
+	return e.err.Error()
+}
+
+func (e *throttledError) Unwrap() error {
+	return e.err
+}
+
+// parseRetryAfter reads a Retry-After header, which is either a number of seconds or a date
+func parseRetryAfter(header string, now time.Time) (time.Duration, bool) {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return 0, false
+	}
+	var wait time.Duration
+	if seconds, err := strconv.Atoi(header); err == nil {
+		wait = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(header); err == nil {
+		wait = date.Sub(now)
+	} else {
+		return 0, false
+	}
+	return min(max(wait, 0), maxRetryAfter), true
+}
+
+// throttle holds up a route's deliveries while its webhook has asked for time
+type throttle struct {
+	mu    sync.Mutex
+	until time.Time
+}
+
+// hold stops deliveries for a while, unless they are already held up for longer
+func (t *throttle) hold(wait time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if until := time.Now().Add(wait); until.After(t.until) {
+		t.until = until
+	}
+}
+
+// wait blocks until deliveries aren't held up any more, or the context is done, so shutting down
+// isn't held up by a webhook that asked for time
+func (t *throttle) wait(ctx context.Context) error {
+	t.mu.Lock()
+	until := t.until
+	t.mu.Unlock()
+	wait := time.Until(until)
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestThrottleWait(t *testing.T) {
+	th := &throttle{}
+	if err := th.wait(context.Background()); err != nil {
+		t.Errorf("expected no wait without a hold, got %v", err)
+	}
+
+	th.hold(50 * time.Millisecond)
+	start := time.Now()
+	if err := th.wait(context.Background()); err != nil {
+		t.Errorf("expected the hold to pass, got %v", err)
+	}
+	if waited := time.Since(start); waited < 40*time.Millisecond {
+		t.Errorf("expected to be held up, only waited %s", waited)
+	}
+}
+
+func TestThrottleWaitCancelled(t *testing.T) {
+	th := &throttle{}
+	th.hold(maxRetryAfter)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- th.wait(ctx) }()
+	cancel()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected the context's error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait wasn't stopped by the context")
+	}
+}
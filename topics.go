@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// topicTemplate renders the subject or topic a message is published to, such as
+// chat.{{.Gateway}}.{{.Channel}}. characters in the values that have a meaning to the broker are
+// replaced, so a value like a channel name always ends up as a single level.
+type topicTemplate struct {
+	tmpl      *template.Template
+	separator string
+	replacer  *strings.Replacer
+}
+
+// parseTopicTemplate parses a template for a broker that splits topics into levels with the
+// separator, replacing the broker's special characters with underscores
+func parseTopicTemplate(text string, separator string, special ...string) (*topicTemplate, error) {
+	if text == "" {
+		return nil, fmt.Errorf("a topic is required")
+	}
+	tmpl, err := template.New("topic").Option("missingkey=error").Parse(text)
+	if err == nil {
+		err = checkTemplateLoops(tmpl)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid topic: %v", err)
+	}
+
+	replacements := []string{separator, "_", " ", "_", "\t", "_", "\r", "_", "\n", "_"}
+	for _, s := range special {
+		replacements = append(replacements, s, "_")
+	}
+	return &topicTemplate{tmpl: tmpl, separator: separator, replacer: strings.NewReplacer(replacements...)}, nil
+}
+
+// render fills in the template for a message
+func (t *topicTemplate) render(msg Message) (string, error) {
+	fields := msg
+	fields.Text = t.replacer.Replace(msg.Text)
+	fields.Channel = t.replacer.Replace(msg.Channel)
+	fields.Username = t.replacer.Replace(msg.Username)
+	fields.Userid = t.replacer.Replace(msg.Userid)
+	fields.Account = t.replacer.Replace(msg.Account)
+	fields.Event = t.replacer.Replace(msg.Event)
+	fields.Protocol = t.replacer.Replace(msg.Protocol)
+	fields.Gateway = t.replacer.Replace(msg.Gateway)
+	fields.Source = t.replacer.Replace(msg.Source)
+
+	topic, err := executeTemplate(t.tmpl, fields)
+	if err != nil {
+		return "", withCause(causeBuildRequest, fmt.Errorf("failed to render topic: %v", err))
+	}
+	for _, level := range strings.Split(topic, t.separator) {
+		if level == "" {
+			return "", withCause(causeBuildRequest, fmt.Errorf("topic %s has an empty level", topic))
+		}
+	}
+	return topic, nil
+}
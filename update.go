@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+
+	"golang.org/x/mod/semver"
+)
+
+// releasesUrl is where self-update looks for the latest release
+const releasesUrl = "https://api.github.com/repos/jake-walker/matterbridge-to-webhook/releases/latest"
+
+// release is the part of a github release needed to update
+type release struct {
+	TagName string         `json:"tag_name"`
+	Assets  []releaseAsset `json:"assets"`
+}
+
+type releaseAsset struct {
+	Name        string `json:"name"`
+	DownloadUrl string `json:"browser_download_url"`
+}
+
+// runSelfUpdate replaces the running binary with the latest release, after checking it against
+// the release's checksums
+func runSelfUpdate(args []string) error {
+	flags := flag.NewFlagSet("self-update", flag.ContinueOnError)
+	checkOnly := flags.Bool("check-only", false, "only check whether an update is available")
+	force := flags.Bool("force", false, "update a development build to the latest release anyway")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	latest, err := fetchLatestRelease()
+	if err != nil {
+		return err
+	}
+	if latest.TagName == version {
+		fmt.Printf("already up to date (%s)\n", version)
+		return nil
+	}
+	// a development build never matches a release, but may well be newer than it
+	if devBuild(version) {
+		fmt.Printf("running a development build (%s), the latest release is %s\n", version, latest.TagName)
+		if *checkOnly {
+			return nil
+		}
+		if !*force {
+			return fmt.Errorf("not replacing a development build, use -force to update to %s anyway", latest.TagName)
+		}
+	} else {
+		newer, err := newerRelease(version, latest.TagName)
+		if err != nil {
+			return err
+		}
+		// the latest release can be older, like when this build is a pre-release
+		if !newer {
+			fmt.Printf("already up to date (%s), the latest release is %s\n", version, latest.TagName)
+			return nil
+		}
+		fmt.Printf("update available: %s -> %s\n", version, latest.TagName)
+		if *checkOnly {
+			return nil
+		}
+	}
+
+	name := fmt.Sprintf("matterbridge-to-webhook_%s_%s", runtime.GOOS, runtime.GOARCH)
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	binaryUrl, checksumsUrl := "", ""
+	for _, asset := range latest.Assets {
+		switch asset.Name {
+		case name:
+			binaryUrl = asset.DownloadUrl
+		case "checksums.txt":
+			checksumsUrl = asset.DownloadUrl
+		}
+	}
+	if binaryUrl == "" {
+		return fmt.Errorf("release %s has no binary for %s/%s", latest.TagName, runtime.GOOS, runtime.GOARCH)
+	}
+	if checksumsUrl == "" {
+		return fmt.Errorf("release %s has no checksums, not updating", latest.TagName)
+	}
+
+	expected, err := fetchChecksum(checksumsUrl, name)
+	if err != nil {
+		return err
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find the running binary: %v", err)
+	}
+	if executable, err = filepath.EvalSymlinks(executable); err != nil {
+		return fmt.Errorf("failed to find the running binary: %v", err)
+	}
+
+	// download next to the binary, so it can be renamed over it in one step
+	tmp, err := os.CreateTemp(filepath.Dir(executable), ".matterbridge-to-webhook-update-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	res, err := http.Get(binaryUrl)
+	if err != nil {
+		return fmt.Errorf("failed to download update: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to download update: %s", res.Status)
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, hash), res.Body); err != nil {
+		return fmt.Errorf("failed to download update: %v", err)
+	}
+	if actual := hex.EncodeToString(hash.Sum(nil)); actual != expected {
+		return fmt.Errorf("checksum of download does not match, not updating (expected %s, got %s)", expected, actual)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write update: %v", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0o755); err != nil {
+		return fmt.Errorf("failed to write update: %v", err)
+	}
+	if err := replaceExecutable(tmp.Name(), executable, runtime.GOOS); err != nil {
+		return err
+	}
+
+	fmt.Printf("updated to %s, restart to use it\n", latest.TagName)
+	return nil
+}
+
+// newerRelease reports whether the latest release is newer than the running version
+func newerRelease(current string, latest string) (bool, error) {
+	if !semver.IsValid(latest) {
+		return false, fmt.Errorf("latest release %s isn't a semantic version, not updating", latest)
+	}
+	if !semver.IsValid(current) {
+		return false, fmt.Errorf("version %s isn't a semantic version, so can't be compared with %s", current, latest)
+	}
+	return semver.Compare(latest, current) > 0, nil
+}
+
+// replaceExecutable moves the update over the binary. windows won't replace a running binary, but
+// lets it be renamed, so it is moved aside first and left to be removed by the next update.
+func replaceExecutable(update string, executable string, goos string) error {
+	if goos != "windows" {
+		if err := os.Rename(update, executable); err != nil {
+			return fmt.Errorf("failed to replace binary: %v", err)
+		}
+		return nil
+	}
+
+	old := executable + ".old"
+	if err := os.Remove(old); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove the binary left by the last update: %v", err)
+	}
+	if err := os.Rename(executable, old); err != nil {
+		return fmt.Errorf("failed to move the running binary aside: %v", err)
+	}
+	if err := os.Rename(update, executable); err != nil {
+		// put the running binary back, so there still is one
+		if restoreErr := os.Rename(old, executable); restoreErr != nil {
+			return fmt.Errorf("failed to replace binary: %v, and failed to restore it from %s: %v", err, old, restoreErr)
+		}
+		return fmt.Errorf("failed to replace binary: %v", err)
+	}
+	return nil
+}
+
+// pseudoVersion matches the versions go gives builds of commits that aren't tagged
+var pseudoVersion = regexp.MustCompile(`\d{14}-[0-9a-f]{12}(\+incompatible)?$`)
+
+// devBuild reports whether a version is from a build that isn't a release, so it can't be
+// compared with the releases
+func devBuild(version string) bool {
+	return version == "dev" || pseudoVersion.MatchString(version)
+}
+
+func fetchLatestRelease() (release, error) {
+	latest := release{}
+
+	req, err := http.NewRequest("GET", releasesUrl, nil)
+	if err != nil {
+		return latest, fmt.Errorf("failed to build request: %v", err)
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return latest, fmt.Errorf("failed to check for updates: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return latest, fmt.Errorf("failed to check for updates: %s", res.Status)
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(&latest); err != nil {
+		return latest, fmt.Errorf("failed to parse release: %v", err)
+	}
+	return latest, nil
+}
+
+// fetchChecksum finds the sha256 checksum of a file in a sha256sum style checksums file
+func fetchChecksum(checksumsUrl string, name string) (string, error) {
+	res, err := http.Get(checksumsUrl)
+	if err != nil {
+		return "", fmt.Errorf("failed to download checksums: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to download checksums: %s", res.Status)
+	}
+
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("failed to read checksums: %v", err)
+	}
+	return "", fmt.Errorf("no checksum for %s in the release, not updating", name)
+}
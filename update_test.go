@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDevBuild(t *testing.T) {
+	for version, dev := range map[string]bool{
+		"dev":                                  true,
+		"v0.0.0-20240101120000-abcdef123456":   true,
+		"v1.2.4-0.20240101120000-abcdef123456": true,
+		"v1.2.3":                               false,
+		"v1.2.3-rc.1":                          false,
+	} {
+		if got := devBuild(version); got != dev {
+			t.Errorf("expected devBuild(%q) to be %v", version, dev)
+		}
+	}
+}
+
+func TestNewerRelease(t *testing.T) {
+	for _, tc := range []struct {
+		current, latest string
+		newer           bool
+	}{
+		{"v1.2.3", "v1.3.0", true},
+		{"v1.2.3", "v1.2.3", false},
+		{"v1.10.0", "v1.9.0", false},
+		{"v1.3.0-rc.1", "v1.2.3", false},
+		{"v1.3.0-rc.1", "v1.3.0", true},
+	} {
+		newer, err := newerRelease(tc.current, tc.latest)
+		if err != nil || newer != tc.newer {
+			t.Errorf("expected %s to be newer than %s: %v, got %v, %v", tc.latest, tc.current, tc.newer, newer, err)
+		}
+	}
+	if _, err := newerRelease("v1.2.3", "latest"); err == nil {
+		t.Error("expected a release that isn't a version to fail")
+	}
+}
+
+func TestReplaceExecutable(t *testing.T) {
+	for _, goos := range []string{"linux", "windows"} {
+		dir := t.TempDir()
+		executable, update := filepath.Join(dir, "bridge"), filepath.Join(dir, "update")
+		os.WriteFile(executable, []byte("old"), 0o755)
+		os.WriteFile(update, []byte("new"), 0o755)
+
+		if err := replaceExecutable(update, executable, goos); err != nil {
+			t.Fatalf("%s: %v", goos, err)
+		}
+		if data, _ := os.ReadFile(executable); string(data) != "new" {
+			t.Errorf("%s: expected the binary to be replaced, got %q", goos, data)
+		}
+		_, err := os.Stat(executable + ".old")
+		if moved := err == nil; moved != (goos == "windows") {
+			t.Errorf("%s: unexpected binary moved aside: %v", goos, moved)
+		}
+	}
+}
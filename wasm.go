@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// wasmTransform runs every message through a webassembly module, which can change it, drop it or
+// turn it into several messages.
+//
+// the module must export its memory, an alloc(size) function returning a pointer to that many
+// bytes, and a transform(ptr, len) function which is given the message as json. transform returns
+// the pointer to its json output in the upper 32 bits of its result, and the length in the lower
+// 32 bits. the output is a message, or an array of messages which is empty to drop the message. if
+// the module exports free(ptr, len), it is called for the input and output once they are used.
+type wasmTransform struct {
+	timeout  time.Duration
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+	module   api.Module
+}
+
+// loadWasmTransform loads the module set in WASM_TRANSFORM, if there is one
+func loadWasmTransform(ctx context.Context) (*wasmTransform, error) {
+	path := os.Getenv("WASM_TRANSFORM")
+	if path == "" {
+		return nil, nil
+	}
+	timeout, err := durationEnv("WASM_TRANSFORM_TIMEOUT", 100*time.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+
+	code, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read wasm transform: %v", err)
+	}
+
+	// closing the module when the context is done is what enforces the timeout
+	runtime := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithCloseOnContextDone(true))
+	wasi_snapshot_preview1.MustInstantiate(ctx, runtime)
+
+	compiled, err := runtime.CompileModule(ctx, code)
+	if err != nil {
+		runtime.Close(ctx)
+		return nil, fmt.Errorf("failed to compile wasm transform: %v", err)
+	}
+	exports := compiled.ExportedFunctions()
+	for _, name := range []string{"alloc", "transform"} {
+		if _, ok := exports[name]; !ok {
+			runtime.Close(ctx)
+			return nil, fmt.Errorf("wasm transform must export a %s function", name)
+		}
+	}
+
+	t := &wasmTransform{timeout: timeout, runtime: runtime, compiled: compiled}
+	if err := t.instantiate(ctx); err != nil {
+		runtime.Close(ctx)
+		return nil, err
+	}
+	slog.Info("loaded wasm transform", "file", path)
+	return t, nil
+}
+
+// instantiate starts a new instance of the module, which is needed after one is closed for taking
+// too long
+func (t *wasmTransform) instantiate(ctx context.Context) error {
+	// reactor modules are initialised, and the main function of commands isn't run
+	config := wazero.NewModuleConfig().WithName("").WithStartFunctions("_initialize").WithStderr(os.Stderr)
+	module, err := t.runtime.InstantiateModule(ctx, t.compiled, config)
+	if err != nil {
+		return fmt.Errorf("failed to start wasm transform: %v", err)
+	}
+	t.module = module
+	return nil
+}
+
+func (t *wasmTransform) flag() string {
+	return flagWasmTransform
+}
+
+// apply runs the message through the module, returning the messages to deliver instead
+func (t *wasmTransform) apply(ctx context.Context, msg Message) ([]transformed, error) {
+	if t.module.IsClosed() {
+		if err := t.instantiate(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	input, err := json.Marshal(msg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal message: %v", err)
+	}
+
+	callCtx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+
+	res, err := t.module.ExportedFunction("alloc").Call(callCtx, uint64(len(input)))
+	if err != nil {
+		return nil, fmt.Errorf("wasm alloc failed: %v", err)
+	}
+	inputPtr := uint32(res[0])
+	if !t.module.Memory().Write(inputPtr, input) {
+		return nil, fmt.Errorf("wasm alloc returned memory out of range")
+	}
+
+	res, err = t.module.ExportedFunction("transform").Call(callCtx, uint64(inputPtr), uint64(len(input)))
+	if err != nil {
+		return nil, fmt.Errorf("wasm transform failed: %v", err)
+	}
+	outputPtr, outputLen := uint32(res[0]>>32), uint32(res[0])
+	view, ok := t.module.Memory().Read(outputPtr, outputLen)
+	if !ok {
+		return nil, fmt.Errorf("wasm transform returned memory out of range")
+	}
+	output := bytes.Clone(view)
+
+	if free := t.module.ExportedFunction("free"); free != nil {
+		free.Call(callCtx, uint64(inputPtr), uint64(len(input)))
+		free.Call(callCtx, uint64(outputPtr), uint64(outputLen))
+	}
+
+	msgs := []Message{}
+	output = bytes.TrimSpace(output)
+	if len(output) > 0 && output[0] == '[' {
+		err = json.Unmarshal(output, &msgs)
+	} else {
+		out := Message{}
+		err = json.Unmarshal(output, &out)
+		msgs = append(msgs, out)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("wasm transform returned invalid json: %v", err)
+	}
+
+	results := make([]transformed, len(msgs))
+	for i, out := range msgs {
+		results[i] = transformed{msg: out}
+	}
+	return results, nil
+}
+
+func (t *wasmTransform) close(ctx context.Context) error {
+	return t.runtime.Close(ctx)
+}
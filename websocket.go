@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/gorilla/websocket"
+	"github.com/jake-walker/matterbridge-to-webhook/pkg/bridge"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// websocketDialer is replaced when connections go through a proxy
+var websocketDialer = websocket.DefaultDialer
+
+// getWebsocketMessages reads messages from the matterbridge websocket until it fails or the context
+// is cancelled. pings are sent on an interval, and the connection is considered dead if no pong
+// arrives in time.
+func getWebsocketMessages(ctx context.Context, src *source, pingInterval time.Duration, maxMessageBytes int, onConnect func(), b backoff.BackOff, c chan queuedMessage) error {
+	// reuse the api request for the url and auth headers
+	req, err := src.newRequest(ctx, "GET", "/api/websocket")
+	if err != nil {
+		return backoff.Permanent(err)
+	}
+	wsUrl := req.URL
+	wsUrl.Scheme = strings.Replace(wsUrl.Scheme, "http", "ws", 1)
+
+	conn, res, err := websocketDialer.DialContext(ctx, wsUrl.String(), req.Header)
+	if ctx.Err() != nil {
+		return backoff.Permanent(ctx.Err())
+	} else if err != nil {
+		if res != nil {
+			return fmt.Errorf("failed to connect to websocket: %v (%s)", err, res.Status)
+		}
+		return fmt.Errorf("failed to connect to websocket: %v", err)
+	}
+	defer conn.Close()
+	// oversized messages fail the read, and the connection is restarted
+	conn.SetReadLimit(int64(maxMessageBytes))
+
+	src.health.setConnected(true)
+	defer src.health.setConnected(false)
+
+	slog.Info("listening for messages over websocket...", "source", src.name)
+	onConnect()
+
+	// a pong pushes the deadline back, so a connection that stops answering will fail the read
+	pongWait := 2 * pingInterval
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		src.health.received()
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	// closing the connection once the context is cancelled stops the read waiting for a message
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(pingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				conn.Close()
+				return
+			case <-ticker.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(pingInterval)); err != nil {
+					slog.Debug("failed to send websocket ping", "error", err)
+				}
+			}
+		}
+	}()
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if ctx.Err() != nil {
+			return backoff.Permanent(ctx.Err())
+		} else if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				return fmt.Errorf("websocket closed by matterbridge: %v", err)
+			}
+			metrics.processingError.Add(context.Background(), 1, metric.WithAttributes(stageAttribute(stageRead), causeAttribute(causeStreamRead)))
+			return fmt.Errorf("failed to read messages: %v", err)
+		}
+		src.health.received()
+		conn.SetReadDeadline(time.Now().Add(pongWait))
+
+		msg := Message{}
+		stageStart := time.Now()
+		err = json.Unmarshal(data, &msg)
+		recordStage(context.Background(), stageRead, stageStart)
+
+		if err != nil {
+			metrics.processingError.Add(context.Background(), 1, metric.WithAttributes(stageAttribute(stageRead), causeAttribute(causeUnmarshal)))
+			slog.Warn("failed to unmarshal message, skipping", "message", bridge.Truncate(data), "error", err)
+			continue
+		}
+
+		if msg.Event != "" {
+			slog.Info(fmt.Sprintf("received %s event", msg.Event))
+			continue
+		}
+
+		recordClockSkew(src, msg)
+		enqueueMessage(src, msg, c)
+		// backpressure can hold up the message for longer than the deadline
+		conn.SetReadDeadline(time.Now().Add(pongWait))
+		b.Reset()
+	}
+}